@@ -1,7 +1,11 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/jimmyjames85/proxysqlapi/pkg/server"
 	"github.com/kelseyhightower/envconfig"
@@ -13,10 +17,34 @@ func main() {
 
 	srv, err := server.New(cfg)
 	if err != nil {
-		log.Fatalf("err loading config: %v", err)
+		slog.Error("err loading config", "error", err)
+		os.Exit(1)
 	}
+
+	go func() {
+		sigs := make(chan os.Signal, 2)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		slog.Info("shutting down", "signal", sig.String(), "timeout", cfg.ShutdownTimeout.String())
+
+		// a second signal skips the graceful shutdown
+		go func() {
+			sig := <-sigs
+			slog.Error("exiting immediately", "signal", sig.String())
+			os.Exit(1)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("shutdown", "error", err)
+		}
+	}()
+
 	err = srv.Serve()
 	if err != nil {
-		log.Fatalf("server failure: %v", err)
+		slog.Error("server failure", "error", err)
+		os.Exit(1)
 	}
+	slog.Info("shut down")
 }
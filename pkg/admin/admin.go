@@ -3,14 +3,24 @@ package admin
 import (
 	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
+// Layer is one of the three copies ProxySQL keeps of every config
+// table
+type Layer string
+
+const (
+	LayerMemory  Layer = "memory"  // e.g. mysql_servers, changed by the admin interface
+	LayerRuntime Layer = "runtime" // e.g. runtime_mysql_servers, in use
+	LayerDisk    Layer = "disk"    // e.g. disk.mysql_servers, loaded on restart
+)
+
 /*//////////////////////////////////////////////////////////////////////*/
 
 // MysqlQueryRule represents a row in the runtime_mysql_query_rules
@@ -135,19 +145,19 @@ func NewMysqlQueryRule() *MysqlQueryRule {
 
 func (r *MysqlQueryRule) ToJSON() string { return toJSON(r) }
 
-func LoadMysqlQueryRulesToRuntime(db *sql.DB) error {
+func LoadMysqlQueryRulesToRuntime(db DB) error {
 	stmt := `LOAD MYSQL QUERY RULES TO RUNTIME`
 	_, err := db.Exec(stmt)
-	return err
+	return tableError("mysql_query_rules", "", err)
 }
 
-func DropMysqlQueryRules(db *sql.DB) error {
+func DropMysqlQueryRules(db DB) error {
 	stmt := `DELETE FROM mysql_query_rules`
 	_, err := db.Exec(stmt)
-	return err
+	return tableError("mysql_query_rules", "", err)
 }
 
-func InsertMysqlQueryRules(db *sql.DB, rules ...MysqlQueryRule) error {
+func InsertMysqlQueryRules(db DB, rules ...MysqlQueryRule) error {
 	if len(rules) == 0 {
 		return nil
 	}
@@ -190,7 +200,6 @@ func InsertMysqlQueryRules(db *sql.DB, rules ...MysqlQueryRule) error {
 
 	args := make([]interface{}, colLen*len(rules))
 	for i, r := range rules {
-		log.Printf("%s\n\n", r.ToJSON())
 		args[colLen*i+0] = r.RuleID
 		args[colLen*i+1] = r.Active
 		args[colLen*i+2] = r.Username
@@ -226,35 +235,53 @@ func InsertMysqlQueryRules(db *sql.DB, rules ...MysqlQueryRule) error {
 
 	_, err := db.Exec(stmt, args...)
 	if err != nil {
-		fmt.Printf("STATEMENT: %s\n\n", stmt)
-		fmt.Printf("len(args): %d\n\n", len(args))
-		return err
+		return insertError("mysql_query_rules", mysqlQueryRuleRows(rules, false), err)
 	}
 	return nil
 }
 
-func SetMysqlQueryRules(db *sql.DB, rules ...MysqlQueryRule) error {
-	err := DropMysqlQueryRules(db)
+// SetMysqlQueryRules replaces the contents of mysql_query_rules with rules. If
+// the insert fails the previous rows are restored.
+func SetMysqlQueryRules(db DB, rules ...MysqlQueryRule) error {
+	prev, err := SelectMysqlQueryRules(db)
 	if err != nil {
 		return err
 	}
 
+	// a cancelled DELETE may still have run, so restore prev too
+	restore := func() error {
+		db := detached(db)
+		if err := DropMysqlQueryRules(db); err != nil {
+			return err
+		}
+		return InsertMysqlQueryRules(db, prev...)
+	}
+
+	err = DropMysqlQueryRules(db)
+	if err != nil {
+		return rollback("mysql_query_rules", err, restore)
+	}
+
 	err = InsertMysqlQueryRules(db, rules...)
 	if err != nil {
-		return err
+		return rollback("mysql_query_rules", err, restore)
 	}
 	return nil
 }
 
-func SelectMysqlQueryRules(db *sql.DB) ([]MysqlQueryRule, error) {
-	return selectMysqlQueryRules(db, false)
+func SelectMysqlQueryRules(db DB) ([]MysqlQueryRule, error) {
+	return selectMysqlQueryRules(db, LayerMemory)
+}
+
+func SelectRuntimeMysqlQueryRules(db DB) ([]MysqlQueryRule, error) {
+	return selectMysqlQueryRules(db, LayerRuntime)
 }
 
-func SelectRuntimeMysqlQueryRules(db *sql.DB) ([]MysqlQueryRule, error) {
-	return selectMysqlQueryRules(db, true)
+func SelectDiskMysqlQueryRules(db DB) ([]MysqlQueryRule, error) {
+	return selectMysqlQueryRules(db, LayerDisk)
 }
 
-func selectMysqlQueryRules(db *sql.DB, runtime bool) ([]MysqlQueryRule, error) {
+func selectMysqlQueryRules(db DB, layer Layer) ([]MysqlQueryRule, error) {
 	var ret []MysqlQueryRule
 	stmt := `SELECT
 		 rule_id,
@@ -289,10 +316,11 @@ func selectMysqlQueryRules(db *sql.DB, runtime bool) ([]MysqlQueryRule, error) {
 		 apply,
 		 comment
 		 FROM %s;`
-	stmt = fmt.Sprintf(stmt, prependRuntime("mysql_query_rules", runtime))
+	tbl := layerTable("mysql_query_rules", layer)
+	stmt = fmt.Sprintf(stmt, tbl)
 	rows, err := db.Query(stmt)
 	if err != nil {
-		return ret, err
+		return ret, tableError(tbl, "", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -340,7 +368,7 @@ func selectMysqlQueryRules(db *sql.DB, runtime bool) ([]MysqlQueryRule, error) {
 			&comment,
 		)
 		if err != nil {
-			return ret, err
+			return ret, tableError(tbl, "", err)
 		}
 
 		if username.Valid {
@@ -426,7 +454,7 @@ func selectMysqlQueryRules(db *sql.DB, runtime bool) ([]MysqlQueryRule, error) {
 	}
 	err = rows.Err()
 	if err != nil {
-		return ret, err
+		return ret, tableError(tbl, "", err)
 	}
 	return ret, nil
 }
@@ -462,7 +490,7 @@ func (u *MysqlUser) UnmarshalJSON(data []byte) error {
 	}
 	*u = MysqlUser(d)
 	if u.Username == nil {
-		return fmt.Errorf("mysql_user.username cannot be null")
+		return invalid("mysql_users", "", "username cannot be null")
 	}
 	return nil
 }
@@ -503,19 +531,73 @@ func NewMysqlUser(username string) *MysqlUser {
 
 func (u *MysqlUser) ToJSON() string { return toJSON(u) }
 
-func LoadMysqlUsersToRuntime(db *sql.DB) error {
+// RedactedPassword replaces passwords removed by RedactMysqlUsers
+const RedactedPassword = "****"
+
+// RedactMysqlUsers returns a copy of users with every non-null
+// password replaced by RedactedPassword
+func RedactMysqlUsers(users []MysqlUser) []MysqlUser {
+	ret := make([]MysqlUser, len(users))
+	for i, u := range users {
+		if u.Password != nil {
+			pw := RedactedPassword
+			u.Password = &pw
+		}
+		ret[i] = u
+	}
+	return ret
+}
+
+// restoreRedactedPasswords returns a copy of users in which every
+// RedactedPassword is replaced by the password stored for the same
+// username and backend, so users read back redacted, e.g. from GET
+// /mysql_users or a redacted /config export, can be written as they
+// are. A redacted password with no stored password to restore is a
+// validation error.
+func restoreRedactedPasswords(users, stored []MysqlUser) ([]MysqlUser, error) {
+	passwords := make(map[string]*string)
+	for _, u := range stored {
+		if u.Username != nil {
+			passwords[mysqlUserKey(u)] = u.Password
+		}
+	}
+	ret := make([]MysqlUser, len(users))
+	for i, u := range users {
+		if u.Username != nil && u.Password != nil && *u.Password == RedactedPassword {
+			pw := passwords[mysqlUserKey(u)]
+			if pw == nil {
+				return nil, invalid("mysql_users", mysqlUserKey(u), fmt.Sprintf("%q is the placeholder for redacted passwords, set a password", RedactedPassword))
+			}
+			u.Password = pw
+		}
+		ret[i] = u
+	}
+	return ret, nil
+}
+
+// mysqlUserKey identifies a mysql_users row, which ProxySQL keys by
+// username and backend
+func mysqlUserKey(u MysqlUser) string {
+	username := ""
+	if u.Username != nil {
+		username = *u.Username
+	}
+	return fmt.Sprintf("%s:%d", username, u.Backend)
+}
+
+func LoadMysqlUsersToRuntime(db DB) error {
 	stmt := `LOAD MYSQL USERS TO RUNTIME`
 	_, err := db.Exec(stmt)
-	return err
+	return tableError("mysql_users", "", err)
 }
 
-func DropMysqlUsers(db *sql.DB) error {
+func DropMysqlUsers(db DB) error {
 	stmt := `DELETE FROM mysql_users`
 	_, err := db.Exec(stmt)
-	return err
+	return tableError("mysql_users", "", err)
 }
 
-func InsertMysqlUsers(db *sql.DB, users ...MysqlUser) error {
+func InsertMysqlUsers(db DB, users ...MysqlUser) error {
 	if len(users) == 0 {
 		return nil
 	}
@@ -540,7 +622,7 @@ func InsertMysqlUsers(db *sql.DB, users ...MysqlUser) error {
 	args := make([]interface{}, colLen*len(users))
 	for i, u := range users {
 		if u.Username == nil {
-			return errors.New("username cannot be nil")
+			return invalid("mysql_users", fmt.Sprintf("#%d", i+1), "username cannot be nil")
 		}
 		args[colLen*i+0] = u.Username
 		args[colLen*i+1] = u.Password
@@ -558,33 +640,58 @@ func InsertMysqlUsers(db *sql.DB, users ...MysqlUser) error {
 
 	_, err := db.Exec(stmt, args...)
 	if err != nil {
-		return err
+		return insertError("mysql_users", mysqlUserRows(users, nil), err)
 	}
 
 	return nil
 }
 
-func SetMysqlUsers(db *sql.DB, users ...MysqlUser) error {
-	err := DropMysqlUsers(db)
+// SetMysqlUsers replaces the contents of mysql_users with users. If
+// the insert fails the previous rows are restored. Users with a
+// RedactedPassword keep their stored password.
+func SetMysqlUsers(db DB, users ...MysqlUser) error {
+	prev, err := SelectMysqlUsers(db)
 	if err != nil {
 		return err
 	}
+	if users, err = restoreRedactedPasswords(users, prev); err != nil {
+		return err
+	}
+
+	// a cancelled DELETE may still have run, so restore prev too
+	restore := func() error {
+		db := detached(db)
+		if err := DropMysqlUsers(db); err != nil {
+			return err
+		}
+		return InsertMysqlUsers(db, prev...)
+	}
+
+	err = DropMysqlUsers(db)
+	if err != nil {
+		return rollback("mysql_users", err, restore)
+	}
+
 	err = InsertMysqlUsers(db, users...)
 	if err != nil {
-		return err
+		return rollback("mysql_users", err, restore)
 	}
 	return nil
 }
 
-func SelectRuntimeMysqlUsers(db *sql.DB) ([]MysqlUser, error) {
-	return selectMysqlUsers(db, true)
+func SelectRuntimeMysqlUsers(db DB) ([]MysqlUser, error) {
+	return selectMysqlUsers(db, LayerRuntime)
+}
+
+func SelectMysqlUsers(db DB) ([]MysqlUser, error) {
+	return selectMysqlUsers(db, LayerMemory)
 }
 
-func SelectMysqlUsers(db *sql.DB) ([]MysqlUser, error) {
-	return selectMysqlUsers(db, false)
+func SelectDiskMysqlUsers(db DB) ([]MysqlUser, error) {
+	return selectMysqlUsers(db, LayerDisk)
 }
 
-func selectMysqlUsers(db *sql.DB, runtime bool) ([]MysqlUser, error) {
+func selectMysqlUsers(db DB, layer Layer) ([]MysqlUser, error) {
 	var ret []MysqlUser
 	stmt := `SELECT
 		 username,
@@ -600,10 +707,11 @@ func selectMysqlUsers(db *sql.DB, runtime bool) ([]MysqlUser, error) {
 		 frontend,
 		 max_connections
 		 FROM %s;`
-	stmt = fmt.Sprintf(stmt, prependRuntime("mysql_users", runtime))
+	tbl := layerTable("mysql_users", layer)
+	stmt = fmt.Sprintf(stmt, tbl)
 	rows, err := db.Query(stmt)
 	if err != nil {
-		return ret, err
+		return ret, tableError(tbl, "", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -626,7 +734,7 @@ func selectMysqlUsers(db *sql.DB, runtime bool) ([]MysqlUser, error) {
 			&u.MaxConnections,
 		)
 		if err != nil {
-			return ret, err
+			return ret, tableError(tbl, "", err)
 		}
 
 		if password.Valid {
@@ -641,7 +749,7 @@ func selectMysqlUsers(db *sql.DB, runtime bool) ([]MysqlUser, error) {
 	}
 	err = rows.Err()
 	if err != nil {
-		return ret, err
+		return ret, tableError(tbl, "", err)
 	}
 	return ret, nil
 }
@@ -674,7 +782,7 @@ func (s *MysqlServer) UnmarshalJSON(data []byte) error {
 	}
 	*s = MysqlServer(d)
 	if s.Hostname == nil {
-		return fmt.Errorf("mysql_server.hostname cannot be null")
+		return invalid("mysql_servers", "", "hostname cannot be null")
 	}
 	return nil
 }
@@ -711,25 +819,92 @@ func NewMysqlServer(hostname string) *MysqlServer {
 
 func (s *MysqlServer) ToJSON() string { return toJSON(s) }
 
-func LoadMysqlServersToRuntime(db *sql.DB) error {
+// Valid values of MysqlServer.Status
+const (
+	MysqlServerStatusOnline      = "ONLINE"
+	MysqlServerStatusShunned     = "SHUNNED"
+	MysqlServerStatusOfflineSoft = "OFFLINE_SOFT"
+	MysqlServerStatusOfflineHard = "OFFLINE_HARD"
+)
+
+func LoadMysqlServersToRuntime(db DB) error {
 	stmt := `LOAD MYSQL SERVERS TO RUNTIME`
 	_, err := db.Exec(stmt)
-	return err
+	return tableError("mysql_servers", "", err)
 }
 
-func DropMysqlServers(db *sql.DB) error {
+func DropMysqlServers(db DB) error {
 	stmt := `DELETE FROM mysql_servers`
 	_, err := db.Exec(stmt)
-	return err
+	return tableError("mysql_servers", "", err)
 }
 
-func DropMysqlServerHostgroup(db *sql.DB, hostgroupID int) error {
+func DropMysqlServerHostgroup(db DB, hostgroupID int) error {
 	stmt := `DELETE FROM mysql_servers WHERE hostgroup_id = ?`
 	_, err := db.Exec(stmt, hostgroupID)
-	return err
+	return tableError("mysql_servers", fmt.Sprintf("%d", hostgroupID), err)
 }
 
-func InsertMysqlServers(db *sql.DB, servers ...MysqlServer) error {
+// UpdateMysqlServer updates every column of the mysql_servers row
+// with the same primary key (hostgroup_id, hostname, port) as s. An
+// error is returned if no such row exists.
+func UpdateMysqlServer(db DB, s MysqlServer) error {
+	if s.Hostname == nil {
+		return invalid("mysql_servers", "", "hostname cannot be nil")
+	}
+	row := fmt.Sprintf("%d:%s:%d", s.HostgroupID, *s.Hostname, s.Port)
+	stmt := `UPDATE mysql_servers SET
+		 status = ?,
+		 weight = ?,
+		 compression = ?,
+		 max_connections = ?,
+		 max_replication_lag = ?,
+		 use_ssl = ?,
+		 max_latency_ms = ?,
+		 comment = ?
+		 WHERE hostgroup_id = ? AND hostname = ? AND port = ?`
+	res, err := db.Exec(stmt,
+		s.Status,
+		s.Weight,
+		s.Compression,
+		s.MaxConnections,
+		s.MaxReplicationLag,
+		s.UseSSL,
+		s.MaxLatencyMS,
+		s.Comment,
+		s.HostgroupID,
+		s.Hostname,
+		s.Port,
+	)
+	if err != nil {
+		return tableError("mysql_servers", row, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return tableError("mysql_servers", row, err)
+	}
+	if n == 0 {
+		return NotFound("mysql_servers", row)
+	}
+	return nil
+}
+
+// SelectMysqlServer returns the mysql_servers row with the given
+// primary key or nil if no such row exists
+func SelectMysqlServer(db DB, hostgroupID int, hostname string, port int) (*MysqlServer, error) {
+	servers, err := SelectMysqlServers(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range servers {
+		if s.HostgroupID == hostgroupID && s.Hostname != nil && *s.Hostname == hostname && s.Port == port {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+func InsertMysqlServers(db DB, servers ...MysqlServer) error {
 	if len(servers) == 0 {
 		return nil
 	}
@@ -753,7 +928,7 @@ func InsertMysqlServers(db *sql.DB, servers ...MysqlServer) error {
 	args := make([]interface{}, colLen*len(servers))
 	for i, s := range servers {
 		if s.Hostname == nil {
-			return errors.New("hostname cannot be nil")
+			return invalid("mysql_servers", fmt.Sprintf("#%d", i+1), "hostname cannot be nil")
 		}
 		args[colLen*i+0] = s.HostgroupID
 		args[colLen*i+1] = s.Hostname
@@ -770,32 +945,53 @@ func InsertMysqlServers(db *sql.DB, servers ...MysqlServer) error {
 
 	_, err := db.Exec(stmt, args...)
 	if err != nil {
-		return err
+		return insertError("mysql_servers", mysqlServerRows(servers), err)
 	}
 	return nil
 }
 
-func SetMysqlServers(db *sql.DB, servers ...MysqlServer) error {
-	err := DropMysqlServers(db)
+// SetMysqlServers replaces the contents of mysql_servers with servers. If
+// the insert fails the previous rows are restored.
+func SetMysqlServers(db DB, servers ...MysqlServer) error {
+	prev, err := SelectMysqlServers(db)
 	if err != nil {
 		return err
 	}
+
+	// a cancelled DELETE may still have run, so restore prev too
+	restore := func() error {
+		db := detached(db)
+		if err := DropMysqlServers(db); err != nil {
+			return err
+		}
+		return InsertMysqlServers(db, prev...)
+	}
+
+	err = DropMysqlServers(db)
+	if err != nil {
+		return rollback("mysql_servers", err, restore)
+	}
+
 	err = InsertMysqlServers(db, servers...)
 	if err != nil {
-		return err
+		return rollback("mysql_servers", err, restore)
 	}
 	return nil
 }
 
-func SelectMysqlServers(db *sql.DB) ([]MysqlServer, error) {
-	return selectMysqlServers(db, false)
+func SelectMysqlServers(db DB) ([]MysqlServer, error) {
+	return selectMysqlServers(db, LayerMemory)
 }
 
-func SelectRuntimeMysqlServers(db *sql.DB) ([]MysqlServer, error) {
-	return selectMysqlServers(db, true)
+func SelectRuntimeMysqlServers(db DB) ([]MysqlServer, error) {
+	return selectMysqlServers(db, LayerRuntime)
 }
 
-func selectMysqlServers(db *sql.DB, runtime bool) ([]MysqlServer, error) {
+func SelectDiskMysqlServers(db DB) ([]MysqlServer, error) {
+	return selectMysqlServers(db, LayerDisk)
+}
+
+func selectMysqlServers(db DB, layer Layer) ([]MysqlServer, error) {
 	var ret []MysqlServer
 	stmt := `SELECT
 		 hostgroup_id,
@@ -810,10 +1006,11 @@ func selectMysqlServers(db *sql.DB, runtime bool) ([]MysqlServer, error) {
 		 max_latency_ms,
 		 comment
 		 FROM %s;`
-	stmt = fmt.Sprintf(stmt, prependRuntime("mysql_servers", runtime))
+	tbl := layerTable("mysql_servers", layer)
+	stmt = fmt.Sprintf(stmt, tbl)
 	rows, err := db.Query(stmt)
 	if err != nil {
-		return ret, err
+		return ret, tableError(tbl, "", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -832,13 +1029,13 @@ func selectMysqlServers(db *sql.DB, runtime bool) ([]MysqlServer, error) {
 			&r.Comment,
 		)
 		if err != nil {
-			return ret, err
+			return ret, tableError(tbl, "", err)
 		}
 		ret = append(ret, r)
 	}
 	err = rows.Err()
 	if err != nil {
-		return ret, err
+		return ret, tableError(tbl, "", err)
 	}
 	return ret, nil
 }
@@ -859,7 +1056,9 @@ type GlobalVariable struct {
 
 func (v *GlobalVariable) ToJSON() string { return toJSON(v) }
 
-// TODO verify `LOAD MYSQL VARIABLES TO RUNTIME` is the same as `LOAD ADMIN VARIABLES TO RUNTIME`
+// `LOAD MYSQL VARIABLES TO RUNTIME` only loads the mysql-* variables
+// and `LOAD ADMIN VARIABLES TO RUNTIME` only the admin-* variables, see
+// LoadGlobalVariablesToRuntime
 
 // TODO proxysql will silently error if setting a runtime variable to
 // an improper value e.g. a number out of range For example, try
@@ -867,27 +1066,42 @@ func (v *GlobalVariable) ToJSON() string { return toJSON(v) }
 // error, but proxysql will silenty reset `mysql-threads` to its
 // default value
 
-func LoadMysqlVariablesToRuntime(db *sql.DB) error {
+func LoadMysqlVariablesToRuntime(db DB) error {
 	stmt := `LOAD MYSQL VARIABLES TO RUNTIME`
 	_, err := db.Exec(stmt)
-	return err
+	return tableError("global_variables", "", err)
 }
 
-func LoadAdminVariablesToRuntime(db *sql.DB) error {
+func LoadAdminVariablesToRuntime(db DB) error {
 	stmt := `LOAD ADMIN VARIABLES TO RUNTIME`
 	_, err := db.Exec(stmt)
-	return err
+	return tableError("global_variables", "", err)
+}
+
+// LoadGlobalVariablesToRuntime loads both the mysql-* and admin-*
+// variables to runtime
+func LoadGlobalVariablesToRuntime(db DB) error {
+	if err := LoadMysqlVariablesToRuntime(db); err != nil {
+		return err
+	}
+	return LoadAdminVariablesToRuntime(db)
 }
 
-func UpdateGlobalVariable(db *sql.DB, name, value string) error {
+func UpdateGlobalVariable(db DB, name, value string) error {
 	stmt := `UPDATE global_variables SET variable_value=? WHERE variable_name=?;`
 	_, err := db.Exec(stmt, value, name)
-	return err
+	return tableError("global_variables", name, err)
 }
 
-func UpdateGlobalVariables(db *sql.DB, globalVariables map[string]string) error {
+// UpdateGlobalVariables sets every variable in globalVariables. Secret
+// variables set to RedactedPassword keep their value, so redacted
+// variables read back from the API can be written as they are.
+func UpdateGlobalVariables(db DB, globalVariables map[string]string) error {
 	// TODO how do I batch update in mysql
 	for name, value := range globalVariables {
+		if IsSecretGlobalVariable(name) && value == RedactedPassword {
+			continue
+		}
 		err := UpdateGlobalVariable(db, name, value)
 		if err != nil {
 			return err
@@ -896,37 +1110,252 @@ func UpdateGlobalVariables(db *sql.DB, globalVariables map[string]string) error
 	return nil
 }
 
-func SelectRuntimeGlobalVariables(db *sql.DB) (map[string]string, error) {
-	return selectGlobalVariables(db, true)
+func SelectRuntimeGlobalVariables(db DB) (map[string]string, error) {
+	return selectGlobalVariables(db, LayerRuntime)
 }
 
-func SelectGlobalVariables(db *sql.DB) (map[string]string, error) {
-	return selectGlobalVariables(db, false)
+func SelectGlobalVariables(db DB) (map[string]string, error) {
+	return selectGlobalVariables(db, LayerMemory)
 }
 
-func selectGlobalVariables(db *sql.DB, runtime bool) (map[string]string, error) {
+func SelectDiskGlobalVariables(db DB) (map[string]string, error) {
+	return selectGlobalVariables(db, LayerDisk)
+}
+
+func selectGlobalVariables(db DB, layer Layer) (map[string]string, error) {
 	ret := make(map[string]string)
 	stmt := `SELECT
 		 variable_name,
 		 variable_value
 		 FROM %s;`
-	stmt = fmt.Sprintf(stmt, prependRuntime("global_variables", runtime))
+	tbl := layerTable("global_variables", layer)
+	stmt = fmt.Sprintf(stmt, tbl)
 	rows, err := db.Query(stmt)
 	if err != nil {
-		return ret, err
+		return ret, tableError(tbl, "", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var v GlobalVariable
 		err = rows.Scan(&v.Name, &v.Value)
 		if err != nil {
-			return ret, err
+			return ret, tableError(tbl, "", err)
 		}
 		ret[v.Name] = v.Value
 	}
 	err = rows.Err()
 	if err != nil {
-		return ret, err
+		return ret, tableError(tbl, "", err)
+	}
+	return ret, nil
+}
+
+/*//////////////////////////////////////////////////////////////////////*/
+
+// Scheduler represents a row in the runtime_scheduler and scheduler
+// tables. The primary key is AUTOINCREMENT (id)
+type Scheduler struct {
+	ID         *int    `json:"id"` // id cannot be null but a default is provided (AUTOINCREMENT)
+	Active     int     `json:"active"`
+	IntervalMS int     `json:"interval_ms"`
+	Filename   *string `json:"filename"` // filename cannot be null, but no default is provided
+	Arg1       *string `json:"arg1"`
+	Arg2       *string `json:"arg2"`
+	Arg3       *string `json:"arg3"`
+	Arg4       *string `json:"arg4"`
+	Arg5       *string `json:"arg5"`
+	Comment    string  `json:"comment"`
+}
+
+func (s *Scheduler) UnmarshalJSON(data []byte) error {
+	type defaultScheduler Scheduler
+	d := defaultScheduler(*NewScheduler(""))
+	d.Filename = nil // Filename must be provided in data
+	err := json.Unmarshal(data, &d)
+	if err != nil {
+		return err
+	}
+	*s = Scheduler(d)
+	if s.Filename == nil {
+		return invalid("scheduler", "", "filename cannot be null")
+	}
+	return nil
+}
+
+// NewScheduler returns a scheduler entry with default values
+func NewScheduler(filename string) *Scheduler {
+	// CREATE TABLE scheduler (
+	//     id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	//     active INT CHECK (active IN (0,1)) NOT NULL DEFAULT 1,
+	//     interval_ms INTEGER CHECK (interval_ms>=100 AND interval_ms<=100000000) NOT NULL,
+	//     filename VARCHAR NOT NULL,
+	//     arg1 VARCHAR,
+	//     arg2 VARCHAR,
+	//     arg3 VARCHAR,
+	//     arg4 VARCHAR,
+	//     arg5 VARCHAR,
+	//     comment VARCHAR NOT NULL DEFAULT '')
+
+	// interval_ms has no default in the table, 10000 is the default
+	// ProxySQL uses when reading the scheduler from its config file
+	return &Scheduler{
+		ID:         nil,
+		Active:     1,
+		IntervalMS: 10000,
+		Filename:   &filename,
+		Arg1:       nil,
+		Arg2:       nil,
+		Arg3:       nil,
+		Arg4:       nil,
+		Arg5:       nil,
+		Comment:    "",
+	}
+}
+
+func (s *Scheduler) ToJSON() string { return toJSON(s) }
+
+func LoadSchedulerToRuntime(db DB) error {
+	stmt := `LOAD SCHEDULER TO RUNTIME`
+	_, err := db.Exec(stmt)
+	return tableError("scheduler", "", err)
+}
+
+func DropScheduler(db DB) error {
+	stmt := `DELETE FROM scheduler`
+	_, err := db.Exec(stmt)
+	return tableError("scheduler", "", err)
+}
+
+func InsertScheduler(db DB, entries ...Scheduler) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	colLen := 10
+	tpl := fmt.Sprintf("(?%s)", strings.Repeat(",?", colLen-1))
+	stmt := `INSERT INTO scheduler (
+		 id,
+		 active,
+		 interval_ms,
+		 filename,
+		 arg1,
+		 arg2,
+		 arg3,
+		 arg4,
+		 arg5,
+		 comment)
+		 VALUES ` + tpl
+	stmt = fmt.Sprintf("%s%s", stmt, strings.Repeat(","+tpl, len(entries)-1))
+
+	args := make([]interface{}, colLen*len(entries))
+	for i, s := range entries {
+		if s.Filename == nil {
+			return invalid("scheduler", fmt.Sprintf("#%d", i+1), "filename cannot be nil")
+		}
+		args[colLen*i+0] = s.ID
+		args[colLen*i+1] = s.Active
+		args[colLen*i+2] = s.IntervalMS
+		args[colLen*i+3] = s.Filename
+		args[colLen*i+4] = s.Arg1
+		args[colLen*i+5] = s.Arg2
+		args[colLen*i+6] = s.Arg3
+		args[colLen*i+7] = s.Arg4
+		args[colLen*i+8] = s.Arg5
+		args[colLen*i+9] = s.Comment
+	}
+
+	_, err := db.Exec(stmt, args...)
+	if err != nil {
+		return insertError("scheduler", schedulerRows(entries), err)
+	}
+	return nil
+}
+
+// SetScheduler replaces the contents of scheduler with entries. If the
+// insert fails the previous rows are restored.
+func SetScheduler(db DB, entries ...Scheduler) error {
+	prev, err := SelectScheduler(db)
+	if err != nil {
+		return err
+	}
+
+	// a cancelled DELETE may still have run, so restore prev too
+	restore := func() error {
+		db := detached(db)
+		if err := DropScheduler(db); err != nil {
+			return err
+		}
+		return InsertScheduler(db, prev...)
+	}
+
+	err = DropScheduler(db)
+	if err != nil {
+		return rollback("scheduler", err, restore)
+	}
+
+	err = InsertScheduler(db, entries...)
+	if err != nil {
+		return rollback("scheduler", err, restore)
+	}
+	return nil
+}
+
+func SelectScheduler(db DB) ([]Scheduler, error) {
+	return selectScheduler(db, LayerMemory)
+}
+
+func SelectRuntimeScheduler(db DB) ([]Scheduler, error) {
+	return selectScheduler(db, LayerRuntime)
+}
+
+func SelectDiskScheduler(db DB) ([]Scheduler, error) {
+	return selectScheduler(db, LayerDisk)
+}
+
+// selectScheduler never returns a nil slice, a nil
+// ProxySQLConfig.Scheduler means the scheduler is not managed
+func selectScheduler(db DB, layer Layer) ([]Scheduler, error) {
+	ret := []Scheduler{}
+	stmt := `SELECT
+		 id,
+		 active,
+		 interval_ms,
+		 filename,
+		 arg1,
+		 arg2,
+		 arg3,
+		 arg4,
+		 arg5,
+		 comment
+		 FROM %s;`
+	tbl := layerTable("scheduler", layer)
+	stmt = fmt.Sprintf(stmt, tbl)
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return ret, tableError(tbl, "", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Scheduler
+		err = rows.Scan(
+			&s.ID,
+			&s.Active,
+			&s.IntervalMS,
+			&s.Filename,
+			&s.Arg1,
+			&s.Arg2,
+			&s.Arg3,
+			&s.Arg4,
+			&s.Arg5,
+			&s.Comment,
+		)
+		if err != nil {
+			return ret, tableError(tbl, "", err)
+		}
+		ret = append(ret, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, tableError(tbl, "", err)
 	}
 	return ret, nil
 }
@@ -939,8 +1368,18 @@ type ProxySQLConfig struct {
 	MysqlServers    []MysqlServer     `json:"mysql_servers"`
 	MysqlUsers      []MysqlUser       `json:"mysql_users"`
 	GlobalVariables map[string]string `json:"global_variables"`
+
+	// Scheduler is left untouched when loading a config in which it is
+	// nil, so configs written before it was supported do not clear it.
+	// Use an empty list to clear it.
+	Scheduler []Scheduler `json:"scheduler"`
 }
 
+// LoadProxySQLConfigFile reads a ProxySQLConfig from a JSON, YAML
+// (.yaml, .yml), TOML (.toml) or ProxySQL (.cnf) config file, see
+// ParseCnf. If filename is a directory, the
+// config files in it are merged in lexical order: table rows are
+// appended and later global variables override earlier ones.
 func LoadProxySQLConfigFile(filename string) (*ProxySQLConfig, error) {
 	f, err := os.Stat(filename)
 	if err != nil {
@@ -948,7 +1387,7 @@ func LoadProxySQLConfigFile(filename string) (*ProxySQLConfig, error) {
 	}
 
 	if f.IsDir() {
-		return nil, fmt.Errorf("cannot open directory as config file: %q", filename)
+		return loadProxySQLConfigDir(filename)
 	}
 
 	b, err := ioutil.ReadFile(filename)
@@ -957,7 +1396,7 @@ func LoadProxySQLConfigFile(filename string) (*ProxySQLConfig, error) {
 	}
 
 	var pcfg ProxySQLConfig
-	err = json.Unmarshal(b, &pcfg)
+	err = Unmarshal(FormatFromExtension(filename), b, &pcfg)
 	if err != nil {
 		return nil, err
 	}
@@ -965,69 +1404,194 @@ func LoadProxySQLConfigFile(filename string) (*ProxySQLConfig, error) {
 	return &pcfg, nil
 }
 
-func (c *ProxySQLConfig) LoadToMemory(db *sql.DB) error {
-	// TODO on any error attempt to load runtime variables to memory ( :/ there is no LOAD RUNTIME TO MEMORY cmd )
+func loadProxySQLConfigDir(dir string) (*ProxySQLConfig, error) {
+	var files []string
+	for _, ext := range []string{"*.json", "*.yaml", "*.yml", "*.toml", "*.cnf"} {
+		matches, err := filepath.Glob(filepath.Join(dir, ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config files in directory %q", dir)
+	}
+	sort.Strings(files)
 
-	if err := SetMysqlServers(db, c.MysqlServers...); err != nil {
-		fmt.Printf("\n\nservers?? here!\n\n")
+	var ret ProxySQLConfig
+	for _, file := range files {
+		pcfg, err := LoadProxySQLConfigFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		ret.MysqlQueryRules = append(ret.MysqlQueryRules, pcfg.MysqlQueryRules...)
+		ret.MysqlServers = append(ret.MysqlServers, pcfg.MysqlServers...)
+		ret.MysqlUsers = append(ret.MysqlUsers, pcfg.MysqlUsers...)
+		if pcfg.Scheduler != nil {
+			ret.Scheduler = append(append([]Scheduler{}, ret.Scheduler...), pcfg.Scheduler...)
+		}
+		for name, value := range pcfg.GlobalVariables {
+			if ret.GlobalVariables == nil {
+				ret.GlobalVariables = make(map[string]string)
+			}
+			ret.GlobalVariables[name] = value
+		}
+	}
+	return &ret, nil
+}
 
+// LoadToMemory replaces the memory tables with the contents of c. If
+// any table fails to load, every memory table is restored to its
+// previous contents, so a failed load never leaves memory half
+// updated.
+func (c *ProxySQLConfig) LoadToMemory(db DB) error {
+	prev, err := SelectProxySQLConfig(db)
+	if err != nil {
 		return err
 	}
+	restore := func() error {
+		db := detached(db)
+		if err := SetMysqlServers(db, prev.MysqlServers...); err != nil {
+			return err
+		}
+		if err := SetMysqlUsers(db, prev.MysqlUsers...); err != nil {
+			return err
+		}
+		if err := SetMysqlQueryRules(db, prev.MysqlQueryRules...); err != nil {
+			return err
+		}
+		if c.Scheduler != nil {
+			if err := SetScheduler(db, prev.Scheduler...); err != nil {
+				return err
+			}
+		}
+		globalVariables := make(map[string]string)
+		for name := range c.GlobalVariables {
+			if value, ok := prev.GlobalVariables[name]; ok {
+				globalVariables[name] = value
+			}
+		}
+		return UpdateGlobalVariables(db, globalVariables)
+	}
+
+	if err := SetMysqlServers(db, c.MysqlServers...); err != nil {
+		return rollback("config", err, restore)
+	}
 
 	if err := SetMysqlUsers(db, c.MysqlUsers...); err != nil {
-		fmt.Printf("\n\nusers?? here!\n\n")
-		return err
+		return rollback("config", err, restore)
 	}
 
 	if err := SetMysqlQueryRules(db, c.MysqlQueryRules...); err != nil {
-		fmt.Printf("\n\nrules?? here!\n\n")
-		return err
+		return rollback("config", err, restore)
+	}
+
+	if c.Scheduler != nil {
+		if err := SetScheduler(db, c.Scheduler...); err != nil {
+			return rollback("config", err, restore)
+		}
 	}
 
 	if err := UpdateGlobalVariables(db, c.GlobalVariables); err != nil {
-		return err
+		return rollback("config", err, restore)
 	}
 
 	return nil
 }
 
-func (c *ProxySQLConfig) LoadToRuntime(db *sql.DB) error {
-
+func (c *ProxySQLConfig) LoadToRuntime(db DB) error {
 	err := c.LoadToMemory(db)
 	if err != nil {
-		fmt.Printf("ltm")
 		return err
 	}
 
 	if err = LoadMysqlServersToRuntime(db); err != nil {
-		fmt.Printf("str")
 		return err
 	}
 
 	if err = LoadMysqlUsersToRuntime(db); err != nil {
-		fmt.Printf("utr")
 		return err
 	}
 
 	if err = LoadMysqlQueryRulesToRuntime(db); err != nil {
-		fmt.Printf("qrtr")
 		return err
 	}
 
-	fmt.Printf("loading admin vars to runtime.....\n")
-	if err = LoadAdminVariablesToRuntime(db); err != nil {
+	if c.Scheduler != nil {
+		if err = LoadSchedulerToRuntime(db); err != nil {
+			return err
+		}
+	}
+
+	if err = LoadGlobalVariablesToRuntime(db); err != nil {
 		return err
 	}
-	fmt.Printf("DONE\n")
 
 	return nil
 }
 
+// SelectProxySQLConfig returns the contents of the memory tables
+// managed by ProxySQLConfig
+func SelectProxySQLConfig(db DB) (*ProxySQLConfig, error) {
+	return selectProxySQLConfig(db, LayerMemory)
+}
+
+// SelectRuntimeProxySQLConfig returns the contents of the runtime
+// tables managed by ProxySQLConfig
+func SelectRuntimeProxySQLConfig(db DB) (*ProxySQLConfig, error) {
+	return selectProxySQLConfig(db, LayerRuntime)
+}
+
+// SelectDiskProxySQLConfig returns the contents of the disk tables
+// managed by ProxySQLConfig, i.e. what ProxySQL loads on restart
+func SelectDiskProxySQLConfig(db DB) (*ProxySQLConfig, error) {
+	return selectProxySQLConfig(db, LayerDisk)
+}
+
+func selectProxySQLConfig(db DB, layer Layer) (*ProxySQLConfig, error) {
+	var c ProxySQLConfig
+	var err error
+
+	if c.MysqlQueryRules, err = selectMysqlQueryRules(db, layer); err != nil {
+		return nil, err
+	}
+	if c.MysqlServers, err = selectMysqlServers(db, layer); err != nil {
+		return nil, err
+	}
+	if c.MysqlUsers, err = selectMysqlUsers(db, layer); err != nil {
+		return nil, err
+	}
+	if c.GlobalVariables, err = selectGlobalVariables(db, layer); err != nil {
+		return nil, err
+	}
+	if c.Scheduler, err = selectScheduler(db, layer); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 ////////// Helper functions
 
-func prependRuntime(tbl string, runtime bool) string {
-	if runtime {
+// rollback runs restore after err caused a change to tbl to fail and
+// returns err annotated with the outcome of the rollback. An *Error
+// keeps its code, table and row so callers can still classify it.
+func rollback(tbl string, err error, restore func() error) error {
+	note := fmt.Sprintf("%s rolled back", tbl)
+	if rerr := restore(); rerr != nil {
+		note = fmt.Sprintf("rolling back %s failed: %v", tbl, rerr)
+	}
+	e := *AsError(err)
+	e.Err = fmt.Errorf("%w (%s)", e.Err, note)
+	return &e
+}
+
+// layerTable returns the name of tbl in layer e.g. runtime_mysql_servers
+func layerTable(tbl string, layer Layer) string {
+	switch layer {
+	case LayerRuntime:
 		return fmt.Sprintf("runtime_%s", tbl)
+	case LayerDisk:
+		return fmt.Sprintf("disk.%s", tbl)
 	}
 	return tbl
 }
@@ -0,0 +1,530 @@
+package admin
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProxySQL reads its config file, proxysql.cnf, with libconfig. The
+// config file is only used the first time ProxySQL starts, or when it
+// is started with --initial, after which the tables are kept in its
+// database. ParseCnf and MarshalCnf convert between it and
+// ProxySQLConfig, so a bootstrap file can be generated from the same
+// config that is loaded through the API.
+//
+// In the config file the mysql_servers columns hostname and
+// hostgroup_id are called address and hostgroup, and global variables
+// are grouped by prefix without it, e.g. mysql-threads is
+// mysql_variables { threads = 4 }.
+
+// cnfColumns maps config file setting names to column names
+var cnfColumns = map[string]map[string]string{
+	"mysql_servers": {"address": "hostname", "hostgroup": "hostgroup_id"},
+}
+
+// ParseCnf parses a ProxySQL config file. The mysql_servers,
+// mysql_users, mysql_query_rules and scheduler lists and the
+// *_variables groups are read; other settings, e.g. datadir or
+// mysql_replication_hostgroups, are ignored. As with any other config,
+// a missing table is loaded as an empty one, except for the scheduler.
+func ParseCnf(data []byte) (*ProxySQLConfig, error) {
+	return parseCnf(data, false)
+}
+
+func parseCnf(data []byte, strict bool) (*ProxySQLConfig, error) {
+	p := &cnfParser{data: data, line: 1}
+	settings, err := p.settings(0)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := make(map[string]interface{})
+	for _, tbl := range []string{"mysql_servers", "mysql_users", "mysql_query_rules", "scheduler"} {
+		v, ok := settings[tbl]
+		if !ok {
+			continue
+		}
+		rows, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list", tbl)
+		}
+		for i, row := range rows {
+			cols, ok := row.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s[%d] must be a group", tbl, i)
+			}
+			for setting, col := range cnfColumns[tbl] {
+				if v, ok := cols[setting]; ok {
+					if _, ok := cols[col]; ok {
+						return nil, fmt.Errorf("%s[%d] sets both %s and %s", tbl, i, setting, col)
+					}
+					cols[col] = v
+					delete(cols, setting)
+				}
+			}
+		}
+		doc[tbl] = rows
+	}
+
+	globalVariables := make(map[string]interface{})
+	for name, v := range settings {
+		if !strings.HasSuffix(name, "_variables") {
+			continue
+		}
+		prefix := strings.TrimSuffix(name, "_variables")
+		vars, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be a group", name)
+		}
+		for variable, value := range vars {
+			s, err := cnfVariableValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", name, variable, err)
+			}
+			globalVariables[prefix+"-"+variable] = s
+		}
+	}
+	if len(globalVariables) > 0 {
+		doc["global_variables"] = globalVariables
+	}
+
+	var ret ProxySQLConfig
+	if err := remarshalJSON(doc, &ret, strict); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// cnfVariableValue returns value the way ProxySQL stores it in
+// global_variables
+func cnfVariableValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("expected a scalar value")
+}
+
+// MarshalCnf returns c as a ProxySQL config file. The separate
+// frontend and backend rows ProxySQL keeps in runtime_mysql_users are
+// merged. Global variables must have a prefix, e.g. mysql- or admin-,
+// as the config file groups them by it.
+func MarshalCnf(c *ProxySQLConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("# generated by proxysqlapi\n\n")
+
+	groups := make(map[string]map[string]string)
+	for name, value := range c.GlobalVariables {
+		i := strings.Index(name, "-")
+		if i <= 0 {
+			return nil, fmt.Errorf("global variable %q has no prefix", name)
+		}
+		prefix := name[:i]
+		if groups[prefix] == nil {
+			groups[prefix] = make(map[string]string)
+		}
+		groups[prefix][name[i+1:]] = value
+	}
+	var prefixes []string
+	for prefix := range groups {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		var names []string
+		for name := range groups[prefix] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&buf, "%s_variables =\n{\n", prefix)
+		for _, name := range names {
+			fmt.Fprintf(&buf, "\t%s = %s\n", name, cnfQuote(groups[prefix][name]))
+		}
+		buf.WriteString("}\n\n")
+	}
+
+	var servers, users, rules, scheduler []interface{}
+	for _, s := range c.MysqlServers {
+		servers = append(servers, s)
+	}
+	for _, u := range mergeFrontendBackendUsers(c.MysqlUsers) {
+		users = append(users, u)
+	}
+	for _, r := range c.MysqlQueryRules {
+		rules = append(rules, r)
+	}
+	writeCnfList(&buf, "mysql_servers", servers)
+	writeCnfList(&buf, "mysql_users", users)
+	writeCnfList(&buf, "mysql_query_rules", rules)
+	if c.Scheduler != nil {
+		for _, s := range c.Scheduler {
+			scheduler = append(scheduler, s)
+		}
+		writeCnfList(&buf, "scheduler", scheduler)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeCnfList writes rows as a list of groups holding their non-null
+// columns, in the order of the struct fields
+func writeCnfList(buf *bytes.Buffer, tbl string, rows []interface{}) {
+	settings := make(map[string]string)
+	for setting, col := range cnfColumns[tbl] {
+		settings[col] = setting
+	}
+
+	if len(rows) == 0 {
+		fmt.Fprintf(buf, "%s = ()\n\n", tbl)
+		return
+	}
+	fmt.Fprintf(buf, "%s =\n(\n", tbl)
+	for i, row := range rows {
+		buf.WriteString("\t{\n")
+		v := reflect.ValueOf(row)
+		for j := 0; j < v.NumField(); j++ {
+			name := strings.Split(v.Type().Field(j).Tag.Get("json"), ",")[0]
+			if s, ok := settings[name]; ok {
+				name = s
+			}
+			f := v.Field(j)
+			if f.Kind() == reflect.Ptr {
+				if f.IsNil() {
+					continue
+				}
+				f = f.Elem()
+			}
+			if f.Kind() == reflect.String {
+				fmt.Fprintf(buf, "\t\t%s = %s\n", name, cnfQuote(f.String()))
+			} else {
+				fmt.Fprintf(buf, "\t\t%s = %v\n", name, f.Interface())
+			}
+		}
+		buf.WriteString("\t}")
+		if i < len(rows)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString(")\n\n")
+}
+
+// cnfQuote returns s as a libconfig string
+func cnfQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\f':
+			buf.WriteString(`\f`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&buf, `\x%02x`, c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+/*//////////////////////////////////////////////////////////////////////*/
+
+// cnfParser parses the subset of the libconfig grammar used by
+// proxysql.cnf: settings, groups, lists, arrays, strings, integers,
+// floats and booleans, with #, // and /* */ comments. Groups are
+// returned as map[string]interface{}, lists and arrays as
+// []interface{}, integers as int64 and floats as float64.
+// @include directives are not supported.
+type cnfParser struct {
+	data []byte
+	pos  int
+	line int
+}
+
+func (p *cnfParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *cnfParser) eof() bool { return p.pos >= len(p.data) }
+
+func (p *cnfParser) peek(n int) byte {
+	if p.pos+n < len(p.data) {
+		return p.data[p.pos+n]
+	}
+	return 0
+}
+
+// skip skips whitespace and comments
+func (p *cnfParser) skip() error {
+	for !p.eof() {
+		switch c := p.data[p.pos]; {
+		case c == '\n':
+			p.line++
+			p.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			p.pos++
+		case c == '#' || (c == '/' && p.peek(1) == '/'):
+			for !p.eof() && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '/' && p.peek(1) == '*':
+			end := bytes.Index(p.data[p.pos+2:], []byte("*/"))
+			if end < 0 {
+				return p.errorf("unterminated comment")
+			}
+			p.line += bytes.Count(p.data[p.pos:p.pos+2+end], []byte("\n"))
+			p.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// settings parses settings up to end, which is '}' for a group or 0
+// for the whole file
+func (p *cnfParser) settings(end byte) (map[string]interface{}, error) {
+	ret := make(map[string]interface{})
+	for {
+		if err := p.skip(); err != nil {
+			return nil, err
+		}
+		if p.eof() {
+			if end != 0 {
+				return nil, p.errorf("unexpected end of file, expected %q", end)
+			}
+			return ret, nil
+		}
+		if p.data[p.pos] == end {
+			p.pos++
+			return ret, nil
+		}
+		if p.data[p.pos] == '@' {
+			return nil, p.errorf("@include is not supported")
+		}
+
+		name := p.name()
+		if name == "" {
+			return nil, p.errorf("unexpected %q, expected a setting name", p.data[p.pos])
+		}
+		if err := p.skip(); err != nil {
+			return nil, err
+		}
+		if p.eof() || (p.data[p.pos] != '=' && p.data[p.pos] != ':') {
+			return nil, p.errorf("expected = or : after %s", name)
+		}
+		p.pos++
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ret[name]; ok {
+			return nil, p.errorf("duplicate setting %s", name)
+		}
+		ret[name] = v
+
+		if err := p.skip(); err != nil {
+			return nil, err
+		}
+		if !p.eof() && (p.data[p.pos] == ';' || p.data[p.pos] == ',') {
+			p.pos++
+		}
+	}
+}
+
+// name parses a setting name: [A-Za-z*][-A-Za-z0-9_*]*
+func (p *cnfParser) name() string {
+	start := p.pos
+	for !p.eof() {
+		c := p.data[p.pos]
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '*'
+		if !isLetter && (p.pos == start || !((c >= '0' && c <= '9') || c == '-' || c == '_')) {
+			break
+		}
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+func (p *cnfParser) value() (interface{}, error) {
+	if err := p.skip(); err != nil {
+		return nil, err
+	}
+	if p.eof() {
+		return nil, p.errorf("unexpected end of file, expected a value")
+	}
+	switch p.data[p.pos] {
+	case '{':
+		p.pos++
+		return p.settings('}')
+	case '(':
+		p.pos++
+		return p.list(')')
+	case '[':
+		p.pos++
+		return p.list(']')
+	case '"':
+		return p.str()
+	}
+	return p.scalar()
+}
+
+// list parses the values of a list or array up to end. A trailing
+// comma is accepted.
+func (p *cnfParser) list(end byte) ([]interface{}, error) {
+	ret := []interface{}{}
+	for {
+		if err := p.skip(); err != nil {
+			return nil, err
+		}
+		if p.eof() {
+			return nil, p.errorf("unexpected end of file, expected %q", end)
+		}
+		if p.data[p.pos] == end {
+			p.pos++
+			return ret, nil
+		}
+		if len(ret) > 0 {
+			if p.data[p.pos] != ',' {
+				return nil, p.errorf("unexpected %q, expected , or %q", p.data[p.pos], end)
+			}
+			p.pos++
+			if err := p.skip(); err != nil {
+				return nil, err
+			}
+			if !p.eof() && p.data[p.pos] == end {
+				p.pos++
+				return ret, nil
+			}
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+}
+
+// str parses a string, concatenating adjacent strings as libconfig
+// does e.g. "foo" "bar"
+func (p *cnfParser) str() (string, error) {
+	var buf bytes.Buffer
+	for {
+		if err := p.quoted(&buf); err != nil {
+			return "", err
+		}
+		if err := p.skip(); err != nil {
+			return "", err
+		}
+		if p.eof() || p.data[p.pos] != '"' {
+			return buf.String(), nil
+		}
+	}
+}
+
+func (p *cnfParser) quoted(buf *bytes.Buffer) error {
+	p.pos++ // opening quote
+	for {
+		if p.eof() {
+			return p.errorf("unterminated string")
+		}
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return nil
+		case '\n':
+			p.line++
+			buf.WriteByte(c)
+		case '\\':
+			if p.eof() {
+				return p.errorf("unterminated string")
+			}
+			e := p.data[p.pos]
+			p.pos++
+			switch e {
+			case '"', '\\':
+				buf.WriteByte(e)
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case 'f':
+				buf.WriteByte('\f')
+			case 'x':
+				if p.pos+2 > len(p.data) {
+					return p.errorf("invalid \\x escape")
+				}
+				b, err := strconv.ParseUint(string(p.data[p.pos:p.pos+2]), 16, 8)
+				if err != nil {
+					return p.errorf("invalid \\x escape")
+				}
+				buf.WriteByte(byte(b))
+				p.pos += 2
+			default:
+				return p.errorf("invalid escape \\%c", e)
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+// scalar parses a boolean, integer (decimal or hex, with an optional
+// L or LL suffix) or float
+func (p *cnfParser) scalar() (interface{}, error) {
+	start := p.pos
+	for !p.eof() {
+		c := p.data[p.pos]
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '+' || c == '-' || c == '.') {
+			break
+		}
+		p.pos++
+	}
+	tok := string(p.data[start:p.pos])
+	if tok == "" {
+		return nil, p.errorf("unexpected %q, expected a value", p.data[p.pos])
+	}
+
+	switch strings.ToLower(tok) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	integer := strings.TrimRight(tok, "Ll")
+	if lower := strings.ToLower(integer); strings.HasPrefix(lower, "0x") {
+		if i, err := strconv.ParseUint(lower[2:], 16, 64); err == nil {
+			return int64(i), nil
+		}
+	} else if i, err := strconv.ParseInt(integer, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(tok, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf("invalid value %q", tok)
+}
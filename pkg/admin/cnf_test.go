@@ -0,0 +1,217 @@
+package admin
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func ptrstring(s string) *string { return &s }
+
+func TestParseCnfDocker(t *testing.T) {
+	b, err := ioutil.ReadFile("../../docker/proxysql.cnf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ParseCnf(b)
+	if err != nil {
+		t.Fatalf("ParseCnf: %v", err)
+	}
+	want := map[string]string{"admin-admin_credentials": "admin:admin;root:"}
+	if !reflect.DeepEqual(c.GlobalVariables, want) {
+		t.Errorf("global variables = %v, want %v", c.GlobalVariables, want)
+	}
+	if len(c.MysqlServers) != 0 || len(c.MysqlUsers) != 0 || len(c.MysqlQueryRules) != 0 {
+		t.Errorf("expected no rows, got %d servers, %d users and %d query rules", len(c.MysqlServers), len(c.MysqlUsers), len(c.MysqlQueryRules))
+	}
+	if c.Scheduler != nil {
+		t.Errorf("scheduler = %v, want nil", c.Scheduler)
+	}
+}
+
+func TestParseCnf(t *testing.T) {
+	gotham := NewMysqlServer("gotham")
+	gotham.HostgroupID = 1
+	gotham.Port = 3307
+
+	tests := []struct {
+		name    string
+		cnf     string
+		want    *ProxySQLConfig
+		wantErr string
+	}{
+		{
+			name: "server address and hostgroup",
+			cnf: `mysql_servers =
+(
+	{ address = "gotham", hostgroup = 1, port = 3307 }
+)`,
+			want: &ProxySQLConfig{MysqlServers: []MysqlServer{*gotham}},
+		},
+		{
+			name: "comments",
+			cnf: `# a comment
+// another
+/* and a
+   block */
+mysql_servers = ( { hostname = "gotham" /* inline */, hostgroup_id = 1, port = 3307 } ) ;`,
+			want: &ProxySQLConfig{MysqlServers: []MysqlServer{*gotham}},
+		},
+		{
+			name: "variables are stored as strings",
+			cnf: `mysql_variables =
+{
+	threads = 4
+	have_compress = true
+	default_query_timeout = 36000000
+	server_version = "5.5.30"
+}`,
+			want: &ProxySQLConfig{GlobalVariables: map[string]string{
+				"mysql-threads":               "4",
+				"mysql-have_compress":         "true",
+				"mysql-default_query_timeout": "36000000",
+				"mysql-server_version":        "5.5.30",
+			}},
+		},
+		{
+			name: "users and query rules",
+			cnf: `mysql_users = ( { username = "batman", password = "robin", default_hostgroup = 1 } )
+mysql_query_rules = ( { rule_id = 1, active = 1, match_digest = "^SELECT", destination_hostgroup = 2, apply = 1 } )`,
+			want: func() *ProxySQLConfig {
+				u := NewMysqlUser("batman")
+				u.Password = ptrstring("robin")
+				u.DefaultHostgroup = 1
+				r := NewMysqlQueryRule()
+				r.RuleID = ptrint(1)
+				r.Active = 1
+				r.MatchDigest = ptrstring("^SELECT")
+				r.DestinationHostgroup = ptrint(2)
+				r.Apply = 1
+				return &ProxySQLConfig{MysqlUsers: []MysqlUser{*u}, MysqlQueryRules: []MysqlQueryRule{*r}}
+			}(),
+		},
+		{
+			name: "other settings are ignored",
+			cnf: `datadir = "/var/lib/proxysql"
+mysql_replication_hostgroups = ( { writer_hostgroup = 1, reader_hostgroup = 2 } )`,
+			want: &ProxySQLConfig{},
+		},
+		{
+			name:    "address and hostname",
+			cnf:     `mysql_servers = ( { address = "gotham", hostname = "gotham" } )`,
+			wantErr: "sets both address and hostname",
+		},
+		{
+			name:    "table is not a list",
+			cnf:     `mysql_servers = { address = "gotham" }`,
+			wantErr: "mysql_servers must be a list",
+		},
+		{
+			name:    "variables are not a group",
+			cnf:     `mysql_variables = ( 1 )`,
+			wantErr: "mysql_variables must be a group",
+		},
+		{
+			name:    "unterminated string",
+			cnf:     `mysql_variables = { threads = "4 }`,
+			wantErr: "line 1: unterminated string",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCnf([]byte(tt.cnf))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", toJSON(got))
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %q, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCnf: %v", err)
+			}
+			if diff := DiffProxySQLConfig(tt.want, got); !diff.Empty() {
+				t.Errorf("unexpected differences: %s", diff.ToJSON())
+			}
+			if len(tt.want.GlobalVariables) > 0 && !reflect.DeepEqual(got.GlobalVariables, tt.want.GlobalVariables) {
+				t.Errorf("global variables = %v, want %v", got.GlobalVariables, tt.want.GlobalVariables)
+			}
+		})
+	}
+}
+
+func TestCnfRoundTrip(t *testing.T) {
+	gotham := NewMysqlServer("gotham")
+	gotham.HostgroupID = 1
+	gotham.Comment = `the "dark" knight's \ city`
+	newyork := NewMysqlServer("newyork")
+	newyork.HostgroupID = 2
+	newyork.Weight = 10
+	newyork.Status = MysqlServerStatusOfflineSoft
+
+	batman := NewMysqlUser("batman")
+	batman.Password = ptrstring("*B1A2C3")
+	batman.DefaultSchema = ptrstring("cave")
+
+	rule := NewMysqlQueryRule()
+	rule.RuleID = ptrint(10)
+	rule.Active = 1
+	rule.MatchPattern = ptrstring(`^SELECT .* FOR UPDATE\s*$`)
+	rule.DestinationHostgroup = ptrint(1)
+
+	scheduler := NewScheduler("/usr/bin/check.sh")
+	scheduler.ID = ptrint(1)
+	scheduler.Arg1 = ptrstring("--tab\tand newline\n")
+
+	tests := []struct {
+		name string
+		cfg  *ProxySQLConfig
+	}{
+		{
+			name: "empty",
+			cfg:  &ProxySQLConfig{},
+		},
+		{
+			name: "every table",
+			cfg: &ProxySQLConfig{
+				MysqlServers:    []MysqlServer{*gotham, *newyork},
+				MysqlUsers:      []MysqlUser{*batman},
+				MysqlQueryRules: []MysqlQueryRule{*rule},
+				Scheduler:       []Scheduler{*scheduler},
+				GlobalVariables: map[string]string{
+					"mysql-threads":           "4",
+					"mysql-monitor_password":  "p\"w",
+					"admin-admin_credentials": "admin:admin",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := MarshalCnf(tt.cfg)
+			if err != nil {
+				t.Fatalf("MarshalCnf: %v", err)
+			}
+			got, err := ParseCnf(b)
+			if err != nil {
+				t.Fatalf("ParseCnf: %v\n%s", err, b)
+			}
+			if diff := DiffProxySQLConfig(tt.cfg, got); !diff.Empty() {
+				t.Errorf("unexpected differences: %s\n%s", diff.ToJSON(), b)
+			}
+			if len(tt.cfg.GlobalVariables) > 0 && !reflect.DeepEqual(got.GlobalVariables, tt.cfg.GlobalVariables) {
+				t.Errorf("global variables = %v, want %v", got.GlobalVariables, tt.cfg.GlobalVariables)
+			}
+			if (tt.cfg.Scheduler == nil) != (got.Scheduler == nil) {
+				t.Errorf("scheduler = %v, want %v", got.Scheduler, tt.cfg.Scheduler)
+			}
+		})
+	}
+
+	if _, err := MarshalCnf(&ProxySQLConfig{GlobalVariables: map[string]string{"threads": "4"}}); err == nil {
+		t.Error("expected an error for a variable without a prefix")
+	}
+}
@@ -0,0 +1,167 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/trace"
+)
+
+// DB is the part of *sql.DB used to talk to the admin interface. Every
+// function in this package takes one: pass a *sql.DB to run without a
+// context, or WithContext(ctx, db) so every statement is cancelled
+// with ctx, e.g. when an HTTP client goes away or a deadline passes.
+type DB interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// WithContext returns db with every statement run under ctx, making
+// e.g. SelectMysqlServers(WithContext(ctx, db)) the context-aware
+// variant of SelectMysqlServers(db)
+func WithContext(ctx context.Context, db *sql.DB) DB {
+	return &ctxDB{ctx: ctx, db: db}
+}
+
+type ctxDB struct {
+	ctx context.Context
+	db  *sql.DB
+}
+
+func (c *ctxDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	ctx, span := startStatementSpan(c.ctx, query)
+	res, err := c.db.ExecContext(ctx, query, args...)
+	if err == nil {
+		if n, err := res.RowsAffected(); err == nil {
+			span.SetAttr("db.response.affected_rows", n)
+		}
+	}
+	endStatementSpan(span, err)
+	c.logStatement(query, start, err)
+	return res, err
+}
+
+// Query traces the statement up to the first row, the rows are read
+// by the caller
+func (c *ctxDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	ctx, span := startStatementSpan(c.ctx, query)
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	endStatementSpan(span, err)
+	c.logStatement(query, start, err)
+	return rows, err
+}
+
+// startStatementSpan starts a span for query as a child of the span
+// in ctx, if any, named after its operation and table e.g.
+// "INSERT mysql_servers"
+func startStatementSpan(ctx context.Context, query string) (context.Context, *trace.Span) {
+	op, tbl := statementTable(query)
+	name := op
+	if tbl != "" {
+		name = op + " " + tbl
+	}
+	ctx, span := trace.Start(ctx, name, trace.KindClient)
+	span.SetAttr("db.system", "mysql")
+	span.SetAttr("db.operation.name", op)
+	if tbl != "" {
+		span.SetAttr("db.collection.name", tbl)
+	}
+	span.SetAttr("db.query.text", compactStatement(query))
+	return ctx, span
+}
+
+func endStatementSpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetAttr("error.type", AsError(err).Code)
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// loadTables maps the object of a LOAD or SAVE admin command to its
+// table
+var loadTables = map[string]string{
+	"MYSQL SERVERS":     "mysql_servers",
+	"MYSQL USERS":       "mysql_users",
+	"MYSQL QUERY RULES": "mysql_query_rules",
+	"MYSQL VARIABLES":   "global_variables",
+	"ADMIN VARIABLES":   "global_variables",
+	"SCHEDULER":         "scheduler",
+}
+
+// statementTable returns the operation, e.g. INSERT, and the table an
+// admin statement works on, or an empty table if it cannot tell
+func statementTable(query string) (op, tbl string) {
+	f := strings.Fields(strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(query), ";")))
+	if len(f) == 0 {
+		return "", ""
+	}
+	op = f[0]
+	orig := strings.Fields(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	after := func(word string) string {
+		for i := 0; i < len(f)-1; i++ {
+			if f[i] == word {
+				return strings.TrimRight(orig[i+1], ";(")
+			}
+		}
+		return ""
+	}
+	switch op {
+	case "SELECT", "DELETE":
+		tbl = after("FROM")
+	case "INSERT", "REPLACE":
+		tbl = after("INTO")
+	case "UPDATE":
+		if len(orig) > 1 {
+			tbl = orig[1]
+		}
+	case "LOAD", "SAVE":
+		for obj, t := range loadTables {
+			if strings.HasPrefix(strings.Join(f[1:], " "), obj+" ") {
+				tbl = t
+			}
+		}
+	}
+	return op, tbl
+}
+
+// compactStatement returns query on one line, cut short if long. It
+// only ever holds placeholders, never the arguments.
+func compactStatement(query string) string {
+	stmt := strings.Join(strings.Fields(query), " ")
+	if len(stmt) > 200 {
+		stmt = stmt[:200] + "..."
+	}
+	return stmt
+}
+
+// logStatement logs query at debug level. Only the statement is
+// logged, never its arguments, which may hold passwords.
+func (c *ctxDB) logStatement(query string, start time.Time, err error) {
+	if !slog.Default().Enabled(c.ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("statement", compactStatement(query)),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	slog.LogAttrs(c.ctx, slog.LevelDebug, "admin statement", attrs...)
+}
+
+// detached returns db without its cancellation or deadline. Rolling a
+// table back after a cancelled write must not be cancelled too, or
+// the table is left empty half way through being replaced.
+func detached(db DB) DB {
+	if c, ok := db.(*ctxDB); ok {
+		return &ctxDB{ctx: context.WithoutCancel(c.ctx), db: c.db}
+	}
+	return db
+}
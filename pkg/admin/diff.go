@@ -0,0 +1,384 @@
+package admin
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Row diff operations
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// RowDiff describes how a single row differs between two versions of
+// a table. Rows are identified by their natural key, e.g.
+// "1:gotham:3306" for a mysql_servers row. Fields lists the columns
+// that changed.
+type RowDiff struct {
+	Key    string                 `json:"key"`
+	Op     string                 `json:"op"`
+	Fields []string               `json:"fields,omitempty"`
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+}
+
+// TableDiff lists the rows of a table that differ between two
+// versions of it
+type TableDiff struct {
+	Table string    `json:"table"`
+	Rows  []RowDiff `json:"rows"`
+}
+
+// ConfigDiff lists the tables that differ between two ProxySQLConfigs.
+// Tables without differences are omitted.
+type ConfigDiff []TableDiff
+
+// Empty returns true if there are no differences
+func (d ConfigDiff) Empty() bool { return len(d) == 0 }
+
+// Tables returns the names of the tables which differ
+func (d ConfigDiff) Tables() []string {
+	ret := make([]string, 0, len(d))
+	for _, t := range d {
+		ret = append(ret, t.Table)
+	}
+	return ret
+}
+
+func (d ConfigDiff) ToJSON() string { return toJSON(d) }
+
+// Redacted returns a copy of d with backend passwords and secret
+// global variables replaced by RedactedPassword. Fields is kept as is,
+// so a changed password still shows up as changed.
+func (d ConfigDiff) Redacted() ConfigDiff {
+	ret := make(ConfigDiff, len(d))
+	for i, t := range d {
+		rows := make([]RowDiff, len(t.Rows))
+		for j, row := range t.Rows {
+			switch {
+			case t.Table == "mysql_users":
+				row.Before = redactColumn(row.Before, "password")
+				row.After = redactColumn(row.After, "password")
+			case t.Table == "global_variables" && IsSecretGlobalVariable(row.Key):
+				row.Before = redactColumn(row.Before, "variable_value")
+				row.After = redactColumn(row.After, "variable_value")
+			}
+			rows[j] = row
+		}
+		ret[i] = TableDiff{Table: t.Table, Rows: rows}
+	}
+	return ret
+}
+
+// IsSecretGlobalVariable returns true for global variables holding
+// credentials e.g. admin-admin_credentials or mysql-monitor_password
+func IsSecretGlobalVariable(name string) bool {
+	return strings.HasSuffix(name, "_credentials") || strings.HasSuffix(name, "_password")
+}
+
+// RedactGlobalVariables returns a copy of vars with the value of every
+// secret variable replaced by RedactedPassword, see
+// IsSecretGlobalVariable
+func RedactGlobalVariables(vars map[string]string) map[string]string {
+	if vars == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(vars))
+	for name, value := range vars {
+		if IsSecretGlobalVariable(name) {
+			value = RedactedPassword
+		}
+		ret[name] = value
+	}
+	return ret
+}
+
+// redactColumn returns a copy of cols with col replaced by
+// RedactedPassword unless it is null
+func redactColumn(cols map[string]interface{}, col string) map[string]interface{} {
+	if cols == nil || cols[col] == nil {
+		return cols
+	}
+	ret := make(map[string]interface{}, len(cols))
+	for k, v := range cols {
+		ret[k] = v
+	}
+	ret[col] = RedactedPassword
+	return ret
+}
+
+// DiffProxySQLConfig returns the changes needed to turn from into to.
+//
+// A nil table in to is treated as empty, the same way LoadToMemory
+// treats it. Global variables are the exception: only variables set
+// in to are compared, since ProxySQL always has every variable. A nil
+// scheduler in to is not compared either, LoadToMemory leaves it as is.
+//
+// If any query rule in to has no rule_id, rules are matched by their
+// position (ordered by rule_id) and rule_id is not compared.
+//
+// ProxySQL may hash passwords when loading mysql_users to runtime, so
+// a password in from is considered equal to its
+// mysql_native_password hash in to and vice versa.
+func DiffProxySQLConfig(from, to *ProxySQLConfig) ConfigDiff {
+	if from == nil {
+		from = &ProxySQLConfig{}
+	}
+	if to == nil {
+		to = &ProxySQLConfig{}
+	}
+
+	ret := ConfigDiff{}
+	add := func(tbl string, rows []RowDiff) {
+		if len(rows) > 0 {
+			ret = append(ret, TableDiff{Table: tbl, Rows: rows})
+		}
+	}
+
+	add("mysql_servers", diffRows(mysqlServerRows(from.MysqlServers), mysqlServerRows(to.MysqlServers)))
+	add("mysql_users", diffRows(mysqlUserRows(from.MysqlUsers, to.MysqlUsers), mysqlUserRows(to.MysqlUsers, from.MysqlUsers)))
+
+	byPosition := false
+	for _, r := range to.MysqlQueryRules {
+		if r.RuleID == nil {
+			byPosition = true
+			break
+		}
+	}
+	add("mysql_query_rules", diffRows(mysqlQueryRuleRows(from.MysqlQueryRules, byPosition), mysqlQueryRuleRows(to.MysqlQueryRules, byPosition)))
+
+	add("global_variables", diffGlobalVariables(from.GlobalVariables, to.GlobalVariables))
+	if to.Scheduler != nil {
+		add("scheduler", diffRows(schedulerRows(from.Scheduler), schedulerRows(to.Scheduler)))
+	}
+	return ret
+}
+
+// keyedRow is a table row converted to a column map, along with its
+// natural key
+type keyedRow struct {
+	key  string
+	cols map[string]interface{}
+}
+
+func diffRows(from, to []keyedRow) []RowDiff {
+	fromByKey := make(map[string]map[string]interface{})
+	for _, r := range from {
+		fromByKey[r.key] = r.cols
+	}
+	toByKey := make(map[string]map[string]interface{})
+	for _, r := range to {
+		toByKey[r.key] = r.cols
+	}
+
+	var ret []RowDiff
+	for _, r := range from {
+		if _, ok := toByKey[r.key]; !ok {
+			ret = append(ret, RowDiff{Key: r.key, Op: DiffRemoved, Before: r.cols})
+		}
+	}
+	for _, r := range to {
+		before, ok := fromByKey[r.key]
+		if !ok {
+			ret = append(ret, RowDiff{Key: r.key, Op: DiffAdded, After: r.cols})
+			continue
+		}
+		if fields := changedFields(before, r.cols); len(fields) > 0 {
+			ret = append(ret, RowDiff{Key: r.key, Op: DiffChanged, Fields: fields, Before: before, After: r.cols})
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+func changedFields(before, after map[string]interface{}) []string {
+	var ret []string
+	for k, v := range after {
+		if !reflect.DeepEqual(before[k], v) {
+			ret = append(ret, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func diffGlobalVariables(from, to map[string]string) []RowDiff {
+	var ret []RowDiff
+	for name, value := range to {
+		before, ok := from[name]
+		after := map[string]interface{}{"variable_name": name, "variable_value": value}
+		if !ok {
+			ret = append(ret, RowDiff{Key: name, Op: DiffAdded, After: after})
+			continue
+		}
+		if before != value {
+			ret = append(ret, RowDiff{
+				Key:    name,
+				Op:     DiffChanged,
+				Fields: []string{"variable_value"},
+				Before: map[string]interface{}{"variable_name": name, "variable_value": before},
+				After:  after,
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// toColumns converts a row struct to a map of its JSON columns
+func toColumns(row interface{}) map[string]interface{} {
+	b, err := json.Marshal(row)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	var ret map[string]interface{}
+	json.Unmarshal(b, &ret)
+	return ret
+}
+
+func mysqlServerRows(servers []MysqlServer) []keyedRow {
+	ret := make([]keyedRow, 0, len(servers))
+	for _, s := range servers {
+		hostname := ""
+		if s.Hostname != nil {
+			hostname = *s.Hostname
+		}
+		ret = append(ret, keyedRow{
+			key:  fmt.Sprintf("%d:%s:%d", s.HostgroupID, hostname, s.Port),
+			cols: toColumns(s),
+		})
+	}
+	return ret
+}
+
+// mysqlUserRows keys users by (username, backend). other is the
+// version being compared against and is used to decide whether a
+// password should be compared in its hashed form.
+func mysqlUserRows(users, other []MysqlUser) []keyedRow {
+	hashed := make(map[string]bool)
+	for _, u := range other {
+		if u.Username != nil && u.Password != nil && isMysqlNativePasswordHash(*u.Password) {
+			hashed[*u.Username] = true
+		}
+	}
+
+	users = mergeFrontendBackendUsers(users)
+	ret := make([]keyedRow, 0, len(users))
+	for _, u := range users {
+		username := ""
+		if u.Username != nil {
+			username = *u.Username
+		}
+		if hashed[username] && u.Password != nil && !isMysqlNativePasswordHash(*u.Password) {
+			pw := mysqlNativePasswordHash(*u.Password)
+			u.Password = &pw
+		}
+		ret = append(ret, keyedRow{
+			key:  mysqlUserKey(u),
+			cols: toColumns(u),
+		})
+	}
+	return ret
+}
+
+// mergeFrontendBackendUsers merges the separate frontend and backend
+// rows ProxySQL keeps in runtime_mysql_users into a single row with
+// both frontend and backend set, which is how they are usually
+// written to mysql_users.
+func mergeFrontendBackendUsers(users []MysqlUser) []MysqlUser {
+	var ret []MysqlUser
+	merged := make([]bool, len(users))
+	for i, u := range users {
+		if merged[i] {
+			continue
+		}
+		if u.Frontend == 1 && u.Backend == 0 {
+			for j := i + 1; j < len(users); j++ {
+				o := users[j]
+				if merged[j] || o.Frontend != 0 || o.Backend != 1 {
+					continue
+				}
+				o.Frontend, o.Backend = 1, 0
+				if reflect.DeepEqual(u, o) {
+					merged[j] = true
+					u.Backend = 1
+					break
+				}
+			}
+		}
+		ret = append(ret, u)
+	}
+	return ret
+}
+
+func mysqlQueryRuleRows(rules []MysqlQueryRule, byPosition bool) []keyedRow {
+	ret := make([]keyedRow, 0, len(rules))
+	if byPosition {
+		rules = append([]MysqlQueryRule{}, rules...)
+		sort.SliceStable(rules, func(i, j int) bool {
+			if rules[i].RuleID == nil || rules[j].RuleID == nil {
+				return false
+			}
+			return *rules[i].RuleID < *rules[j].RuleID
+		})
+	}
+	for i, r := range rules {
+		var key string
+		cols := toColumns(r)
+		switch {
+		case byPosition:
+			key = fmt.Sprintf("#%d", i+1)
+			delete(cols, "rule_id")
+		case r.RuleID != nil:
+			key = fmt.Sprintf("%d", *r.RuleID)
+		default:
+			key = fmt.Sprintf("#%d", i+1)
+		}
+		ret = append(ret, keyedRow{key: key, cols: cols})
+	}
+	return ret
+}
+
+// schedulerRows keys entries by id, or by position for entries
+// without one
+func schedulerRows(entries []Scheduler) []keyedRow {
+	ret := make([]keyedRow, 0, len(entries))
+	for i, s := range entries {
+		key := fmt.Sprintf("#%d", i+1)
+		if s.ID != nil {
+			key = fmt.Sprintf("%d", *s.ID)
+		}
+		ret = append(ret, keyedRow{key: key, cols: toColumns(s)})
+	}
+	return ret
+}
+
+// isMysqlNativePasswordHash returns true if pw looks like the output
+// of mysqlNativePasswordHash
+func isMysqlNativePasswordHash(pw string) bool {
+	if len(pw) != 41 || pw[0] != '*' {
+		return false
+	}
+	_, err := hex.DecodeString(pw[1:])
+	return err == nil
+}
+
+// mysqlNativePasswordHash returns the hash MySQL (and ProxySQL) store
+// for mysql_native_password: "*" + HEX(SHA1(SHA1(pw)))
+func mysqlNativePasswordHash(pw string) string {
+	h1 := sha1.Sum([]byte(pw))
+	h2 := sha1.Sum(h1[:])
+	return "*" + strings.ToUpper(hex.EncodeToString(h2[:]))
+}
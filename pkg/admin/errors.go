@@ -0,0 +1,153 @@
+package admin
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Error codes, see Error. They are stable so automation can decide
+// what to do about a failure without parsing messages.
+const (
+	CodeValidation  = "validation_failed" // the request is wrong, retrying will not help
+	CodeNotFound    = "not_found"         // the row does not exist
+	CodeConflict    = "conflict"          // e.g. two rows with the same primary key
+	CodeUnavailable = "admin_unavailable" // the admin interface could not be reached, retry later
+	CodeRejected    = "proxysql_rejected" // ProxySQL refused the statement e.g. a CHECK constraint failed
+	CodeTimeout     = "timeout"           // the statement was cancelled or ran out of time
+	CodeInternal    = "internal_error"
+)
+
+// Error is returned by the functions in this package which read or
+// change a table. Err is the underlying error, usually a
+// *mysql.MySQLError or a connection error.
+type Error struct {
+	Code  string
+	Table string // e.g. mysql_servers, empty if unknown
+	Row   string // natural key of the failing row e.g. 1:gotham:3306, empty if unknown
+	Errno uint16 // MySQL error number, 0 if ProxySQL did not return one
+	Err   error
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Row != "":
+		return fmt.Sprintf("%s %s: %v", e.Table, e.Row, e.Err)
+	case e.Table != "":
+		return fmt.Sprintf("%s: %v", e.Table, e.Err)
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Retryable returns true if the same request may succeed later
+func (e *Error) Retryable() bool {
+	return e.Code == CodeUnavailable || e.Code == CodeTimeout
+}
+
+// AsError returns err as an *Error. Errors which are not one already,
+// e.g. from decoding a payload or a bare driver error, are classified
+// by their type. It returns nil for a nil err.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var me *mysql.MySQLError
+	var fe FieldErrors
+	var pe *PatchError
+	var se *json.SyntaxError
+	var te *json.UnmarshalTypeError
+	var ne net.Error
+	switch {
+	case errors.As(err, &me):
+		return &Error{Code: mysqlErrorCode(me), Errno: me.Number, Err: err}
+	case errors.As(err, &pe):
+		if pe.TestFailed {
+			return &Error{Code: CodeConflict, Err: err}
+		}
+		return &Error{Code: CodeValidation, Err: err}
+	case errors.As(err, &fe), errors.As(err, &se), errors.As(err, &te):
+		return &Error{Code: CodeValidation, Err: err}
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return &Error{Code: CodeTimeout, Err: err}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &ne):
+		return &Error{Code: CodeUnavailable, Err: err}
+	}
+	return &Error{Code: CodeInternal, Err: err}
+}
+
+// mysqlErrorCode classifies an error returned by the admin interface.
+// ProxySQL reports almost every failed admin statement, including
+// SQLite constraint failures, as error 1045, so the message decides.
+func mysqlErrorCode(me *mysql.MySQLError) string {
+	switch {
+	case strings.Contains(me.Message, "UNIQUE constraint failed"):
+		return CodeConflict
+	case strings.HasPrefix(me.Message, "Access denied"):
+		// our credentials are wrong, not the request
+		return CodeUnavailable
+	}
+	return CodeRejected
+}
+
+// tableError returns err as an *Error about row of tbl, or nil if err
+// is nil
+func tableError(tbl, row string, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := *AsError(err)
+	if e.Table == "" {
+		e.Table = tbl
+	}
+	if e.Row == "" {
+		e.Row = row
+	}
+	return &e
+}
+
+// insertError is tableError for a multi row INSERT of rows into tbl.
+// ProxySQL does not say which row failed, but a UNIQUE constraint can
+// be pinned on the first duplicate key, and a single row on itself.
+func insertError(tbl string, rows []keyedRow, err error) error {
+	if err == nil {
+		return nil
+	}
+	row := ""
+	if AsError(err).Code == CodeConflict {
+		seen := make(map[string]bool)
+		for _, r := range rows {
+			if seen[r.key] {
+				row = r.key
+				break
+			}
+			seen[r.key] = true
+		}
+	} else if len(rows) == 1 {
+		row = rows[0].key
+	}
+	return tableError(tbl, row, err)
+}
+
+// NotFound returns a CodeNotFound *Error for row of tbl
+func NotFound(tbl, row string) error {
+	return &Error{Code: CodeNotFound, Table: tbl, Row: row, Err: errors.New("not found")}
+}
+
+// invalid returns a CodeValidation *Error for row of tbl
+func invalid(tbl, row, msg string) error {
+	return &Error{Code: CodeValidation, Table: tbl, Row: row, Err: errors.New(msg)}
+}
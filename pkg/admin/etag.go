@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ETag returns a strong entity tag for the contents of a table, e.g.
+// the []MysqlServer returned by SelectMysqlServers, the map returned by
+// SelectGlobalVariables or a *ProxySQLConfig. A nil slice has the same
+// tag as an empty one. Passwords are hashed as mysql_native_password
+// first, so the tag of a redacted response does not hash the plain
+// text password.
+func ETag(v interface{}) string {
+	switch t := v.(type) {
+	case []MysqlUser:
+		v = etagMysqlUsers(t)
+	case *ProxySQLConfig:
+		if t != nil {
+			c := *t
+			c.MysqlUsers = etagMysqlUsers(c.MysqlUsers)
+			v = &c
+		}
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		v = []interface{}{}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		// every table marshals, but never hand out a tag which
+		// matches a different table
+		b = []byte(err.Error())
+	}
+	return fmt.Sprintf(`"%x"`, sha1.Sum(b))
+}
+
+func etagMysqlUsers(users []MysqlUser) []MysqlUser {
+	if users == nil {
+		return []MysqlUser{}
+	}
+	ret := make([]MysqlUser, len(users))
+	for i, u := range users {
+		if u.Password != nil && !isMysqlNativePasswordHash(*u.Password) {
+			pw := mysqlNativePasswordHash(*u.Password)
+			u.Password = &pw
+		}
+		ret[i] = u
+	}
+	return ret
+}
+
+// SelectRuntimeChecksums returns the checksums ProxySQL keeps of its
+// runtime config for clustering by name, e.g. mysql_servers or
+// mysql_variables. Checksums which have not been computed, see the
+// admin-checksum_* variables, are left out. ProxySQL before 1.4 has no
+// runtime_checksums_values table and returns an error.
+func SelectRuntimeChecksums(db DB) (map[string]string, error) {
+	ret := make(map[string]string)
+	rows, err := db.Query(`SELECT name, version, checksum FROM runtime_checksums_values;`)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var version int64
+		var checksum sql.NullString
+		if err := rows.Scan(&name, &version, &checksum); err != nil {
+			return ret, err
+		}
+		if version == 0 || !checksum.Valid || strings.Trim(checksum.String, "0x") == "" {
+			continue
+		}
+		ret[name] = checksum.String
+	}
+	return ret, rows.Err()
+}
+
+// RuntimeETag returns an entity tag built from the named checksums, see
+// SelectRuntimeChecksums, or false if any of them is missing
+func RuntimeETag(checksums map[string]string, names ...string) (string, bool) {
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		c, ok := checksums[name]
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, c)
+	}
+	return fmt.Sprintf(`"%s"`, strings.Join(parts, "-")), true
+}
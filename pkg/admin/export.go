@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"reflect"
+)
+
+// ExportOptions controls how ExportProxySQLConfig renders a config
+type ExportOptions struct {
+	// Redact replaces backend passwords with RedactedPassword and drops
+	// global variables holding credentials. A redacted export cannot be
+	// loaded as is.
+	Redact bool
+
+	// Minimal drops columns which equal ProxySQL's defaults. They are
+	// filled back in on load. Global variables are always exported in
+	// full, ProxySQL does not expose their defaults.
+	Minimal bool
+}
+
+// ExportProxySQLConfig returns c as a document which can be loaded
+// back with LoadToMemory or LoadToRuntime, e.g. through
+// /load/runtime/config. The separate frontend and backend rows
+// ProxySQL keeps in runtime_mysql_users are merged.
+func ExportProxySQLConfig(c *ProxySQLConfig, opts ExportOptions) map[string]interface{} {
+	users := mergeFrontendBackendUsers(c.MysqlUsers)
+	if opts.Redact {
+		users = RedactMysqlUsers(users)
+	}
+
+	globalVariables := make(map[string]string)
+	for name, value := range c.GlobalVariables {
+		if opts.Redact && IsSecretGlobalVariable(name) {
+			continue
+		}
+		globalVariables[name] = value
+	}
+
+	rules := make([]map[string]interface{}, 0, len(c.MysqlQueryRules))
+	for _, r := range c.MysqlQueryRules {
+		rules = append(rules, exportRow(r, *NewMysqlQueryRule(), opts.Minimal, "rule_id"))
+	}
+	servers := make([]map[string]interface{}, 0, len(c.MysqlServers))
+	for _, s := range c.MysqlServers {
+		servers = append(servers, exportRow(s, *NewMysqlServer(""), opts.Minimal, "hostgroup_id", "hostname", "port"))
+	}
+	exportedUsers := make([]map[string]interface{}, 0, len(users))
+	for _, u := range users {
+		exportedUsers = append(exportedUsers, exportRow(u, *NewMysqlUser(""), opts.Minimal, "username"))
+	}
+
+	ret := map[string]interface{}{
+		"mysql_query_rules": rules,
+		"mysql_servers":     servers,
+		"mysql_users":       exportedUsers,
+		"global_variables":  globalVariables,
+	}
+	if c.Scheduler != nil {
+		scheduler := make([]map[string]interface{}, 0, len(c.Scheduler))
+		for _, s := range c.Scheduler {
+			scheduler = append(scheduler, exportRow(s, *NewScheduler(""), opts.Minimal, "id", "filename"))
+		}
+		ret["scheduler"] = scheduler
+	}
+	return ret
+}
+
+// exportRow converts row to its JSON columns. If minimal, columns equal
+// to those of defaults are dropped, except for the key columns.
+func exportRow(row, defaults interface{}, minimal bool, keys ...string) map[string]interface{} {
+	cols := toColumns(row)
+	if !minimal {
+		return cols
+	}
+	defaultCols := toColumns(defaults)
+	for col, v := range cols {
+		if !containsString(keys, col) && reflect.DeepEqual(v, defaultCols[col]) {
+			delete(cols, col)
+		}
+	}
+	return cols
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Supported config formats. YAML and TOML documents use the same
+// field names as the JSON tags. FormatCnf, ProxySQL's own config file
+// format, can only hold a ProxySQLConfig, see ParseCnf.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+	FormatCnf  = "cnf"
+)
+
+// FormatFromExtension returns the format of filename based on its
+// extension, defaulting to JSON
+func FormatFromExtension(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	case ".cnf":
+		return FormatCnf
+	}
+	return FormatJSON
+}
+
+// FormatFromMediaType returns the format of a Content-Type or Accept
+// media type, or "" if it is not a YAML, TOML, cnf or JSON type
+func FormatFromMediaType(mediaType string) string {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return ""
+	}
+	switch mt {
+	case "application/json":
+		return FormatJSON
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return FormatYAML
+	case "application/toml", "text/toml", "text/x-toml":
+		return FormatTOML
+	case "text/x-proxysql-cnf":
+		return FormatCnf
+	}
+	return ""
+}
+
+// MediaType returns the Content-Type to use for format
+func MediaType(format string) string {
+	switch format {
+	case FormatYAML:
+		return "application/yaml"
+	case FormatTOML:
+		return "application/toml"
+	case FormatCnf:
+		return "text/x-proxysql-cnf"
+	}
+	return "application/json"
+}
+
+// Unmarshal decodes data in format into v. YAML and TOML are converted
+// to JSON first, so the JSON tags and the defaulting done by e.g.
+// MysqlServer.UnmarshalJSON apply to every format.
+//
+// TOML documents must be tables. If v is a slice, a TOML document
+// holding a single array, e.g. [[mysql_servers]] entries, is accepted.
+func Unmarshal(format string, data []byte, v interface{}) error {
+	return unmarshal(format, data, v, false)
+}
+
+// UnmarshalStrict is Unmarshal, but rejects documents with unknown
+// fields or values of the wrong type with FieldErrors, see CheckFields
+func UnmarshalStrict(format string, data []byte, v interface{}) error {
+	return unmarshal(format, data, v, true)
+}
+
+func unmarshal(format string, data []byte, v interface{}, strict bool) error {
+	var generic interface{}
+	switch format {
+	case FormatJSON:
+		return decodeJSON(data, v, strict)
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		return remarshalJSON(stringKeys(generic), v, strict)
+	case FormatTOML:
+		var table map[string]interface{}
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			return err
+		}
+		generic = table
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Slice && len(table) == 1 {
+			for _, arr := range table {
+				generic = arr
+			}
+		}
+		return remarshalJSON(generic, v, strict)
+	case FormatCnf:
+		c, ok := v.(*ProxySQLConfig)
+		if !ok {
+			return fmt.Errorf("only a config can be read from the %s format", format)
+		}
+		parsed, err := parseCnf(data, strict)
+		if err != nil {
+			return err
+		}
+		*c = *parsed
+		return nil
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
+
+// Marshal encodes v in format using its JSON field names. TOML cannot
+// hold null values, they are omitted, and its documents must be
+// tables, so a slice is wrapped in a table under key.
+func Marshal(format string, v interface{}, key string) ([]byte, error) {
+	if format == FormatJSON {
+		return json.Marshal(v)
+	}
+
+	// round trip through JSON to pick up the JSON tags
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalJSONAs(format, b, key)
+}
+
+// MarshalJSONAs converts the JSON document b to format, see Marshal
+func MarshalJSONAs(format string, b []byte, key string) ([]byte, error) {
+	if format == FormatJSON {
+		return b, nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var generic interface{}
+	if err := d.Decode(&generic); err != nil {
+		return nil, err
+	}
+	generic = fromJSONNumbers(generic)
+
+	switch format {
+	case FormatYAML:
+		return yaml.Marshal(generic)
+	case FormatTOML:
+		if _, ok := generic.(map[string]interface{}); !ok {
+			generic = map[string]interface{}{key: generic}
+		}
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(generic); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case FormatCnf:
+		var c ProxySQLConfig
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, fmt.Errorf("only a config can be written in the %s format: %v", format, err)
+		}
+		return MarshalCnf(&c)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+func remarshalJSON(generic, v interface{}, strict bool) error {
+	stringifyGlobalVariables(generic, v)
+	b, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(b, v, strict)
+}
+
+func decodeJSON(data []byte, v interface{}, strict bool) error {
+	if strict {
+		if err := CheckFields(data, v); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringifyGlobalVariables converts unquoted YAML and TOML global
+// variable values, e.g. mysql-threads: 4, to the strings they are in
+// JSON
+func stringifyGlobalVariables(generic, v interface{}) {
+	m, ok := generic.(map[string]interface{})
+	if !ok {
+		return
+	}
+	switch v.(type) {
+	case *ProxySQLConfig:
+		m, ok = m["global_variables"].(map[string]interface{})
+		if !ok {
+			return
+		}
+	case *map[string]string:
+	default:
+		return
+	}
+	for name, value := range m {
+		switch value.(type) {
+		case string, nil:
+		default:
+			m[name] = fmt.Sprintf("%v", value)
+		}
+	}
+}
+
+// stringKeys converts the map[interface{}]interface{} values yaml.v2
+// decodes mappings into, which encoding/json cannot handle
+func stringKeys(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			ret[fmt.Sprintf("%v", k)] = stringKeys(v)
+		}
+		return ret
+	case []interface{}:
+		for i, v := range t {
+			t[i] = stringKeys(v)
+		}
+	}
+	return v
+}
+
+// fromJSONNumbers converts json.Numbers to int64 or float64, so they
+// are encoded as numbers rather than strings
+func fromJSONNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = fromJSONNumbers(v)
+		}
+	case []interface{}:
+		for i, v := range t {
+			t[i] = fromJSONNumbers(v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,620 @@
+package admin
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MonitorLogFilter restricts the rows returned from the monitor log
+// tables. Zero values are ignored, e.g. a zero Port matches every
+// port and a zero Until has no upper bound.
+type MonitorLogFilter struct {
+	Hostname string
+	Port     int
+	Since    time.Time
+	Until    time.Time
+}
+
+// where returns the WHERE clause (including the keyword) and its
+// arguments for the filter. An empty string is returned if the filter
+// is empty.
+func (f MonitorLogFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.Hostname != "" {
+		conds = append(conds, "hostname = ?")
+		args = append(args, f.Hostname)
+	}
+	if f.Port != 0 {
+		conds = append(conds, "port = ?")
+		args = append(args, f.Port)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "time_start_us >= ?")
+		args = append(args, f.Since.UnixNano()/1000)
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "time_start_us <= ?")
+		args = append(args, f.Until.UnixNano()/1000)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// queryMonitorLog selects cols from the monitor log table tbl
+// applying the filter f and ordering by backend and time
+func queryMonitorLog(db DB, tbl string, f MonitorLogFilter, cols ...string) (*sql.Rows, error) {
+	where, args := f.where()
+	stmt := fmt.Sprintf(`SELECT
+		 %s
+		 FROM %s %s
+		 ORDER BY hostname, port, time_start_us;`, strings.Join(cols, ",\n\t\t "), tbl, where)
+	return db.Query(stmt, args...)
+}
+
+// usToTime converts the microsecond timestamps used by the monitor
+// tables to a time.Time
+func usToTime(us int64) time.Time {
+	return time.Unix(0, us*1000).UTC()
+}
+
+/*
+CREATE TABLE mysql_server_ping_log (
+    hostname VARCHAR NOT NULL,
+    port INT NOT NULL DEFAULT 3306,
+    time_start_us INT NOT NULL DEFAULT 0,
+    ping_success_time_us INT DEFAULT 0,
+    ping_error VARCHAR,
+    PRIMARY KEY (hostname, port, time_start_us))
+*/
+
+type MonitorMysqlServerPingLog struct {
+	Hostname          string    `json:"hostname"`
+	Port              int       `json:"port"`
+	TimeStart         time.Time `json:"time_start"`
+	TimeStartUS       int64     `json:"time_start_us"`
+	PingSuccessTimeUS int       `json:"ping_success_time_us"`
+	PingError         *string   `json:"ping_error"`
+}
+
+// SelectMonitorMysqlServerPingLogHandler returns every row in
+// mysql_server_ping_log.
+//
+// Deprecated: use SelectMonitorMysqlServerPingLog
+func SelectMonitorMysqlServerPingLogHandler(db DB) ([]MonitorMysqlServerPingLog, error) {
+	return SelectMonitorMysqlServerPingLog(db, MonitorLogFilter{})
+}
+
+func SelectMonitorMysqlServerPingLog(db DB, f MonitorLogFilter) ([]MonitorMysqlServerPingLog, error) {
+	var ret []MonitorMysqlServerPingLog
+
+	rows, err := queryMonitorLog(db, "mysql_server_ping_log", f,
+		"hostname",
+		"port",
+		"time_start_us",
+		"ping_success_time_us",
+		"ping_error",
+	)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var successTimeUS sql.NullInt64
+		var sqlError sql.NullString
+		var r MonitorMysqlServerPingLog
+		err = rows.Scan(
+			&r.Hostname,
+			&r.Port,
+			&r.TimeStartUS,
+			&successTimeUS,
+			&sqlError,
+		)
+		if err != nil {
+			return ret, err
+		}
+
+		r.TimeStart = usToTime(r.TimeStartUS)
+		r.PingSuccessTimeUS = int(successTimeUS.Int64)
+		r.PingError = ptrNullString(sqlError)
+
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+/*
+CREATE TABLE mysql_server_connect_log (
+    hostname VARCHAR NOT NULL,
+    port INT NOT NULL DEFAULT 3306,
+    time_start_us INT NOT NULL DEFAULT 0,
+    connect_success_time_us INT DEFAULT 0,
+    connect_error VARCHAR,
+    PRIMARY KEY (hostname, port, time_start_us))
+*/
+
+type MonitorMysqlServerConnectLog struct {
+	Hostname             string    `json:"hostname"`
+	Port                 int       `json:"port"`
+	TimeStart            time.Time `json:"time_start"`
+	TimeStartUS          int64     `json:"time_start_us"`
+	ConnectSuccessTimeUS int       `json:"connect_success_time_us"`
+	ConnectError         *string   `json:"connect_error"`
+}
+
+func SelectMonitorMysqlServerConnectLog(db DB, f MonitorLogFilter) ([]MonitorMysqlServerConnectLog, error) {
+	var ret []MonitorMysqlServerConnectLog
+
+	rows, err := queryMonitorLog(db, "mysql_server_connect_log", f,
+		"hostname",
+		"port",
+		"time_start_us",
+		"connect_success_time_us",
+		"connect_error",
+	)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var successTimeUS sql.NullInt64
+		var sqlError sql.NullString
+		var r MonitorMysqlServerConnectLog
+		err = rows.Scan(
+			&r.Hostname,
+			&r.Port,
+			&r.TimeStartUS,
+			&successTimeUS,
+			&sqlError,
+		)
+		if err != nil {
+			return ret, err
+		}
+
+		r.TimeStart = usToTime(r.TimeStartUS)
+		r.ConnectSuccessTimeUS = int(successTimeUS.Int64)
+		r.ConnectError = ptrNullString(sqlError)
+
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+/*
+CREATE TABLE mysql_server_read_only_log (
+    hostname VARCHAR NOT NULL,
+    port INT NOT NULL DEFAULT 3306,
+    time_start_us INT NOT NULL DEFAULT 0,
+    success_time_us INT DEFAULT 0,
+    read_only INT DEFAULT 1,
+    error VARCHAR,
+    PRIMARY KEY (hostname, port, time_start_us))
+*/
+
+type MonitorMysqlServerReadOnlyLog struct {
+	Hostname      string    `json:"hostname"`
+	Port          int       `json:"port"`
+	TimeStart     time.Time `json:"time_start"`
+	TimeStartUS   int64     `json:"time_start_us"`
+	SuccessTimeUS int       `json:"success_time_us"`
+	ReadOnly      *int      `json:"read_only"`
+	Error         *string   `json:"error"`
+}
+
+func SelectMonitorMysqlServerReadOnlyLog(db DB, f MonitorLogFilter) ([]MonitorMysqlServerReadOnlyLog, error) {
+	var ret []MonitorMysqlServerReadOnlyLog
+
+	rows, err := queryMonitorLog(db, "mysql_server_read_only_log", f,
+		"hostname",
+		"port",
+		"time_start_us",
+		"success_time_us",
+		"read_only",
+		"error",
+	)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var successTimeUS, readOnly sql.NullInt64
+		var sqlError sql.NullString
+		var r MonitorMysqlServerReadOnlyLog
+		err = rows.Scan(
+			&r.Hostname,
+			&r.Port,
+			&r.TimeStartUS,
+			&successTimeUS,
+			&readOnly,
+			&sqlError,
+		)
+		if err != nil {
+			return ret, err
+		}
+
+		r.TimeStart = usToTime(r.TimeStartUS)
+		r.SuccessTimeUS = int(successTimeUS.Int64)
+		if readOnly.Valid {
+			r.ReadOnly = ptrint(int(readOnly.Int64))
+		}
+		r.Error = ptrNullString(sqlError)
+
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+/*
+CREATE TABLE mysql_server_replication_lag_log (
+    hostname VARCHAR NOT NULL,
+    port INT NOT NULL DEFAULT 3306,
+    time_start_us INT NOT NULL DEFAULT 0,
+    success_time_us INT DEFAULT 0,
+    repl_lag INT DEFAULT 0,
+    error VARCHAR,
+    PRIMARY KEY (hostname, port, time_start_us))
+*/
+
+type MonitorMysqlServerReplicationLagLog struct {
+	Hostname      string    `json:"hostname"`
+	Port          int       `json:"port"`
+	TimeStart     time.Time `json:"time_start"`
+	TimeStartUS   int64     `json:"time_start_us"`
+	SuccessTimeUS int       `json:"success_time_us"`
+	ReplLag       *int      `json:"repl_lag"`
+	Error         *string   `json:"error"`
+}
+
+func SelectMonitorMysqlServerReplicationLagLog(db DB, f MonitorLogFilter) ([]MonitorMysqlServerReplicationLagLog, error) {
+	var ret []MonitorMysqlServerReplicationLagLog
+
+	rows, err := queryMonitorLog(db, "mysql_server_replication_lag_log", f,
+		"hostname",
+		"port",
+		"time_start_us",
+		"success_time_us",
+		"repl_lag",
+		"error",
+	)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var successTimeUS, replLag sql.NullInt64
+		var sqlError sql.NullString
+		var r MonitorMysqlServerReplicationLagLog
+		err = rows.Scan(
+			&r.Hostname,
+			&r.Port,
+			&r.TimeStartUS,
+			&successTimeUS,
+			&replLag,
+			&sqlError,
+		)
+		if err != nil {
+			return ret, err
+		}
+
+		r.TimeStart = usToTime(r.TimeStartUS)
+		r.SuccessTimeUS = int(successTimeUS.Int64)
+		if replLag.Valid {
+			r.ReplLag = ptrint(int(replLag.Int64))
+		}
+		r.Error = ptrNullString(sqlError)
+
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+/*
+CREATE TABLE mysql_server_group_replication_log (
+    hostname VARCHAR NOT NULL,
+    port INT NOT NULL DEFAULT 3306,
+    time_start_us INT NOT NULL DEFAULT 0,
+    success_time_us INT DEFAULT 0,
+    viable_candidate VARCHAR NOT NULL DEFAULT 'NO',
+    read_only VARCHAR NOT NULL DEFAULT 'YES',
+    transactions_behind INT DEFAULT 0,
+    error VARCHAR,
+    PRIMARY KEY (hostname, port, time_start_us))
+*/
+
+type MonitorMysqlServerGroupReplicationLog struct {
+	Hostname           string    `json:"hostname"`
+	Port               int       `json:"port"`
+	TimeStart          time.Time `json:"time_start"`
+	TimeStartUS        int64     `json:"time_start_us"`
+	SuccessTimeUS      int       `json:"success_time_us"`
+	ViableCandidate    string    `json:"viable_candidate"`
+	ReadOnly           string    `json:"read_only"`
+	TransactionsBehind *int      `json:"transactions_behind"`
+	Error              *string   `json:"error"`
+}
+
+func SelectMonitorMysqlServerGroupReplicationLog(db DB, f MonitorLogFilter) ([]MonitorMysqlServerGroupReplicationLog, error) {
+	var ret []MonitorMysqlServerGroupReplicationLog
+
+	rows, err := queryMonitorLog(db, "mysql_server_group_replication_log", f,
+		"hostname",
+		"port",
+		"time_start_us",
+		"success_time_us",
+		"viable_candidate",
+		"read_only",
+		"transactions_behind",
+		"error",
+	)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var successTimeUS, transactionsBehind sql.NullInt64
+		var sqlError sql.NullString
+		var r MonitorMysqlServerGroupReplicationLog
+		err = rows.Scan(
+			&r.Hostname,
+			&r.Port,
+			&r.TimeStartUS,
+			&successTimeUS,
+			&r.ViableCandidate,
+			&r.ReadOnly,
+			&transactionsBehind,
+			&sqlError,
+		)
+		if err != nil {
+			return ret, err
+		}
+
+		r.TimeStart = usToTime(r.TimeStartUS)
+		r.SuccessTimeUS = int(successTimeUS.Int64)
+		if transactionsBehind.Valid {
+			r.TransactionsBehind = ptrint(int(transactionsBehind.Int64))
+		}
+		r.Error = ptrNullString(sqlError)
+
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+/*//////////////////////////////////////////////////////////////////////*/
+// Health summary
+
+// MonitorCheckSummary summarizes the ping or connect checks the
+// ProxySQL monitor ran against a single backend. Latencies only take
+// successful checks into account.
+type MonitorCheckSummary struct {
+	Checks      int     `json:"checks"`
+	Successes   int     `json:"successes"`
+	SuccessRate float64 `json:"success_rate"`
+	P50US       *int    `json:"p50_us"`
+	P99US       *int    `json:"p99_us"`
+}
+
+// MonitorError is the most recent error reported by any of the
+// monitor checks
+type MonitorError struct {
+	Check string    `json:"check"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// MonitorReplicationLag summarizes the replication lag reported for
+// a backend. Trend is one of "increasing", "decreasing" or "stable"
+// and compares the average lag of the older half of the samples to
+// the newer half.
+type MonitorReplicationLag struct {
+	Samples int    `json:"samples"`
+	Latest  *int   `json:"latest"`
+	Min     int    `json:"min"`
+	Max     int    `json:"max"`
+	Trend   string `json:"trend"`
+}
+
+// MonitorBackendHealth summarizes the monitor logs of a single
+// backend
+type MonitorBackendHealth struct {
+	Hostname       string                 `json:"hostname"`
+	Port           int                    `json:"port"`
+	Ping           MonitorCheckSummary    `json:"ping"`
+	Connect        MonitorCheckSummary    `json:"connect"`
+	LastError      *MonitorError          `json:"last_error"`
+	ReadOnly       *int                   `json:"read_only"`
+	ReplicationLag *MonitorReplicationLag `json:"replication_lag"`
+}
+
+func (h *MonitorBackendHealth) ToJSON() string { return toJSON(h) }
+
+// SelectMonitorHealth summarizes the ping, connect, read_only and
+// replication lag logs matching f for every backend found in them.
+func SelectMonitorHealth(db DB, f MonitorLogFilter) ([]MonitorBackendHealth, error) {
+	pings, err := SelectMonitorMysqlServerPingLog(db, f)
+	if err != nil {
+		return nil, err
+	}
+	connects, err := SelectMonitorMysqlServerConnectLog(db, f)
+	if err != nil {
+		return nil, err
+	}
+	readOnlys, err := SelectMonitorMysqlServerReadOnlyLog(db, f)
+	if err != nil {
+		return nil, err
+	}
+	lags, err := SelectMonitorMysqlServerReplicationLagLog(db, f)
+	if err != nil {
+		return nil, err
+	}
+
+	type backend struct {
+		hostname string
+		port     int
+	}
+	health := make(map[backend]*MonitorBackendHealth)
+	get := func(hostname string, port int) *MonitorBackendHealth {
+		k := backend{hostname, port}
+		if h, ok := health[k]; ok {
+			return h
+		}
+		h := &MonitorBackendHealth{Hostname: hostname, Port: port}
+		health[k] = h
+		return h
+	}
+	setLastError := func(h *MonitorBackendHealth, check string, t time.Time, e *string) {
+		if e == nil || *e == "" {
+			return
+		}
+		if h.LastError == nil || t.After(h.LastError.Time) {
+			h.LastError = &MonitorError{Check: check, Time: t, Error: *e}
+		}
+	}
+
+	pingLatencies := make(map[*MonitorBackendHealth][]int)
+	for _, p := range pings {
+		h := get(p.Hostname, p.Port)
+		h.Ping.Checks++
+		if p.PingError == nil {
+			h.Ping.Successes++
+			pingLatencies[h] = append(pingLatencies[h], p.PingSuccessTimeUS)
+		}
+		setLastError(h, "ping", p.TimeStart, p.PingError)
+	}
+
+	connectLatencies := make(map[*MonitorBackendHealth][]int)
+	for _, c := range connects {
+		h := get(c.Hostname, c.Port)
+		h.Connect.Checks++
+		if c.ConnectError == nil {
+			h.Connect.Successes++
+			connectLatencies[h] = append(connectLatencies[h], c.ConnectSuccessTimeUS)
+		}
+		setLastError(h, "connect", c.TimeStart, c.ConnectError)
+	}
+
+	// rows are ordered by time so the last value seen is the latest
+	for _, ro := range readOnlys {
+		h := get(ro.Hostname, ro.Port)
+		if ro.ReadOnly != nil {
+			h.ReadOnly = ro.ReadOnly
+		}
+		setLastError(h, "read_only", ro.TimeStart, ro.Error)
+	}
+
+	replLags := make(map[*MonitorBackendHealth][]int)
+	for _, l := range lags {
+		h := get(l.Hostname, l.Port)
+		if l.ReplLag != nil {
+			replLags[h] = append(replLags[h], *l.ReplLag)
+		}
+		setLastError(h, "replication_lag", l.TimeStart, l.Error)
+	}
+
+	var ret []MonitorBackendHealth
+	for _, h := range health {
+		summarizeChecks(&h.Ping, pingLatencies[h])
+		summarizeChecks(&h.Connect, connectLatencies[h])
+		if samples := replLags[h]; len(samples) > 0 {
+			h.ReplicationLag = summarizeReplicationLag(samples)
+		}
+		ret = append(ret, *h)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Hostname != ret[j].Hostname {
+			return ret[i].Hostname < ret[j].Hostname
+		}
+		return ret[i].Port < ret[j].Port
+	})
+	return ret, nil
+}
+
+func summarizeChecks(s *MonitorCheckSummary, latencies []int) {
+	if s.Checks > 0 {
+		s.SuccessRate = float64(s.Successes) / float64(s.Checks)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Ints(latencies)
+	s.P50US = ptrint(percentile(latencies, 50))
+	s.P99US = ptrint(percentile(latencies, 99))
+}
+
+// percentile returns the nearest-rank percentile p of the sorted,
+// non-empty slice vals
+func percentile(vals []int, p int) int {
+	rank := (p*len(vals) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return vals[rank-1]
+}
+
+// summarizeReplicationLag expects samples to be ordered oldest first
+func summarizeReplicationLag(samples []int) *MonitorReplicationLag {
+	ret := &MonitorReplicationLag{
+		Samples: len(samples),
+		Latest:  ptrint(samples[len(samples)-1]),
+		Min:     samples[0],
+		Max:     samples[0],
+		Trend:   "stable",
+	}
+	for _, s := range samples {
+		if s < ret.Min {
+			ret.Min = s
+		}
+		if s > ret.Max {
+			ret.Max = s
+		}
+	}
+	if len(samples) < 2 {
+		return ret
+	}
+
+	half := len(samples) / 2
+	older, newer := 0, 0
+	for _, s := range samples[:half] {
+		older += s
+	}
+	for _, s := range samples[len(samples)-half:] {
+		newer += s
+	}
+	switch {
+	case newer > older:
+		ret.Trend = "increasing"
+	case newer < older:
+		ret.Trend = "decreasing"
+	}
+	return ret
+}
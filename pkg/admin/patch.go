@@ -0,0 +1,498 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Patch document types
+const (
+	PatchMerge = "merge" // JSON Merge Patch, RFC 7386
+	PatchJSON  = "json"  // JSON Patch, RFC 6902
+)
+
+// Patch is a patch against the JSON representation of a table. Tables
+// are represented as an object of rows keyed by their natural key, the
+// same keys DiffProxySQLConfig uses, e.g.
+//
+//	{"1:gotham:3306": {"hostgroup_id": 1, "hostname": "gotham", ...}}
+//
+// for mysql_servers, "username:backend" for mysql_users and rule_id for
+// mysql_query_rules. global_variables is represented as usual. New rows
+// may use any key, but must set their key columns.
+type Patch struct {
+	Type string // PatchMerge or PatchJSON
+	Data []byte
+}
+
+// PatchOptions controls how a patched table is decoded
+type PatchOptions struct {
+	// Strict rejects unknown fields and mistyped values in the patched
+	// rows, see CheckFields
+	Strict bool
+
+	// Redact patches mysql_users with passwords replaced by
+	// RedactedPassword, as a caller without access to them sees the
+	// table. Rows left with RedactedPassword keep their password.
+	Redact bool
+}
+
+// PatchError is returned when a patch is malformed or cannot be
+// applied to the table
+type PatchError struct {
+	Message string
+
+	// TestFailed is set when a JSON Patch test operation failed, i.e.
+	// the table is not in the state the patch expects
+	TestFailed bool
+}
+
+func (e *PatchError) Error() string { return e.Message }
+
+func patchErrorf(format string, args ...interface{}) *PatchError {
+	return &PatchError{Message: fmt.Sprintf(format, args...)}
+}
+
+func PatchMysqlServers(servers []MysqlServer, p Patch, opts PatchOptions) ([]MysqlServer, error) {
+	var ret []MysqlServer
+	if err := patchTable("mysql_servers", mysqlServerRows(servers), p, opts, &ret); err != nil {
+		return nil, err
+	}
+	if err := uniqueKeys("mysql_servers", mysqlServerRows(ret)); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func PatchMysqlQueryRules(rules []MysqlQueryRule, p Patch, opts PatchOptions) ([]MysqlQueryRule, error) {
+	var ret []MysqlQueryRule
+	if err := patchTable("mysql_query_rules", mysqlQueryRuleRows(rules, false), p, opts, &ret); err != nil {
+		return nil, err
+	}
+	var withID []MysqlQueryRule
+	for _, r := range ret {
+		if r.RuleID != nil {
+			withID = append(withID, r)
+		}
+	}
+	if err := uniqueKeys("mysql_query_rules", mysqlQueryRuleRows(withID, false)); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func PatchMysqlUsers(users []MysqlUser, p Patch, opts PatchOptions) ([]MysqlUser, error) {
+	rows := mysqlUserRows(users, nil)
+	if opts.Redact {
+		rows = mysqlUserRows(RedactMysqlUsers(users), nil)
+	}
+
+	var ret []MysqlUser
+	if err := patchTable("mysql_users", rows, p, opts, &ret); err != nil {
+		return nil, err
+	}
+	if err := uniqueKeys("mysql_users", mysqlUserRows(ret, nil)); err != nil {
+		return nil, err
+	}
+
+	if opts.Redact {
+		// a username may have separate frontend and backend rows
+		passwords := make(map[string]*string)
+		for _, u := range users {
+			if u.Username != nil {
+				passwords[mysqlUserKey(u)] = u.Password
+			}
+		}
+		for i, u := range ret {
+			if u.Password == nil || *u.Password != RedactedPassword {
+				continue
+			}
+			pw, ok := passwords[mysqlUserKey(u)]
+			if !ok || pw == nil {
+				return nil, patchErrorf("mysql_users %s: %q is the placeholder for redacted passwords, set a password", mysqlUserKey(u), RedactedPassword)
+			}
+			ret[i].Password = pw
+		}
+	}
+	return ret, nil
+}
+
+// PatchGlobalVariables returns the variables changed by p. Variables
+// cannot be added or removed, ProxySQL defines them.
+func PatchGlobalVariables(vars map[string]string, p Patch, opts PatchOptions) (map[string]string, error) {
+	doc := make(map[string]interface{}, len(vars))
+	for name, value := range vars {
+		doc[name] = value
+	}
+	patched, err := applyPatch(doc, p)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(patched)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]string
+	if err := decodeJSON(b, &result, opts.Strict); err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]string)
+	for name, value := range result {
+		prev, ok := vars[name]
+		if !ok {
+			return nil, patchErrorf("unknown global variable %s", name)
+		}
+		if value != prev {
+			changed[name] = value
+		}
+	}
+	for name := range vars {
+		if _, ok := result[name]; !ok {
+			return nil, patchErrorf("global variable %s cannot be removed", name)
+		}
+	}
+	return changed, nil
+}
+
+// patchTable applies p to the keyed rows of tbl and decodes the
+// resulting rows, ordered by key, into v, a pointer to a slice of rows
+func patchTable(tbl string, rows []keyedRow, p Patch, opts PatchOptions, v interface{}) error {
+	doc := make(map[string]interface{}, len(rows))
+	for _, row := range rows {
+		doc[row.key] = row.cols
+	}
+
+	patched, err := applyPatch(doc, p)
+	if err != nil {
+		return err
+	}
+	obj, ok := patched.(map[string]interface{})
+	if !ok {
+		return patchErrorf("patched %s must be an object of rows keyed by their natural key", tbl)
+	}
+
+	if opts.Strict {
+		// check the rows by key rather than by their position in the
+		// list they are decoded from, so errors point at the row patched
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		rowType := reflect.TypeOf(v).Elem().Elem()
+		byKey := reflect.New(reflect.MapOf(reflect.TypeOf(""), rowType))
+		if err := CheckFields(b, byKey.Interface()); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]interface{}, len(keys))
+	for i, k := range keys {
+		list[i] = obj[k]
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// uniqueKeys returns an error if two rows share a natural key, e.g.
+// after a patch changed a key column
+func uniqueKeys(tbl string, rows []keyedRow) error {
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		if seen[row.key] {
+			return patchErrorf("%s: more than one row with key %s", tbl, row.key)
+		}
+		seen[row.key] = true
+	}
+	return nil
+}
+
+func applyPatch(doc interface{}, p Patch) (interface{}, error) {
+	switch p.Type {
+	case PatchMerge:
+		var patch interface{}
+		if err := json.Unmarshal(p.Data, &patch); err != nil {
+			return nil, patchErrorf("invalid merge patch: %v", err)
+		}
+		return mergePatch(doc, patch), nil
+	case PatchJSON:
+		var ops []map[string]interface{}
+		if err := json.Unmarshal(p.Data, &ops); err != nil {
+			return nil, patchErrorf("invalid JSON patch: %v", err)
+		}
+		for i, op := range ops {
+			var err error
+			if doc, err = applyPatchOperation(doc, op); err != nil {
+				if pe, ok := err.(*PatchError); ok {
+					pe.Message = fmt.Sprintf("operation %d: %s", i, pe.Message)
+				}
+				return nil, err
+			}
+		}
+		return doc, nil
+	}
+	return nil, patchErrorf("unknown patch type %q", p.Type)
+}
+
+// mergePatch implements the MergePatch function of RFC 7386
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// applyPatchOperation applies a single RFC 6902 operation to doc
+func applyPatchOperation(doc interface{}, op map[string]interface{}) (interface{}, error) {
+	name, _ := op["op"].(string)
+	path, ok := op["path"].(string)
+	if !ok {
+		return nil, patchErrorf("%s requires a path", name)
+	}
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	value, hasValue := op["value"]
+	fromTokens := func() ([]string, error) {
+		from, ok := op["from"].(string)
+		if !ok {
+			return nil, patchErrorf("%s requires from", name)
+		}
+		return parsePointer(from)
+	}
+
+	switch name {
+	case "add", "replace", "test":
+		if !hasValue {
+			return nil, patchErrorf("%s requires a value", name)
+		}
+	}
+
+	switch name {
+	case "add":
+		return pointerAdd(doc, tokens, value)
+	case "remove":
+		doc, _, err = pointerRemove(doc, tokens)
+		return doc, err
+	case "replace":
+		if doc, _, err = pointerRemove(doc, tokens); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, tokens, value)
+	case "move":
+		from, err := fromTokens()
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) > len(from) && reflect.DeepEqual(tokens[:len(from)], from) {
+			return nil, patchErrorf("cannot move %s into itself", op["from"])
+		}
+		doc, moved, err := pointerRemove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, tokens, moved)
+	case "copy":
+		from, err := fromTokens()
+		if err != nil {
+			return nil, err
+		}
+		v, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, tokens, deepCopy(v))
+	case "test":
+		v, err := pointerGet(doc, tokens)
+		if err != nil {
+			return nil, &PatchError{Message: err.Error(), TestFailed: true}
+		}
+		if !reflect.DeepEqual(v, value) {
+			return nil, &PatchError{Message: fmt.Sprintf("test failed: %s is %s", path, toJSON(v)), TestFailed: true}
+		}
+		return doc, nil
+	}
+	return nil, patchErrorf("unknown op %q", name)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped
+// reference tokens
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if ptr[0] != '/' {
+		return nil, patchErrorf("invalid JSON pointer %q", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for i, t := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[t]
+			if !ok {
+				return nil, patchErrorf("%s not found", pointerString(tokens[:i+1]))
+			}
+			doc = v
+		case []interface{}:
+			idx, err := arrayIndex(t, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[idx]
+		default:
+			return nil, patchErrorf("%s not found", pointerString(tokens[:i+1]))
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd adds value at tokens, returning the updated doc since
+// arrays may have to grow
+func pointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		idx := len(node)
+		if last != "-" {
+			if idx, err = arrayIndex(last, len(node)); err != nil {
+				return nil, err
+			}
+		}
+		grown := append(node[:idx:idx], append([]interface{}{value}, node[idx:]...)...)
+		return pointerSet(doc, tokens[:len(tokens)-1], grown)
+	}
+	return nil, patchErrorf("cannot add to %s, it is not an object or array", pointerString(tokens[:len(tokens)-1]))
+}
+
+// pointerSet replaces the existing value at tokens
+func pointerSet(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		node[idx] = value
+		return doc, nil
+	}
+	return nil, patchErrorf("%s not found", pointerString(tokens))
+}
+
+// pointerRemove removes the value at tokens, returning the updated doc
+// and the removed value
+func pointerRemove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := pointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		v, ok := node[last]
+		if !ok {
+			return nil, nil, patchErrorf("%s not found", pointerString(tokens))
+		}
+		delete(node, last)
+		return doc, v, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := node[idx]
+		shrunk := append(node[:idx:idx], node[idx+1:]...)
+		doc, err = pointerSet(doc, tokens[:len(tokens)-1], shrunk)
+		return doc, v, err
+	}
+	return nil, nil, patchErrorf("%s not found", pointerString(tokens))
+}
+
+func arrayIndex(token string, max int) (int, error) {
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || idx > max || (len(token) > 1 && token[0] == '0') {
+		return 0, patchErrorf("invalid array index %q", token)
+	}
+	return idx, nil
+}
+
+func pointerString(tokens []string) string {
+	var ret string
+	for _, t := range tokens {
+		ret += "/" + strings.Replace(strings.Replace(t, "~", "~0", -1), "/", "~1", -1)
+	}
+	return ret
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			ret[k] = deepCopy(v)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(t))
+		for i, v := range t {
+			ret[i] = deepCopy(v)
+		}
+		return ret
+	}
+	return v
+}
@@ -0,0 +1,199 @@
+package admin
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestApplyJSONPatch runs the examples of RFC 6902 appendix A
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		doc        string
+		patch      string
+		want       string // empty when the patch must fail
+		testFailed bool
+	}{
+		{
+			name:  "A.1 adding an object member",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			want:  `{"baz": "qux", "foo": "bar"}`,
+		},
+		{
+			name:  "A.2 adding an array element",
+			doc:   `{"foo": ["bar", "baz"]}`,
+			patch: `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			want:  `{"foo": ["bar", "qux", "baz"]}`,
+		},
+		{
+			name:  "A.3 removing an object member",
+			doc:   `{"baz": "qux", "foo": "bar"}`,
+			patch: `[{"op": "remove", "path": "/baz"}]`,
+			want:  `{"foo": "bar"}`,
+		},
+		{
+			name:  "A.4 removing an array element",
+			doc:   `{"foo": ["bar", "qux", "baz"]}`,
+			patch: `[{"op": "remove", "path": "/foo/1"}]`,
+			want:  `{"foo": ["bar", "baz"]}`,
+		},
+		{
+			name:  "A.5 replacing a value",
+			doc:   `{"baz": "qux", "foo": "bar"}`,
+			patch: `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			want:  `{"baz": "boo", "foo": "bar"}`,
+		},
+		{
+			name:  "A.6 moving a value",
+			doc:   `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			patch: `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			want:  `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`,
+		},
+		{
+			name:  "A.7 moving an array element",
+			doc:   `{"foo": ["all", "grass", "cows", "eat"]}`,
+			patch: `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			want:  `{"foo": ["all", "cows", "eat", "grass"]}`,
+		},
+		{
+			name:  "A.8 testing a value: success",
+			doc:   `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			patch: `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			want:  `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		},
+		{
+			name:       "A.9 testing a value: error",
+			doc:        `{"baz": "qux"}`,
+			patch:      `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+			testFailed: true,
+		},
+		{
+			name:  "A.10 adding a nested member object",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			want:  `{"foo": "bar", "child": {"grandchild": {}}}`,
+		},
+		{
+			name:  "A.11 ignoring unrecognized elements",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+			want:  `{"foo": "bar", "baz": "qux"}`,
+		},
+		{
+			name:  "A.12 adding to a nonexistent target",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+		},
+		{
+			// encoding/json keeps the last op, and /baz does not exist
+			name:  "A.13 invalid JSON patch document",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux", "op": "remove"}]`,
+		},
+		{
+			name:  "A.14 ~ escape ordering",
+			doc:   `{"/": 9, "~1": 10}`,
+			patch: `[{"op": "test", "path": "/~01", "value": 10}]`,
+			want:  `{"/": 9, "~1": 10}`,
+		},
+		{
+			name:       "A.15 comparing strings and numbers",
+			doc:        `{"/": 9, "~1": 10}`,
+			patch:      `[{"op": "test", "path": "/~01", "value": "10"}]`,
+			testFailed: true,
+		},
+		{
+			name:  "A.16 adding an array value",
+			doc:   `{"foo": ["bar"]}`,
+			patch: `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			want:  `{"foo": ["bar", ["abc", "def"]]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc interface{}
+			if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+			got, err := applyPatch(doc, Patch{Type: PatchJSON, Data: []byte(tt.patch)})
+			if tt.want == "" {
+				pe, ok := err.(*PatchError)
+				if !ok {
+					t.Fatalf("expected a *PatchError, got %v (%T) and %s", err, err, toJSON(got))
+				}
+				if pe.TestFailed != tt.testFailed {
+					t.Errorf("TestFailed = %v, want %v: %v", pe.TestFailed, tt.testFailed, pe)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyPatch: %v", err)
+			}
+			var want interface{}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %s\nwant %s", toJSON(got), toJSON(want))
+			}
+		})
+	}
+}
+
+func TestPatchMysqlUsersRedacted(t *testing.T) {
+	// batman has separate frontend and backend rows with different
+	// passwords, so they are not merged into one row
+	backend := NewMysqlUser("batman")
+	backend.Password = ptrstring("backend")
+	backend.Frontend = 0
+	frontend := NewMysqlUser("batman")
+	frontend.Password = ptrstring("frontend")
+	frontend.Backend = 0
+	users := []MysqlUser{*backend, *frontend}
+
+	tests := []struct {
+		name      string
+		patch     Patch
+		passwords map[string]string // by username:backend
+		wantErr   bool
+	}{
+		{
+			name:      "redacted passwords are kept per row",
+			patch:     Patch{Type: PatchMerge, Data: []byte(`{"batman:0": {"max_connections": 5}}`)},
+			passwords: map[string]string{"batman:0": "frontend", "batman:1": "backend"},
+		},
+		{
+			name:      "a new password replaces the redacted one",
+			patch:     Patch{Type: PatchJSON, Data: []byte(`[{"op": "replace", "path": "/batman:1/password", "value": "alfred"}]`)},
+			passwords: map[string]string{"batman:0": "frontend", "batman:1": "alfred"},
+		},
+		{
+			name:    "a new row cannot use the placeholder",
+			patch:   Patch{Type: PatchMerge, Data: []byte(`{"robin:1": {"username": "robin", "password": "****"}}`)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PatchMysqlUsers(users, tt.patch, PatchOptions{Strict: true, Redact: true})
+			if tt.wantErr {
+				if _, ok := err.(*PatchError); !ok {
+					t.Fatalf("expected a *PatchError, got %v (%T)", err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PatchMysqlUsers: %v", err)
+			}
+			passwords := make(map[string]string)
+			for _, u := range got {
+				passwords[mysqlUserKey(u)] = *u.Password
+			}
+			if !reflect.DeepEqual(passwords, tt.passwords) {
+				t.Errorf("passwords = %v, want %v", passwords, tt.passwords)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package admin
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+/*
+CREATE TABLE stats_mysql_processlist (
+    ThreadID INT NOT NULL,
+    SessionID INTEGER PRIMARY KEY,
+    user VARCHAR,
+    db VARCHAR,
+    cli_host VARCHAR,
+    cli_port VARCHAR,
+    hostgroup VARCHAR,
+    l_srv_host VARCHAR,
+    l_srv_port VARCHAR,
+    srv_host VARCHAR,
+    srv_port VARCHAR,
+    command VARCHAR,
+    time_ms INT NOT NULL,
+    info VARCHAR)
+*/
+
+type StatsMysqlProcesslist struct {
+	ThreadID  int     `json:"ThreadID"`
+	SessionID int     `json:"SessionID"`
+	User      *string `json:"user"`
+	DB        *string `json:"db"`
+	CliHost   *string `json:"cli_host"`
+	CliPort   *string `json:"cli_port"`
+	Hostgroup *string `json:"hostgroup"`
+	LSrvHost  *string `json:"l_srv_host"`
+	LSrvPort  *string `json:"l_srv_port"`
+	SrvHost   *string `json:"srv_host"`
+	SrvPort   *string `json:"srv_port"`
+	Command   *string `json:"command"`
+	TimeMS    int     `json:"time_ms"`
+	Info      *string `json:"info"`
+}
+
+func (p *StatsMysqlProcesslist) ToJSON() string { return toJSON(p) }
+
+// StatsMysqlProcesslistFilter restricts the sessions returned by
+// SelectStatsMysqlProcesslist. Zero values are ignored.
+type StatsMysqlProcesslistFilter struct {
+	User      string
+	DB        string
+	Hostgroup string
+	Command   string
+	MinTimeMS int
+}
+
+// IsEmpty returns true if the filter matches every session
+func (f StatsMysqlProcesslistFilter) IsEmpty() bool {
+	return f == StatsMysqlProcesslistFilter{}
+}
+
+func (f StatsMysqlProcesslistFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.User != "" {
+		conds = append(conds, "user = ?")
+		args = append(args, f.User)
+	}
+	if f.DB != "" {
+		conds = append(conds, "db = ?")
+		args = append(args, f.DB)
+	}
+	if f.Hostgroup != "" {
+		conds = append(conds, "hostgroup = ?")
+		args = append(args, f.Hostgroup)
+	}
+	if f.Command != "" {
+		conds = append(conds, "command = ?")
+		args = append(args, f.Command)
+	}
+	if f.MinTimeMS != 0 {
+		conds = append(conds, "time_ms >= ?")
+		args = append(args, f.MinTimeMS)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+func SelectStatsMysqlProcesslist(db DB, f StatsMysqlProcesslistFilter) ([]StatsMysqlProcesslist, error) {
+	var ret []StatsMysqlProcesslist
+
+	stmt := `SELECT
+		 ThreadID,
+		 SessionID,
+		 user,
+		 db,
+		 cli_host,
+		 cli_port,
+		 hostgroup,
+		 l_srv_host,
+		 l_srv_port,
+		 srv_host,
+		 srv_port,
+		 command,
+		 time_ms,
+		 info
+		 FROM stats_mysql_processlist %s;`
+
+	where, args := f.where()
+	stmt = fmt.Sprintf(stmt, where)
+	rows, err := db.Query(stmt, args...)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var user, database, cliHost, cliPort, hostgroup, lSrvHost, lSrvPort sql.NullString
+		var srvHost, srvPort, command, info sql.NullString
+
+		var r StatsMysqlProcesslist
+		err = rows.Scan(
+			&r.ThreadID,  // NOT NULL
+			&r.SessionID, // NOT NULL
+			&user,
+			&database,
+			&cliHost,
+			&cliPort,
+			&hostgroup,
+			&lSrvHost,
+			&lSrvPort,
+			&srvHost,
+			&srvPort,
+			&command,
+			&r.TimeMS, // NOT NULL
+			&info,
+		)
+		if err != nil {
+			return ret, err
+		}
+
+		r.User = ptrNullString(user)
+		r.DB = ptrNullString(database)
+		r.CliHost = ptrNullString(cliHost)
+		r.CliPort = ptrNullString(cliPort)
+		r.Hostgroup = ptrNullString(hostgroup)
+		r.LSrvHost = ptrNullString(lSrvHost)
+		r.LSrvPort = ptrNullString(lSrvPort)
+		r.SrvHost = ptrNullString(srvHost)
+		r.SrvPort = ptrNullString(srvPort)
+		r.Command = ptrNullString(command)
+		r.Info = ptrNullString(info)
+
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// KillConnection terminates the client session with the given
+// SessionID (as found in stats_mysql_processlist)
+func KillConnection(db DB, sessionID int) error {
+	stmt := fmt.Sprintf(`KILL CONNECTION %d`, sessionID)
+	_, err := db.Exec(stmt)
+	return err
+}
+
+// KillQuery terminates the query currently running in the client
+// session with the given SessionID but leaves the session open
+func KillQuery(db DB, sessionID int) error {
+	stmt := fmt.Sprintf(`KILL QUERY %d`, sessionID)
+	_, err := db.Exec(stmt)
+	return err
+}
+
+// KillResult reports the outcome of killing a single session
+type KillResult struct {
+	SessionID int     `json:"SessionID"`
+	User      *string `json:"user"`
+	TimeMS    int     `json:"time_ms"`
+	Error     *string `json:"error"`
+}
+
+// KillSessions kills every session in stats_mysql_processlist
+// matching f. If queryOnly is true only the running queries are
+// killed. Killing stops at the first failure of the admin interface
+// to look up the processlist, but individual kill failures are
+// reported in the results and do not stop the remaining kills.
+func KillSessions(db DB, f StatsMysqlProcesslistFilter, queryOnly bool) ([]KillResult, error) {
+	sessions, err := SelectStatsMysqlProcesslist(db, f)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]KillResult, 0, len(sessions))
+	for _, p := range sessions {
+		res := KillResult{SessionID: p.SessionID, User: p.User, TimeMS: p.TimeMS}
+		if queryOnly {
+			err = KillQuery(db, p.SessionID)
+		} else {
+			err = KillConnection(db, p.SessionID)
+		}
+		if err != nil {
+			msg := err.Error()
+			res.Error = &msg
+		}
+		ret = append(ret, res)
+	}
+	return ret, nil
+}
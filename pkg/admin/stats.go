@@ -1,6 +1,10 @@
 package admin
 
-import "database/sql"
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
 
 /*
 CREATE TABLE stats_mysql_connection_pool (
@@ -35,7 +39,19 @@ type StatsMysqlConnectionPool struct {
 
 func (s *StatsMysqlConnectionPool) ToJSON() string { return toJSON(s) }
 
-func SelectStatsMysqlConnectionPool(db *sql.DB) ([]StatsMysqlConnectionPool, error) {
+func SelectStatsMysqlConnectionPool(db DB) ([]StatsMysqlConnectionPool, error) {
+	return selectStatsMysqlConnectionPool(db, false)
+}
+
+// SelectStatsMysqlConnectionPoolReset returns the same rows as
+// SelectStatsMysqlConnectionPool, but reading from
+// stats_mysql_connection_pool_reset causes ProxySQL to zero the
+// counters afterwards.
+func SelectStatsMysqlConnectionPoolReset(db DB) ([]StatsMysqlConnectionPool, error) {
+	return selectStatsMysqlConnectionPool(db, true)
+}
+
+func selectStatsMysqlConnectionPool(db DB, reset bool) ([]StatsMysqlConnectionPool, error) {
 	var ret []StatsMysqlConnectionPool
 	stmt := `SELECT
 		 hostgroup,
@@ -50,7 +66,12 @@ func SelectStatsMysqlConnectionPool(db *sql.DB) ([]StatsMysqlConnectionPool, err
 		 Bytes_data_sent,
 		 Bytes_data_recv,
 		 Latency_us
-		 FROM stats_mysql_connection_pool;`
+		 FROM %s;`
+	tbl := "stats_mysql_connection_pool"
+	if reset {
+		tbl = "stats_mysql_connection_pool_reset"
+	}
+	stmt = fmt.Sprintf(stmt, tbl)
 	rows, err := db.Query(stmt)
 	if err != nil {
 		return ret, err
@@ -84,12 +105,41 @@ func SelectStatsMysqlConnectionPool(db *sql.DB) ([]StatsMysqlConnectionPool, err
 	return ret, nil
 }
 
-func SelectStatsMysqlGlobal(db *sql.DB) (map[string]string, error) {
+func SelectStatsMysqlGlobal(db DB) (map[string]string, error) {
+	return selectStatsVariables(db, "stats_mysql_global")
+}
+
+/*
+CREATE TABLE stats_memory_metrics (
+    Variable_Name VARCHAR NOT NULL PRIMARY KEY,
+    Variable_Value VARCHAR NOT NULL)
+*/
+
+func SelectStatsMemoryMetrics(db DB) (map[string]string, error) {
+	return selectStatsVariables(db, "stats_memory_metrics")
+}
+
+/*
+CREATE TABLE global_variables (
+    variable_name VARCHAR NOT NULL PRIMARY KEY,
+    variable_value VARCHAR NOT NULL)
+*/
+
+// SelectStatsGlobalVariables returns the contents of the stats
+// schema's global_variables table. Not to be confused with the admin
+// global_variables table returned by SelectGlobalVariables.
+func SelectStatsGlobalVariables(db DB) (map[string]string, error) {
+	return selectStatsVariables(db, "stats.global_variables")
+}
+
+// selectStatsVariables returns the name/value pairs of a two column
+// stats table e.g. stats_mysql_global
+func selectStatsVariables(db DB, tbl string) (map[string]string, error) {
 	ret := make(map[string]string)
-	stmt := `SELECT
+	stmt := fmt.Sprintf(`SELECT
 		 Variable_Name,
 		 Variable_Value
-		 FROM stats_mysql_global;`
+		 FROM %s;`, tbl)
 	rows, err := db.Query(stmt)
 	if err != nil {
 		return ret, err
@@ -140,7 +190,7 @@ type StatsMysqlQueryDigest struct {
 	MaxTime    int    `json:"max_time"`
 }
 
-func SelectStatsMysqlQueryDigest(db *sql.DB) ([]StatsMysqlQueryDigest, error) {
+func SelectStatsMysqlQueryDigest(db DB) ([]StatsMysqlQueryDigest, error) {
 	// LIMIT is 100
 
 	var ret []StatsMysqlQueryDigest
@@ -200,7 +250,7 @@ type StatsMysqlQueryRules struct {
 	Hits   int `json:"hits"`
 }
 
-func SelectStatsMysqlQueryRules(db *sql.DB) ([]StatsMysqlQueryRules, error) {
+func SelectStatsMysqlQueryRules(db DB) ([]StatsMysqlQueryRules, error) {
 	var ret []StatsMysqlQueryRules
 
 	stmt := `SELECT
@@ -245,7 +295,7 @@ type StatsMysqlUsers struct {
 	FrontendMaxConnections int    `json:"frontend_max_connections"`
 }
 
-func SelectStatsMysqlUsers(db *sql.DB) ([]StatsMysqlUsers, error) {
+func SelectStatsMysqlUsers(db DB) ([]StatsMysqlUsers, error) {
 	var ret []StatsMysqlUsers
 
 	stmt := `SELECT
@@ -280,33 +330,225 @@ func SelectStatsMysqlUsers(db *sql.DB) ([]StatsMysqlUsers, error) {
 }
 
 /*
-CREATE TABLE mysql_server_ping_log (
+CREATE TABLE stats_mysql_commands_counters (
+    Command VARCHAR NOT NULL PRIMARY KEY,
+    Total_Time_us INT NOT NULL,
+    Total_cnt INT NOT NULL,
+    cnt_100us INT NOT NULL,
+    cnt_500us INT NOT NULL,
+    cnt_1ms INT NOT NULL,
+    cnt_5ms INT NOT NULL,
+    cnt_10ms INT NOT NULL,
+    cnt_50ms INT NOT NULL,
+    cnt_100ms INT NOT NULL,
+    cnt_500ms INT NOT NULL,
+    cnt_1s INT NOT NULL,
+    cnt_5s INT NOT NULL,
+    cnt_10s INT NOT NULL,
+    cnt_INFs)
+*/
+
+// StatsLatencyBucket is one bucket of the latency histogram kept in
+// stats_mysql_commands_counters. Count is the number of commands
+// which took at most UpperBoundUS microseconds (and more than the
+// previous bucket's bound). UpperBoundUS is nil for the cnt_INFs
+// bucket.
+type StatsLatencyBucket struct {
+	Name         string `json:"name"`
+	UpperBoundUS *int   `json:"upper_bound_us"`
+	Count        int    `json:"count"`
+}
+
+// commandsCountersBuckets are the histogram columns of
+// stats_mysql_commands_counters in the order they are selected
+var commandsCountersBuckets = []struct {
+	name         string
+	upperBoundUS *int
+}{
+	{"cnt_100us", ptrint(100)},
+	{"cnt_500us", ptrint(500)},
+	{"cnt_1ms", ptrint(1000)},
+	{"cnt_5ms", ptrint(5000)},
+	{"cnt_10ms", ptrint(10000)},
+	{"cnt_50ms", ptrint(50000)},
+	{"cnt_100ms", ptrint(100000)},
+	{"cnt_500ms", ptrint(500000)},
+	{"cnt_1s", ptrint(1000000)},
+	{"cnt_5s", ptrint(5000000)},
+	{"cnt_10s", ptrint(10000000)},
+	{"cnt_INFs", nil},
+}
+
+type StatsMysqlCommandsCounters struct {
+	Command     string               `json:"Command"`
+	TotalTimeUS int                  `json:"Total_Time_us"`
+	TotalCnt    int                  `json:"Total_cnt"`
+	Latency     []StatsLatencyBucket `json:"latency"`
+}
+
+func (s *StatsMysqlCommandsCounters) ToJSON() string { return toJSON(s) }
+
+func SelectStatsMysqlCommandsCounters(db DB) ([]StatsMysqlCommandsCounters, error) {
+	var ret []StatsMysqlCommandsCounters
+
+	cols := make([]string, len(commandsCountersBuckets))
+	for i, b := range commandsCountersBuckets {
+		cols[i] = b.name
+	}
+	stmt := `SELECT
+		 Command,
+		 Total_Time_us,
+		 Total_cnt,
+		 ` + strings.Join(cols, ",\n\t\t ") + `
+		 FROM stats_mysql_commands_counters;`
+
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var r StatsMysqlCommandsCounters
+		counts := make([]int, len(commandsCountersBuckets))
+		dest := []interface{}{&r.Command, &r.TotalTimeUS, &r.TotalCnt}
+		for i := range counts {
+			dest = append(dest, &counts[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return ret, err
+		}
+		r.Latency = make([]StatsLatencyBucket, len(commandsCountersBuckets))
+		for i, b := range commandsCountersBuckets {
+			r.Latency[i] = StatsLatencyBucket{Name: b.name, UpperBoundUS: b.upperBoundUS, Count: counts[i]}
+		}
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+/*
+CREATE TABLE stats_mysql_prepared_statements_info (
+    global_stmt_id INT NOT NULL,
+    hostgroup INT NOT NULL,
+    schemaname VARCHAR NOT NULL,
+    username VARCHAR NOT NULL,
+    digest VARCHAR NOT NULL,
+    ref_count_client INT NOT NULL,
+    ref_count_server INT NOT NULL,
+    query VARCHAR NOT NULL)
+*/
+
+type StatsMysqlPreparedStatementsInfo struct {
+	GlobalStmtID   int    `json:"global_stmt_id"`
+	Hostgroup      int    `json:"hostgroup"`
+	Schemaname     string `json:"schemaname"`
+	Username       string `json:"username"`
+	Digest         string `json:"digest"`
+	RefCountClient int    `json:"ref_count_client"`
+	RefCountServer int    `json:"ref_count_server"`
+	Query          string `json:"query"`
+}
+
+func SelectStatsMysqlPreparedStatementsInfo(db DB) ([]StatsMysqlPreparedStatementsInfo, error) {
+	var ret []StatsMysqlPreparedStatementsInfo
+
+	stmt := `SELECT
+		 global_stmt_id,
+		 hostgroup,
+		 schemaname,
+		 username,
+		 digest,
+		 ref_count_client,
+		 ref_count_server,
+		 query
+		 FROM stats_mysql_prepared_statements_info;`
+
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var r StatsMysqlPreparedStatementsInfo
+		err = rows.Scan(
+			&r.GlobalStmtID,
+			&r.Hostgroup,
+			&r.Schemaname,
+			&r.Username,
+			&r.Digest,
+			&r.RefCountClient,
+			&r.RefCountServer,
+			&r.Query,
+		)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+/*
+ProxySQL 2.x only
+
+CREATE TABLE stats_mysql_errors (
+    hostgroup INT NOT NULL,
     hostname VARCHAR NOT NULL,
-    port INT NOT NULL DEFAULT 3306,
-    time_start_us INT NOT NULL DEFAULT 0,
-    ping_success_time_us INT DEFAULT 0,
-    ping_error VARCHAR,
-    PRIMARY KEY (hostname, port, time_start_us))
+    port INT NOT NULL,
+    username VARCHAR NOT NULL,
+    client_address VARCHAR NOT NULL,
+    schemaname VARCHAR NOT NULL,
+    errno INT NOT NULL,
+    count_star INTEGER NOT NULL,
+    first_seen INTEGER NOT NULL,
+    last_seen INTEGER NOT NULL,
+    last_error VARCHAR NOT NULL DEFAULT '',
+    PRIMARY KEY (hostgroup, hostname, port, username, schemaname, errno) )
 */
 
-type MonitorMysqlServerPingLog struct {
-	Hostname          string  `json:"hostname"`
-	Port              int     `json:"port"`
-	TimeStartUS       int     `json:"time_start_us"`
-	PingSuccessTimeUS int     `json:"ping_success_time_us"`
-	PingError         *string `json:"ping_error"`
+type StatsMysqlErrors struct {
+	Hostgroup     int    `json:"hostgroup"`
+	Hostname      string `json:"hostname"`
+	Port          int    `json:"port"`
+	Username      string `json:"username"`
+	ClientAddress string `json:"client_address"`
+	Schemaname    string `json:"schemaname"`
+	Errno         int    `json:"errno"`
+	CountStar     int    `json:"count_star"`
+	FirstSeen     int    `json:"first_seen"`
+	LastSeen      int    `json:"last_seen"`
+	LastError     string `json:"last_error"`
 }
 
-func SelectMonitorMysqlServerPingLogHandler(db *sql.DB) ([]MonitorMysqlServerPingLog, error) {
-	var ret []MonitorMysqlServerPingLog
+// SelectStatsMysqlErrors returns the contents of stats_mysql_errors,
+// which only exists in ProxySQL 2.x
+func SelectStatsMysqlErrors(db DB) ([]StatsMysqlErrors, error) {
+	var ret []StatsMysqlErrors
 
 	stmt := `SELECT
+		 hostgroup,
 		 hostname,
 		 port,
-		 time_start_us,
-		 ping_success_time_us,
-		 ping_error
-		 FROM mysql_server_ping_log;`
+		 username,
+		 client_address,
+		 schemaname,
+		 errno,
+		 count_star,
+		 first_seen,
+		 last_seen,
+		 last_error
+		 FROM stats_mysql_errors;`
 
 	rows, err := db.Query(stmt)
 	if err != nil {
@@ -315,21 +557,127 @@ func SelectMonitorMysqlServerPingLogHandler(db *sql.DB) ([]MonitorMysqlServerPin
 
 	defer rows.Close()
 	for rows.Next() {
-		var sqlError sql.NullString
-		var r MonitorMysqlServerPingLog
+		var r StatsMysqlErrors
 		err = rows.Scan(
+			&r.Hostgroup,
 			&r.Hostname,
 			&r.Port,
-			&r.TimeStartUS,
-			&r.PingSuccessTimeUS,
-			&sqlError,
+			&r.Username,
+			&r.ClientAddress,
+			&r.Schemaname,
+			&r.Errno,
+			&r.CountStar,
+			&r.FirstSeen,
+			&r.LastSeen,
+			&r.LastError,
 		)
 		if err != nil {
 			return ret, err
 		}
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
 
-		if sqlError.Valid {
-			r.PingError = &sqlError.String
+/*
+ProxySQL 2.x only
+
+CREATE TABLE stats_mysql_free_connections (
+    fd INT NOT NULL,
+    hostgroup INT NOT NULL,
+    srv_host VARCHAR NOT NULL,
+    srv_port INT NOT NULL,
+    user VARCHAR NOT NULL,
+    schema VARCHAR,
+    init_connect VARCHAR,
+    time_zone VARCHAR,
+    sql_mode VARCHAR,
+    autocommit VARCHAR,
+    idle_ms INT,
+    statistics VARCHAR,
+    mysql_info VARCHAR)
+*/
+
+type StatsMysqlFreeConnections struct {
+	FD          int     `json:"fd"`
+	Hostgroup   int     `json:"hostgroup"`
+	SrvHost     string  `json:"srv_host"`
+	SrvPort     int     `json:"srv_port"`
+	User        string  `json:"user"`
+	Schema      *string `json:"schema"`
+	InitConnect *string `json:"init_connect"`
+	TimeZone    *string `json:"time_zone"`
+	SQLMode     *string `json:"sql_mode"`
+	Autocommit  *string `json:"autocommit"`
+	IdleMS      *int    `json:"idle_ms"`
+	Statistics  *string `json:"statistics"`
+	MysqlInfo   *string `json:"mysql_info"`
+}
+
+// SelectStatsMysqlFreeConnections returns the contents of
+// stats_mysql_free_connections, which only exists in ProxySQL 2.x
+func SelectStatsMysqlFreeConnections(db DB) ([]StatsMysqlFreeConnections, error) {
+	var ret []StatsMysqlFreeConnections
+
+	stmt := `SELECT
+		 fd,
+		 hostgroup,
+		 srv_host,
+		 srv_port,
+		 user,
+		 schema,
+		 init_connect,
+		 time_zone,
+		 sql_mode,
+		 autocommit,
+		 idle_ms,
+		 statistics,
+		 mysql_info
+		 FROM stats_mysql_free_connections;`
+
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return ret, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var schema, initConnect, timeZone, sqlMode, autocommit, statistics, mysqlInfo sql.NullString
+		var idleMS sql.NullInt64
+
+		var r StatsMysqlFreeConnections
+		err = rows.Scan(
+			&r.FD,
+			&r.Hostgroup,
+			&r.SrvHost,
+			&r.SrvPort,
+			&r.User,
+			&schema,
+			&initConnect,
+			&timeZone,
+			&sqlMode,
+			&autocommit,
+			&idleMS,
+			&statistics,
+			&mysqlInfo,
+		)
+		if err != nil {
+			return ret, err
+		}
+
+		r.Schema = ptrNullString(schema)
+		r.InitConnect = ptrNullString(initConnect)
+		r.TimeZone = ptrNullString(timeZone)
+		r.SQLMode = ptrNullString(sqlMode)
+		r.Autocommit = ptrNullString(autocommit)
+		r.Statistics = ptrNullString(statistics)
+		r.MysqlInfo = ptrNullString(mysqlInfo)
+		if idleMS.Valid {
+			r.IdleMS = ptrint(int(idleMS.Int64))
 		}
 
 		ret = append(ret, r)
@@ -341,7 +689,16 @@ func SelectMonitorMysqlServerPingLogHandler(db *sql.DB) ([]MonitorMysqlServerPin
 	return ret, nil
 }
 
-func _TEMPLATESelectStatsMysqlConnectionPool(db *sql.DB) ([]int, error) {
+// ptrNullString returns nil if s is NULL otherwise a pointer to its
+// value
+func ptrNullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func _TEMPLATESelectStatsMysqlConnectionPool(db DB) ([]int, error) {
 	var ret []int // some row
 
 	stmt := `SELECT
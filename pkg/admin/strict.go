@@ -0,0 +1,262 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldError describes a field of a document which would be dropped
+// or mangled when decoding it, e.g. a misspelt column
+type FieldError struct {
+	Path       string `json:"path"` // e.g. $.mysql_servers[0].hostgroupid
+	Problem    string `json:"problem"`
+	Suggestion string `json:"suggestion,omitempty"` // nearest known field name
+}
+
+func (e FieldError) Error() string {
+	if e.Suggestion != "" {
+		return fmt.Sprintf("%s: %s (did you mean %q?)", e.Path, e.Problem, e.Suggestion)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Problem)
+}
+
+// FieldErrors is returned by UnmarshalStrict, it lists every problem
+// found rather than just the first
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// CheckFields compares the JSON document data with the type of v,
+// reporting fields which do not exist in v and values which do not
+// fit the field they are set on, including nulls for columns which
+// cannot be null. encoding/json silently ignores unknown fields and
+// stops at the first type mismatch, so a typo like "hostgroupid"
+// would otherwise load ProxySQL's default instead.
+func CheckFields(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var generic interface{}
+	if err := d.Decode(&generic); err != nil {
+		return err
+	}
+
+	var errs FieldErrors
+	checkFields("$", generic, reflect.TypeOf(v), &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkFields(path string, value interface{}, t reflect.Type, errs *FieldErrors) {
+	mismatch := func(expected string) {
+		*errs = append(*errs, FieldError{Path: path, Problem: fmt.Sprintf("expected %s, got %s", expected, jsonKind(value))})
+	}
+
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+	if value == nil {
+		switch t.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Interface:
+		default:
+			if !nullable {
+				*errs = append(*errs, FieldError{Path: path, Problem: "cannot be null"})
+			}
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			mismatch("a boolean")
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			mismatch("a string")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(json.Number)
+		if !ok {
+			mismatch("an integer")
+		} else if _, err := n.Int64(); err != nil {
+			mismatch("an integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(json.Number); !ok {
+			mismatch("a number")
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := value.([]interface{})
+		if !ok {
+			mismatch("an array")
+			return
+		}
+		for i, elem := range list {
+			checkFields(fmt.Sprintf("%s[%d]", path, i), elem, t.Elem(), errs)
+		}
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			mismatch("an object")
+			return
+		}
+		for _, k := range sortedKeys(obj) {
+			checkFields(fieldPath(path, k), obj[k], t.Elem(), errs)
+		}
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			mismatch("an object")
+			return
+		}
+		fields := jsonFields(t)
+		for _, k := range sortedKeys(obj) {
+			f, ok := lookupField(fields, k)
+			if !ok {
+				*errs = append(*errs, FieldError{Path: fieldPath(path, k), Problem: "unknown field", Suggestion: nearestField(fields, k)})
+				continue
+			}
+			checkFields(fieldPath(path, k), obj[k], f.Type, errs)
+		}
+	}
+}
+
+// jsonFields returns the fields of t by their JSON name
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	ret := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		ret[name] = f
+	}
+	return ret
+}
+
+// lookupField matches name the way encoding/json does, preferring an
+// exact match over a case insensitive one
+func lookupField(fields map[string]reflect.StructField, name string) (reflect.StructField, bool) {
+	if f, ok := fields[name]; ok {
+		return f, true
+	}
+	for n, f := range fields {
+		if strings.EqualFold(n, name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// nearestField returns the field name closest to name, or "" if none
+// is close enough to be a likely typo
+func nearestField(fields map[string]reflect.StructField, name string) string {
+	best, bestDist := "", -1
+	for n := range fields {
+		d := editDistance(strings.ToLower(name), strings.ToLower(n))
+		if bestDist < 0 || d < bestDist || (d == bestDist && n < best) {
+			best, bestDist = n, d
+		}
+	}
+	max := len(name) / 3
+	if max < 2 {
+		max = 2
+	}
+	if bestDist < 0 || bestDist > max {
+		return ""
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(vals ...int) int {
+	ret := vals[0]
+	for _, v := range vals[1:] {
+		if v < ret {
+			ret = v
+		}
+	}
+	return ret
+}
+
+// fieldPath appends key to path, quoting keys which are not plain
+// identifiers e.g. global variable names
+func fieldPath(path, key string) string {
+	for _, c := range key {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return fmt.Sprintf("%s[%q]", path, key)
+		}
+	}
+	return path + "." + key
+}
+
+func jsonKind(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case string:
+		return "a string"
+	case json.Number:
+		if _, err := t.Int64(); err != nil {
+			return fmt.Sprintf("the number %s", t)
+		}
+		return "a number"
+	case []interface{}:
+		return "an array"
+	}
+	return "an object"
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
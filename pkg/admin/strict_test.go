@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckFields(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		v    interface{}
+		want FieldErrors
+	}{
+		{
+			name: "valid",
+			data: `[{"hostgroup_id": 1, "hostname": "gotham", "port": 3306, "comment": "primary"}]`,
+			v:    []MysqlServer{},
+		},
+		{
+			name: "hostgroupid",
+			data: `[{"hostgroupid": 1, "hostname": "gotham"}]`,
+			v:    []MysqlServer{},
+			want: FieldErrors{{Path: "$[0].hostgroupid", Problem: "unknown field", Suggestion: "hostgroup_id"}},
+		},
+		{
+			name: "max_conections",
+			data: `[{"username": "batman", "max_conections": 100}]`,
+			v:    []MysqlUser{},
+			want: FieldErrors{{Path: "$[0].max_conections", Problem: "unknown field", Suggestion: "max_connections"}},
+		},
+		{
+			name: "no suggestion for an unrelated field",
+			data: `[{"hostname": "gotham", "datacenter": "east"}]`,
+			v:    []MysqlServer{},
+			want: FieldErrors{{Path: "$[0].datacenter", Problem: "unknown field"}},
+		},
+		{
+			name: "field names are matched case insensitively",
+			data: `[{"Hostname": "gotham", "PORT": 3306}]`,
+			v:    []MysqlServer{},
+		},
+		{
+			name: "every problem is reported",
+			data: `[{"hostname": "gotham", "port": "3306"}, {"hostname": "newyork", "weight": 1.5, "status": null}]`,
+			v:    []MysqlServer{},
+			want: FieldErrors{
+				{Path: "$[0].port", Problem: "expected an integer, got a string"},
+				{Path: "$[1].status", Problem: "cannot be null"},
+				{Path: "$[1].weight", Problem: "expected an integer, got the number 1.5"},
+			},
+		},
+		{
+			name: "nullable columns",
+			data: `[{"username": "batman", "password": null, "default_schema": null}]`,
+			v:    []MysqlUser{},
+		},
+		{
+			name: "not an array",
+			data: `{"hostname": "gotham"}`,
+			v:    []MysqlServer{},
+			want: FieldErrors{{Path: "$", Problem: "expected an array, got an object"}},
+		},
+		{
+			name: "config document",
+			data: `{"mysql_servers": [{"hostname": "gotham"}], "global_variables": {"mysql-threads": 4}, "mysql_user": []}`,
+			v:    ProxySQLConfig{},
+			want: FieldErrors{
+				{Path: `$.global_variables["mysql-threads"]`, Problem: "expected a string, got a number"},
+				{Path: "$.mysql_user", Problem: "unknown field", Suggestion: "mysql_users"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckFields([]byte(tt.data), tt.v)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("CheckFields: %v", err)
+				}
+				return
+			}
+			got, ok := err.(FieldErrors)
+			if !ok {
+				t.Fatalf("expected FieldErrors, got %T: %v", err, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldErrorMessage(t *testing.T) {
+	err := FieldErrors{
+		{Path: "$[0].hostgroupid", Problem: "unknown field", Suggestion: "hostgroup_id"},
+		{Path: "$[1].port", Problem: "expected an integer, got a string"},
+	}
+	want := `$[0].hostgroupid: unknown field (did you mean "hostgroup_id"?); $[1].port: expected an integer, got a string`
+	if err.Error() != want {
+		t.Errorf("got  %s\nwant %s", err.Error(), want)
+	}
+}
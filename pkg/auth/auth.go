@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Permission is an action an identity may be allowed to perform
+type Permission string
+
+const (
+	ReadStats   Permission = "read_stats"   // stats and monitor tables
+	ReadConfig  Permission = "read_config"  // memory and runtime tables, with passwords redacted
+	ReadSecrets Permission = "read_secrets" // backend passwords in mysql_users
+	WriteMemory Permission = "write_memory" // change memory tables
+	LoadRuntime Permission = "load_runtime" // LOAD ... TO RUNTIME and other runtime changes e.g. killing connections
+	ReadAudit   Permission = "read_audit"   // the audit log of config changes
+
+	// All grants every permission when used in a role
+	All Permission = "*"
+)
+
+// Identity is an authenticated caller
+type Identity struct {
+	Name   string `json:"name"`
+	Method string `json:"method"` // token, basic or mtls
+}
+
+// ErrInvalidCredentials is returned by an Authenticator when a
+// request carries credentials of its kind that are not valid
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator identifies the caller of a request. It returns nil
+// and no error if the request does not carry credentials it
+// understands, so the next Authenticator can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Authenticators tries each Authenticator in turn and returns the
+// first identity found
+type Authenticators []Authenticator
+
+func (as Authenticators) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range as {
+		id, err := a.Authenticate(r)
+		if err != nil || id != nil {
+			return id, err
+		}
+	}
+	return nil, nil
+}
+
+/*//////////////////////////////////////////////////////////////////////*/
+
+// StaticTokens authenticates "Authorization: Bearer <token>" headers
+// against a fixed set of tokens
+type StaticTokens map[string]string // token -> identity name
+
+// LoadStaticTokensFile reads a file of "<token> <identity>" lines.
+// Blank lines and lines starting with # are ignored.
+func LoadStaticTokensFile(filename string) (StaticTokens, error) {
+	ret := make(StaticTokens)
+	err := readLines(filename, func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("expected \"<token> <identity>\"")
+		}
+		ret[fields[0]] = fields[1]
+		return nil
+	})
+	return ret, err
+}
+
+func (t StaticTokens) Authenticate(r *http.Request) (*Identity, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	for known, name := range t {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			return &Identity{Name: name, Method: "token"}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+/*//////////////////////////////////////////////////////////////////////*/
+
+// BasicAuth authenticates HTTP basic auth against bcrypt hashed
+// passwords
+type BasicAuth map[string][]byte // username -> bcrypt hash
+
+// LoadBasicAuthFile reads a file of "<username>:<bcrypt hash>" lines,
+// as written by `htpasswd -B`. Blank lines and lines starting with #
+// are ignored.
+func LoadBasicAuthFile(filename string) (BasicAuth, error) {
+	ret := make(BasicAuth)
+	err := readLines(filename, func(line string) error {
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return fmt.Errorf("expected \"<username>:<bcrypt hash>\"")
+		}
+		hash := []byte(line[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return fmt.Errorf("invalid bcrypt hash for %q: %v", line[:i], err)
+		}
+		ret[line[:i]] = hash
+		return nil
+	})
+	return ret, err
+}
+
+func (b BasicAuth) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	hash, ok := b[username]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Name: username, Method: "basic"}, nil
+}
+
+/*//////////////////////////////////////////////////////////////////////*/
+
+// ClientCert authenticates requests made over TLS with a verified
+// client certificate. The identity is the certificate's subject
+// common name. The TLS listener is responsible for verifying the
+// certificate against the client CA.
+type ClientCert struct{}
+
+func (ClientCert) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if cn == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Name: cn, Method: "mtls"}, nil
+}
+
+/*//////////////////////////////////////////////////////////////////////*/
+
+// Policy maps identities to roles and roles to permissions
+type Policy struct {
+	Roles      map[string][]Permission `json:"roles"`
+	Identities map[string][]string     `json:"identities"` // identity name -> roles
+}
+
+// LoadPolicyFile reads a JSON Policy e.g.
+//
+//	{
+//	  "roles": {
+//	    "viewer": ["read_stats", "read_config"],
+//	    "deployer": ["read_stats", "read_config", "write_memory", "load_runtime"],
+//	    "admin": ["*"]
+//	  },
+//	  "identities": {
+//	    "alice": ["admin"],
+//	    "ci-bot": ["deployer"]
+//	  }
+//	}
+func LoadPolicyFile(filename string) (*Policy, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err = json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for id, roles := range p.Identities {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return nil, fmt.Errorf("%s: identity %q has unknown role %q", filename, id, role)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Allowed returns true if the identity has every one of perms
+func (p *Policy) Allowed(id *Identity, perms ...Permission) bool {
+	if id == nil {
+		return false
+	}
+	for _, perm := range perms {
+		if !p.has(id.Name, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Policy) has(name string, perm Permission) bool {
+	for _, role := range p.Identities[name] {
+		for _, granted := range p.Roles[role] {
+			if granted == perm || granted == All {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*//////////////////////////////////////////////////////////////////////*/
+
+type contextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx by WithIdentity or
+// nil
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// readLines calls fn with every non blank, non comment line of
+// filename
+func readLines(filename string, fn func(line string) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, n, err)
+		}
+	}
+	return sc.Err()
+}
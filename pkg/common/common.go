@@ -1,12 +1,48 @@
 package common
 
-import "encoding/json"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// adminTLSConfigName is the name the admin TLS config is registered
+// under with the mysql driver
+const adminTLSConfigName = "proxysqlapi-admin"
 
 type DBConfig struct {
 	DBuser string `envconfig:"ADMIN_USER" default:"root"`
 	DBPswd string `envconfig:"ADMIN_PASS" default:""`
 	DBHost string `envconfig:"ADMIN_HOST" default:"localhost"`
 	DBPort int    `envconfig:"ADMIN_PORT" default:"6032"`
+
+	// DBSocket is the path to the admin unix socket. If set, DBHost and
+	// DBPort are ignored.
+	DBSocket string `envconfig:"ADMIN_SOCKET" default:""`
+
+	// credentials can be read from files e.g. mounted secrets instead
+	// of the environment. They override DBuser and DBPswd.
+	DBUserFile string `envconfig:"ADMIN_USER_FILE" default:""`
+	DBPswdFile string `envconfig:"ADMIN_PASS_FILE" default:""`
+
+	// TLS to the admin port is enabled when DBTLS is set or any of the
+	// CA, cert or key files are configured
+	DBTLS           bool   `envconfig:"ADMIN_TLS" default:"false"`
+	DBTLSCAFile     string `envconfig:"ADMIN_TLS_CA_FILE" default:""`          // defaults to the system roots
+	DBTLSCertFile   string `envconfig:"ADMIN_TLS_CERT_FILE" default:""`        // client cert
+	DBTLSKeyFile    string `envconfig:"ADMIN_TLS_KEY_FILE" default:""`         // client key
+	DBTLSServerName string `envconfig:"ADMIN_TLS_SERVER_NAME" default:""`      // defaults to DBHost
+	DBTLSSkipVerify bool   `envconfig:"ADMIN_TLS_SKIP_VERIFY" default:"false"` // e.g. for ProxySQL's auto generated cert
+
+	DBConnectTimeout time.Duration `envconfig:"ADMIN_CONNECT_TIMEOUT" default:"10s"`
+	DBReadTimeout    time.Duration `envconfig:"ADMIN_READ_TIMEOUT" default:"0s"` // 0 means no timeout
+	DBWriteTimeout   time.Duration `envconfig:"ADMIN_WRITE_TIMEOUT" default:"0s"`
 }
 
 func (c *DBConfig) ToJSON() string {
@@ -15,3 +51,104 @@ func (c *DBConfig) ToJSON() string {
 	b, _ := json.Marshal(copy)
 	return string(b)
 }
+
+// MysqlConfig returns the driver config used to connect to the admin
+// interface. Credential files are read and, if TLS is enabled, the TLS
+// config is registered with the driver.
+func (c *DBConfig) MysqlConfig() (*mysql.Config, error) {
+	// NewConfig sets the driver's defaults, e.g. allowing
+	// mysql_native_password, which a bare Config does not
+	ret := mysql.NewConfig()
+	ret.User = c.DBuser
+	ret.Passwd = c.DBPswd
+	ret.Net = "tcp"
+	ret.Addr = fmt.Sprintf("%s:%d", c.DBHost, c.DBPort)
+	ret.Timeout = c.DBConnectTimeout
+	ret.ReadTimeout = c.DBReadTimeout
+	ret.WriteTimeout = c.DBWriteTimeout
+	ret.InterpolateParams = true
+
+	if c.DBSocket != "" {
+		ret.Net = "unix"
+		ret.Addr = c.DBSocket
+	}
+
+	if c.DBUserFile != "" {
+		user, err := readSecretFile(c.DBUserFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading admin user: %v", err)
+		}
+		ret.User = user
+	}
+	if c.DBPswdFile != "" {
+		pswd, err := readSecretFile(c.DBPswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading admin password: %v", err)
+		}
+		ret.Passwd = pswd
+	}
+
+	if c.tlsEnabled() {
+		if c.DBSocket != "" {
+			return nil, fmt.Errorf("admin TLS is not supported over a unix socket")
+		}
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		if err := mysql.RegisterTLSConfig(adminTLSConfigName, tlsConfig); err != nil {
+			return nil, err
+		}
+		ret.TLSConfig = adminTLSConfigName
+	}
+
+	return ret, nil
+}
+
+func (c *DBConfig) tlsEnabled() bool {
+	return c.DBTLS || c.DBTLSCAFile != "" || c.DBTLSCertFile != "" || c.DBTLSKeyFile != ""
+}
+
+func (c *DBConfig) tlsConfig() (*tls.Config, error) {
+	ret := &tls.Config{
+		ServerName:         c.DBTLSServerName,
+		InsecureSkipVerify: c.DBTLSSkipVerify,
+	}
+	if ret.ServerName == "" {
+		ret.ServerName = c.DBHost
+	}
+
+	if c.DBTLSCAFile != "" {
+		b, err := ioutil.ReadFile(c.DBTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading admin TLS CA: %v", err)
+		}
+		ret.RootCAs = x509.NewCertPool()
+		if !ret.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in admin TLS CA %s", c.DBTLSCAFile)
+		}
+	}
+
+	if c.DBTLSCertFile != "" || c.DBTLSKeyFile != "" {
+		if c.DBTLSCertFile == "" || c.DBTLSKeyFile == "" {
+			return nil, fmt.Errorf("both an admin TLS cert and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(c.DBTLSCertFile, c.DBTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading admin TLS cert: %v", err)
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+
+	return ret, nil
+}
+
+// readSecretFile returns the contents of a credentials file without
+// the trailing newline editors and secret mounts tend to add
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+	"github.com/jimmyjames85/proxysqlapi/pkg/auth"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied" // refused by authorize, nothing was changed
+)
+
+// AuditEntry records a single mutating request. Diff and RuntimeDiff
+// hold the changes to the memory and runtime tables made while the
+// request was handled, with passwords redacted.
+type AuditEntry struct {
+	Time        time.Time        `json:"time"`
+	RequestID   string           `json:"request_id"`
+	User        string           `json:"user,omitempty"` // empty when auth is disabled
+	AuthMethod  string           `json:"auth_method,omitempty"`
+	SourceIP    string           `json:"source_ip"`
+	Method      string           `json:"method"`
+	Endpoint    string           `json:"endpoint"` // the route e.g. /load/mysql_servers
+	Path        string           `json:"path"`
+	Status      int              `json:"status"`
+	Outcome     string           `json:"outcome"`
+	Error       string           `json:"error,omitempty"`
+	DurationMS  int64            `json:"duration_ms"`
+	Tables      []string         `json:"tables,omitempty"` // tables changed in memory or runtime
+	Diff        admin.ConfigDiff `json:"diff,omitempty"`
+	RuntimeDiff admin.ConfigDiff `json:"runtime_diff,omitempty"`
+}
+
+func (e *AuditEntry) ToJSON() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// AuditFilter selects audit entries. Zero values match everything.
+type AuditFilter struct {
+	Since time.Time
+	Until time.Time
+	Table string
+	User  string
+}
+
+func (f AuditFilter) match(e AuditEntry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Table != "" {
+		for _, t := range e.Tables {
+			if t == f.Table {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// auditLog appends entries as JSON lines to a file and/or syslog. The
+// file is only ever opened for appending.
+type auditLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	syslog *syslog.Writer
+}
+
+// openAuditLog returns nil if neither an audit file nor syslog is
+// configured
+func openAuditLog(cfg Config) (*auditLog, error) {
+	if cfg.AuditLogFile == "" && !cfg.AuditSyslog {
+		return nil, nil
+	}
+
+	a := &auditLog{path: cfg.AuditLogFile}
+	if cfg.AuditLogFile != "" {
+		f, err := os.OpenFile(cfg.AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %v", err)
+		}
+		a.file = f
+	}
+	if cfg.AuditSyslog {
+		w, err := syslog.Dial(cfg.AuditSyslogNetwork, cfg.AuditSyslogAddr, syslog.LOG_NOTICE|syslog.LOG_USER, "proxysqlapi")
+		if err != nil {
+			if a.file != nil {
+				a.file.Close()
+			}
+			return nil, fmt.Errorf("connecting to syslog: %v", err)
+		}
+		a.syslog = w
+	}
+	return a, nil
+}
+
+func (a *auditLog) write(e AuditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		if _, err := a.file.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if a.syslog != nil {
+		if err := a.syslog.Notice(string(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query returns the entries in the audit file matching f, oldest first
+func (a *auditLog) query(f AuditFilter) ([]AuditEntry, error) {
+	if a.path == "" {
+		return nil, fmt.Errorf("audit log is only written to syslog, set an audit log file to query it")
+	}
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ret := []AuditEntry{}
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024) // diffs of big tables make for long lines
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// a partially written last line, e.g. after a crash
+			continue
+		}
+		if f.match(e) {
+			ret = append(ret, e)
+		}
+	}
+	return ret, sc.Err()
+}
+
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	if a.syslog != nil {
+		a.syslog.Close()
+	}
+}
+
+// audited wraps a mutating endpoint so that every request to it is
+// written to the audit log along with the changes it made to the
+// memory and runtime tables. It must run inside authorize so the
+// caller's identity is known.
+func (s *Server) audited(ep Endpoint) http.HandlerFunc {
+	if s.audit == nil || !ep.mutates() {
+		return ep.HandlerFunc
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := AuditEntry{
+			Time:      time.Now().UTC(),
+			RequestID: requestID(w, r),
+			Method:    r.Method,
+			Endpoint:  ep.Path,
+			Path:      r.URL.Path,
+		}
+		e.SourceIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+		if id := auth.FromContext(r.Context()); id != nil {
+			e.User = id.Name
+			e.AuthMethod = id.Method
+		}
+
+		// the snapshots before and after the change each get their own
+		// snapshotTimeout, the handler may take longer than that
+		db, cancel := s.snapshotDB(r.Context())
+		var errs []string
+		before, err := admin.SelectProxySQLConfig(db)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("reading memory config: %v", err))
+		}
+		runtimeBefore, err := admin.SelectRuntimeProxySQLConfig(db)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("reading runtime config: %v", err))
+		}
+		cancel()
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		ep.HandlerFunc(rec, r)
+
+		e.Status = rec.status
+		e.DurationMS = int64(time.Since(e.Time) / time.Millisecond)
+		e.Outcome = AuditSuccess
+		if rec.status >= 400 {
+			e.Outcome = AuditFailure
+			var body struct {
+				Error string `json:"error"`
+			}
+			json.Unmarshal(rec.body.Bytes(), &body)
+			e.Error = body.Error
+		}
+
+		db, cancel = s.snapshotDB(r.Context())
+		defer cancel()
+		if before != nil {
+			after, err := admin.SelectProxySQLConfig(db)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("reading memory config: %v", err))
+			} else {
+				e.Diff = admin.DiffProxySQLConfig(before, after).Redacted()
+			}
+		}
+		if runtimeBefore != nil {
+			runtimeAfter, err := admin.SelectRuntimeProxySQLConfig(db)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("reading runtime config: %v", err))
+			} else {
+				e.RuntimeDiff = admin.DiffProxySQLConfig(runtimeBefore, runtimeAfter).Redacted()
+			}
+		}
+		e.Tables = unionStrings(e.Diff.Tables(), e.RuntimeDiff.Tables())
+		if len(errs) > 0 {
+			// the change still happened, record that its diff is incomplete
+			if e.Error != "" {
+				errs = append([]string{e.Error}, errs...)
+			}
+			e.Error = strings.Join(errs, "; ")
+		}
+
+		if err := s.audit.write(e); err != nil {
+			slog.ErrorContext(r.Context(), "AUDIT FAILURE: unable to write audit entry", "entry", json.RawMessage(e.ToJSON()), "error", err)
+		}
+	}
+}
+
+// auditDenied audits a mutating request which authorize refused with
+// status, so it never reached audited. id is nil when the caller could
+// not be authenticated.
+func (s *Server) auditDenied(w http.ResponseWriter, r *http.Request, ep Endpoint, id *auth.Identity, status int, err error) {
+	if s.audit == nil || !ep.mutates() {
+		return
+	}
+	e := AuditEntry{
+		Time:      time.Now().UTC(),
+		RequestID: requestID(w, r),
+		Method:    r.Method,
+		Endpoint:  ep.Path,
+		Path:      r.URL.Path,
+		Status:    status,
+		Outcome:   AuditDenied,
+		Error:     err.Error(),
+	}
+	e.SourceIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if id != nil {
+		e.User = id.Name
+		e.AuthMethod = id.Method
+	}
+	if err := s.audit.write(e); err != nil {
+		slog.ErrorContext(r.Context(), "AUDIT FAILURE: unable to write audit entry", "entry", json.RawMessage(e.ToJSON()), "error", err)
+	}
+}
+
+// responseRecorder records the status code of a response and, for
+// errors, its body so the error message can be audited
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status >= 400 && w.body.Len() < 4096 {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func unionStrings(a, b []string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, s := range append(a, b...) {
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if s.audit == nil {
+		s.handleError(w, r, fmt.Errorf("audit log is not enabled"), http.StatusNotFound)
+		return
+	}
+
+	var f AuditFilter
+	var err error
+	if f.Since, err = parseTimeParam(r.URL.Query().Get("since")); err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if f.Until, err = parseTimeParam(r.URL.Query().Get("until")); err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	f.Table = r.URL.Query().Get("table")
+	f.User = r.URL.Query().Get("user")
+
+	entries, err := s.audit.query(f)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/auth"
+)
+
+// loadAuth builds the authenticators and policy described by cfg. A
+// nil Authenticator is returned when auth is disabled.
+func loadAuth(cfg Config) (auth.Authenticator, *auth.Policy, error) {
+	var authn auth.Authenticators
+
+	if cfg.AuthTokensFile != "" {
+		tokens, err := auth.LoadStaticTokensFile(cfg.AuthTokensFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading tokens: %v", err)
+		}
+		authn = append(authn, tokens)
+	}
+	if cfg.AuthBasicFile != "" {
+		basic, err := auth.LoadBasicAuthFile(cfg.AuthBasicFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading basic auth credentials: %v", err)
+		}
+		authn = append(authn, basic)
+	}
+	if cfg.AuthClientCert {
+		if cfg.TLSClientCAFile == "" {
+			return nil, nil, fmt.Errorf("client cert authentication requires a TLS client CA")
+		}
+		authn = append(authn, auth.ClientCert{})
+	}
+
+	if len(authn) == 0 {
+		slog.Warn("auth is disabled, anyone who can reach the API can read and change the ProxySQL config", "port", cfg.Port)
+		return nil, nil, nil
+	}
+
+	if cfg.AuthPolicyFile == "" {
+		return nil, nil, fmt.Errorf("an auth policy file is required when auth is enabled")
+	}
+	policy, err := auth.LoadPolicyFile(cfg.AuthPolicyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading auth policy: %v", err)
+	}
+	return authn, policy, nil
+}
+
+// authorize wraps the endpoint's handler so that callers must
+// authenticate and hold every permission the endpoint requires. The
+// caller's identity is stored in the request context. Every denial is
+// logged. When auth is disabled the handler is returned as is.
+func (s *Server) authorize(ep Endpoint) http.HandlerFunc {
+	if s.authn == nil {
+		return ep.HandlerFunc
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := s.authn.Authenticate(r)
+		if err != nil || id == nil {
+			if err == nil {
+				err = fmt.Errorf("authentication required")
+			}
+			slog.WarnContext(r.Context(), "auth: denied", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "error", err)
+			s.auditDenied(w, r, ep, nil, http.StatusUnauthorized, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proxysqlapi", Basic realm="proxysqlapi"`)
+			s.handleError(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		if ri := requestInfoFrom(r.Context()); ri != nil {
+			ri.user = id.Name
+		}
+
+		if !s.policy.Allowed(id, ep.Permissions...) {
+			err = fmt.Errorf("%s requires permissions %v", ep.Path, ep.Permissions)
+			slog.WarnContext(r.Context(), "auth: denied", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "user", id.Name, "auth_method", id.Method, "error", err)
+			s.auditDenied(w, r, ep, id, http.StatusForbidden, err)
+			s.handleError(w, r, err, http.StatusForbidden)
+			return
+		}
+
+		ep.HandlerFunc(w, r.WithContext(auth.WithIdentity(r.Context(), id)))
+	}
+}
+
+// allowed returns true if the caller of r holds perm. Always true when
+// auth is disabled.
+func (s *Server) allowed(r *http.Request, perm auth.Permission) bool {
+	if s.authn == nil {
+		return true
+	}
+	return s.policy.Allowed(auth.FromContext(r.Context()), perm)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+)
+
+// db returns the admin db with every statement run under r's context,
+// so a hung admin interface only holds a handler until RequestTimeout
+// or until the client gives up, see withDeadline
+func (s *Server) db(r *http.Request) admin.DB {
+	return admin.WithContext(r.Context(), s.psqlAdminDb)
+}
+
+// snapshotTimeout bounds how long a snapshot taken around a change
+// waits for the admin interface, see snapshotDB
+const snapshotTimeout = 10 * time.Second
+
+// snapshotDB returns the admin db for the snapshots taken around a
+// change for the audit log and the history. They are traced with ctx
+// but never cancelled with it, the change may still have happened, and
+// give up after snapshotTimeout so a hung admin interface cannot hold
+// the write lock forever.
+func (s *Server) snapshotDB(ctx context.Context) (admin.DB, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), snapshotTimeout)
+	return admin.WithContext(ctx, s.psqlAdminDb), cancel
+}
+
+// withDeadline wraps an endpoint so its context expires after
+// RequestTimeout. pprof endpoints are left alone, they are expected to
+// run for as long as the caller asks.
+func (s *Server) withDeadline(ep Endpoint) http.HandlerFunc {
+	if s.cfg.RequestTimeout <= 0 || strings.HasPrefix(ep.Path, "/debug/pprof/") {
+		return ep.HandlerFunc
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RequestTimeout)
+		defer cancel()
+		ep.HandlerFunc(w, r.WithContext(ctx))
+	}
+}
+
+// contextError explains why r's context ended, for errors returned by
+// admin queries which were cancelled with it
+func (s *Server) contextError(r *http.Request, err error) error {
+	switch r.Context().Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("proxysql admin did not respond within %s: %v", s.cfg.RequestTimeout, err)
+	case context.Canceled:
+		return fmt.Errorf("request cancelled by the client: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+)
+
+const drainJobKind = "drain"
+
+// DrainRequest is the optional JSON payload of the drain endpoint
+type DrainRequest struct {
+	Timeout      string `json:"timeout"`       // how long to wait for ConnUsed to reach 0, default 5m
+	PollInterval string `json:"poll_interval"` // how often to poll stats_mysql_connection_pool, default 1s
+	OfflineHard  bool   `json:"offline_hard"`  // set OFFLINE_HARD once drained
+}
+
+// DrainResult is the result reported by a finished drain job
+type DrainResult struct {
+	PreviousStatus string `json:"previous_status"`
+	PreviousWeight int    `json:"previous_weight"`
+	Status         string `json:"status"`
+	ConnUsed       int    `json:"ConnUsed"`
+}
+
+// drainedServer records the state of a server before it was drained
+// so that undrain can restore it
+type drainedServer struct {
+	Status string
+	Weight int
+}
+
+// drainStateEntry is a drainedServer as stored in DrainStateFile
+type drainStateEntry struct {
+	HostgroupID int    `json:"hostgroup_id"`
+	Hostname    string `json:"hostname"`
+	Port        int    `json:"port"`
+	Status      string `json:"status"`
+	Weight      int    `json:"weight"`
+}
+
+// loadDrainState returns the servers which were drained, and not yet
+// undrained, before a restart. A missing file means none were.
+func loadDrainState(path string) (map[serverKey]drainedServer, error) {
+	drained := make(map[serverKey]drainedServer)
+	if path == "" {
+		return drained, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return drained, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading drain state: %v", err)
+	}
+	var entries []drainStateEntry
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("loading drain state: %s: %v", path, err)
+	}
+	for _, e := range entries {
+		drained[serverKey{HostgroupID: e.HostgroupID, Hostname: e.Hostname, Port: e.Port}] = drainedServer{Status: e.Status, Weight: e.Weight}
+	}
+	return drained, nil
+}
+
+// saveDrainStateLocked writes s.drained to DrainStateFile, if set, so
+// undrain can restore servers drained before a restart. s.drainedMu
+// must be held.
+func (s *Server) saveDrainStateLocked() error {
+	if s.cfg.DrainStateFile == "" {
+		return nil
+	}
+	entries := make([]drainStateEntry, 0, len(s.drained))
+	for k, d := range s.drained {
+		entries = append(entries, drainStateEntry{HostgroupID: k.HostgroupID, Hostname: k.Hostname, Port: k.Port, Status: d.Status, Weight: d.Weight})
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a partial file behind
+	tmp := s.cfg.DrainStateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("saving drain state: %v", err)
+	}
+	if err = os.Rename(tmp, s.cfg.DrainStateFile); err != nil {
+		return fmt.Errorf("saving drain state: %v", err)
+	}
+	return nil
+}
+
+// serverKey identifies a mysql_servers row from the URL params
+// hostgroup, host and port
+type serverKey struct {
+	HostgroupID int
+	Hostname    string
+	Port        int
+}
+
+func (k serverKey) String() string {
+	return fmt.Sprintf("%d:%s:%d", k.HostgroupID, k.Hostname, k.Port)
+}
+
+func parseServerKey(r *http.Request) (serverKey, error) {
+	var k serverKey
+	var err error
+	k.HostgroupID, err = strconv.Atoi(chi.URLParam(r, "hostgroup"))
+	if err != nil {
+		return k, fmt.Errorf("invalid hostgroup: %v", err)
+	}
+	k.Hostname = chi.URLParam(r, "host")
+	k.Port, err = strconv.Atoi(chi.URLParam(r, "port"))
+	if err != nil {
+		return k, fmt.Errorf("invalid port: %v", err)
+	}
+	return k, nil
+}
+
+// setServerStatus updates the status (and weight if weight is not
+// nil) of the server in memory and loads mysql_servers to runtime
+func (s *Server) setServerStatus(db admin.DB, k serverKey, status string, weight *int) error {
+	srv, err := admin.SelectMysqlServer(db, k.HostgroupID, k.Hostname, k.Port)
+	if err != nil {
+		return err
+	}
+	if srv == nil {
+		return admin.NotFound("mysql_servers", k.String())
+	}
+	srv.Status = status
+	if weight != nil {
+		srv.Weight = *weight
+	}
+	if err = admin.UpdateMysqlServer(db, *srv); err != nil {
+		return err
+	}
+	return admin.LoadMysqlServersToRuntime(db)
+}
+
+// connUsed returns the sum of ConnUsed for the server in
+// stats_mysql_connection_pool. A server missing from the pool has no
+// connections in use.
+func (s *Server) connUsed(db admin.DB, k serverKey) (int, error) {
+	pool, err := admin.SelectStatsMysqlConnectionPool(db)
+	if err != nil {
+		return 0, err
+	}
+	used := 0
+	for _, p := range pool {
+		if p.Hostgroup == k.HostgroupID && p.SrvHost == k.Hostname && p.SrvPort == k.Port {
+			used += p.ConnUsed
+		}
+	}
+	return used, nil
+}
+
+// drainServerHandler sets the server OFFLINE_SOFT and starts a job
+// which waits for its ConnUsed to reach 0. The response is the job,
+// which can be polled at /jobs/{JobID}.
+func (s *Server) drainServerHandler(w http.ResponseWriter, r *http.Request) {
+	k, err := parseServerKey(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	var req DrainRequest
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &req); err != nil {
+			s.handleError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+	timeout, err := parseDurationDefault(req.Timeout, 5*time.Minute)
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("invalid timeout: %v", err), http.StatusBadRequest)
+		return
+	}
+	pollInterval, err := parseDurationDefault(req.PollInterval, time.Second)
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("invalid poll_interval: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if j := s.jobs.running(drainJobKind, k.String()); j != nil {
+		s.handleError(w, r, fmt.Errorf("server %s is already being drained by job %s", k, j.ID), http.StatusConflict)
+		return
+	}
+
+	srv, err := admin.SelectMysqlServer(s.db(r), k.HostgroupID, k.Hostname, k.Port)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if srv == nil {
+		s.handleError(w, r, admin.NotFound("mysql_servers", k.String()), http.StatusNotFound)
+		return
+	}
+
+	// only remember the original state, draining twice must not
+	// overwrite it with OFFLINE_SOFT
+	s.drainedMu.Lock()
+	prev, ok := s.drained[k]
+	if !ok {
+		prev = drainedServer{Status: srv.Status, Weight: srv.Weight}
+		s.drained[k] = prev
+		if err = s.saveDrainStateLocked(); err != nil {
+			delete(s.drained, k)
+			s.drainedMu.Unlock()
+			s.handleError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	s.drainedMu.Unlock()
+
+	if err = s.setServerStatus(s.db(r), k, admin.MysqlServerStatusOfflineSoft, nil); err != nil {
+		if !ok {
+			s.drainedMu.Lock()
+			delete(s.drained, k)
+			if err := s.saveDrainStateLocked(); err != nil {
+				slog.ErrorContext(r.Context(), "unable to save drain state", "error", err)
+			}
+			s.drainedMu.Unlock()
+		}
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// the job's later writes are made under the caller's lease
+	leaseID := r.Header.Get("X-Lock-Id")
+	j := s.jobs.start(requestContext(s.ctx, r), drainJobKind, k.String(), func(ctx context.Context, j *Job) error {
+		res := DrainResult{PreviousStatus: prev.Status, PreviousWeight: prev.Weight, Status: admin.MysqlServerStatusOfflineSoft}
+		j.Logf("set %s to %s, waiting up to %s for ConnUsed to reach 0", k, admin.MysqlServerStatusOfflineSoft, timeout)
+
+		deadline := time.Now().Add(timeout)
+		for {
+			used, err := s.connUsed(admin.WithContext(ctx, s.psqlAdminDb), k)
+			if err != nil {
+				return err
+			}
+			res.ConnUsed = used
+			j.SetResult(res)
+			j.Logf("ConnUsed=%d", used)
+			if used == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out after %s with ConnUsed=%d", timeout, used)
+			}
+			if err = sleepCtx(ctx, pollInterval); err != nil {
+				return err
+			}
+		}
+
+		if req.OfflineHard {
+			unlock, err := s.lockWrites(ctx, leaseID)
+			if err != nil {
+				return err
+			}
+			err = s.setServerStatus(admin.WithContext(ctx, s.psqlAdminDb), k, admin.MysqlServerStatusOfflineHard, nil)
+			unlock()
+			if err != nil {
+				return err
+			}
+			res.Status = admin.MysqlServerStatusOfflineHard
+			j.SetResult(res)
+			j.Logf("set %s to %s", k, admin.MysqlServerStatusOfflineHard)
+		}
+		return nil
+	})
+
+	s.writeJobAccepted(w, j)
+}
+
+// undrainServerHandler cancels any running drain of the server and
+// restores the status and weight it had before it was drained. If the
+// server was not drained by this process, or before a restart when
+// DrainStateFile is set, it is set ONLINE and its
+// weight is left as is.
+func (s *Server) undrainServerHandler(w http.ResponseWriter, r *http.Request) {
+	k, err := parseServerKey(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	// wait for the drain without holding the write lock, the job may
+	// need it to finish
+	if j := s.jobs.running(drainJobKind, k.String()); j != nil {
+		j.Cancel()
+		select {
+		case <-j.Done():
+		case <-r.Context().Done():
+			s.handleError(w, r, r.Context().Err(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	unlock, err := s.lockWrites(r.Context(), r.Header.Get("X-Lock-Id"))
+	if err != nil {
+		s.handleError(w, r, err, lockStatus(err))
+		return
+	}
+	defer unlock()
+
+	s.drainedMu.Lock()
+	prev, ok := s.drained[k]
+	s.drainedMu.Unlock()
+
+	var weight *int
+	status := admin.MysqlServerStatusOnline
+	if ok {
+		status = prev.Status
+		weight = &prev.Weight
+	}
+
+	if err = s.setServerStatus(s.db(r), k, status, weight); err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	s.drainedMu.Lock()
+	delete(s.drained, k)
+	if err := s.saveDrainStateLocked(); err != nil {
+		slog.ErrorContext(r.Context(), "unable to save drain state", "error", err)
+	}
+	s.drainedMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"success":"true"}`))
+}
+
+// parseDurationDefault parses d, returning def if d is empty
+func parseDurationDefault(d string, def time.Duration) (time.Duration, error) {
+	if d == "" {
+		return def, nil
+	}
+	return time.ParseDuration(d)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+	"github.com/jimmyjames85/proxysqlapi/pkg/auth"
+)
+
+// DriftReport lists, row by row, how the memory, runtime and disk
+// copies of the config tables differ
+type DriftReport struct {
+	InSync bool `json:"in_sync"`
+
+	// Unloaded are the changes made to memory which a LOAD ... TO
+	// RUNTIME would apply, i.e. runtime -> memory
+	Unloaded admin.ConfigDiff `json:"unloaded"`
+
+	// Unpersisted are the runtime changes which would be lost on a
+	// restart, i.e. disk -> runtime
+	Unpersisted admin.ConfigDiff `json:"unpersisted"`
+
+	// Unsaved are the changes made to memory which a SAVE ... TO DISK
+	// would write, i.e. disk -> memory
+	Unsaved admin.ConfigDiff `json:"unsaved"`
+}
+
+// driftHandler compares the memory, runtime and disk tables. Passwords
+// are redacted unless the caller may read secrets.
+func (s *Server) driftHandler(w http.ResponseWriter, r *http.Request) {
+	memory, err := admin.SelectProxySQLConfig(s.db(r))
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("reading memory config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	runtime, err := admin.SelectRuntimeProxySQLConfig(s.db(r))
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("reading runtime config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	disk, err := admin.SelectDiskProxySQLConfig(s.db(r))
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("reading disk config: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	report := DriftReport{
+		Unloaded:    admin.DiffProxySQLConfig(runtime, memory),
+		Unpersisted: admin.DiffProxySQLConfig(disk, runtime),
+		Unsaved:     admin.DiffProxySQLConfig(disk, memory),
+	}
+	report.InSync = report.Unloaded.Empty() && report.Unpersisted.Empty() && report.Unsaved.Empty()
+	if !s.allowed(r, auth.ReadSecrets) {
+		report.Unloaded = report.Unloaded.Redacted()
+		report.Unpersisted = report.Unpersisted.Redacted()
+		report.Unsaved = report.Unsaved.Redacted()
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
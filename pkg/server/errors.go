@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+)
+
+// ErrorResponse is the body of every error returned by the API. Code is
+// stable and meant for automation, Error is meant for humans and may
+// change. StatusCode is a string for compatibility with older clients.
+type ErrorResponse struct {
+	Error      string `json:"error,omitempty"`
+	StatusCode string `json:"status_code"`
+	Code       string `json:"code"`
+	RequestID  string `json:"request_id,omitempty"`
+	Table      string `json:"table,omitempty"`
+	Row        string `json:"row,omitempty"`
+	MysqlErrno uint16 `json:"mysql_errno,omitempty"`
+	Retryable  bool   `json:"retryable"`
+}
+
+// Codes for errors which do not come from pkg/admin, see statusCode
+const (
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codePreconditionFailed = "precondition_failed"
+	codeLocked             = "locked"
+)
+
+// codeStatus maps the admin error codes to HTTP statuses
+var codeStatus = map[string]int{
+	admin.CodeValidation:  http.StatusBadRequest,
+	admin.CodeNotFound:    http.StatusNotFound,
+	admin.CodeConflict:    http.StatusConflict,
+	admin.CodeUnavailable: http.StatusServiceUnavailable,
+	admin.CodeRejected:    http.StatusUnprocessableEntity,
+	admin.CodeTimeout:     http.StatusGatewayTimeout,
+}
+
+// statusCode returns the code for an error reported with status but
+// without a more specific code of its own
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return admin.CodeValidation
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return admin.CodeNotFound
+	case http.StatusConflict:
+		return admin.CodeConflict
+	case http.StatusPreconditionFailed:
+		return codePreconditionFailed
+	case http.StatusUnprocessableEntity:
+		return admin.CodeRejected
+	case http.StatusLocked:
+		return codeLocked
+	case http.StatusServiceUnavailable:
+		return admin.CodeUnavailable
+	case http.StatusGatewayTimeout:
+		return admin.CodeTimeout
+	}
+	if status >= 400 && status < 500 {
+		return admin.CodeValidation
+	}
+	return admin.CodeInternal
+}
+
+// errorResponse classifies err, which a handler reported with status.
+// A typed error from pkg/admin decides the status itself, e.g. a 400
+// caused by the admin interface being down becomes a 503. Other errors
+// reported as 500 are classified by admin.AsError, so e.g. a bare
+// driver error still becomes a 503, and everything else keeps status.
+func (s *Server) errorResponse(r *http.Request, err error, status int) (ErrorResponse, int) {
+	var resp ErrorResponse
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	var e *admin.Error
+	switch {
+	case err == nil:
+	case status == http.StatusInternalServerError && r.Context().Err() != nil:
+		// the admin query was cut short by the request deadline or the
+		// client going away, see withDeadline
+		resp.Error = s.contextError(r, err).Error()
+		te := *admin.AsError(err)
+		te.Code = admin.CodeTimeout
+		e = &te
+	case errors.As(err, &e):
+	case status == http.StatusInternalServerError:
+		e = admin.AsError(err)
+	}
+
+	if e != nil {
+		if st, ok := codeStatus[e.Code]; ok {
+			status = st
+		}
+		resp.Code = e.Code
+		resp.Table = e.Table
+		resp.Row = e.Row
+		resp.MysqlErrno = e.Errno
+		resp.Retryable = e.Retryable()
+	} else {
+		resp.Code = statusCode(status)
+		resp.Retryable = status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout || status == http.StatusLocked
+	}
+	return resp, status
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+)
+
+// Tables whose ETag can be checked with If-Match, see tableETag
+const (
+	etagMysqlServers    = "mysql_servers"
+	etagMysqlUsers      = "mysql_users"
+	etagMysqlQueryRules = "mysql_query_rules"
+	etagGlobalVariables = "global_variables"
+	etagConfig          = "config"
+)
+
+// tableETag returns the ETag of a memory table, the same one served by
+// e.g. GET /mysql_servers, or of the whole config for etagConfig. With
+// runtime it returns the ETag of the runtime table instead, the one
+// served by e.g. GET /runtime/mysql_servers.
+func (s *Server) tableETag(r *http.Request, table string, runtime bool) (string, error) {
+	db := s.db(r)
+	var v interface{}
+	var checksums []string
+	var err error
+	switch {
+	case table == etagMysqlServers && runtime:
+		v, err = admin.SelectRuntimeMysqlServers(db)
+		checksums = []string{"mysql_servers"}
+	case table == etagMysqlServers:
+		v, err = admin.SelectMysqlServers(db)
+	case table == etagMysqlUsers && runtime:
+		v, err = admin.SelectRuntimeMysqlUsers(db)
+		checksums = []string{"mysql_users"}
+	case table == etagMysqlUsers:
+		v, err = admin.SelectMysqlUsers(db)
+	case table == etagMysqlQueryRules && runtime:
+		v, err = admin.SelectRuntimeMysqlQueryRules(db)
+		checksums = []string{"mysql_query_rules"}
+	case table == etagMysqlQueryRules:
+		v, err = admin.SelectMysqlQueryRules(db)
+	case table == etagGlobalVariables && runtime:
+		v, err = admin.SelectRuntimeGlobalVariables(db)
+		checksums = []string{"mysql_variables", "admin_variables"}
+	case table == etagGlobalVariables:
+		v, err = admin.SelectGlobalVariables(db)
+	case table == etagConfig && runtime:
+		v, err = admin.SelectRuntimeProxySQLConfig(db)
+	case table == etagConfig:
+		v, err = admin.SelectProxySQLConfig(db)
+	default:
+		return "", fmt.Errorf("no etag for %q", table)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(checksums) > 0 {
+		return s.runtimeETag(r, v, checksums...), nil
+	}
+	return admin.ETag(v), nil
+}
+
+// runtimeETag returns the ETag of a runtime table, preferring ProxySQL's
+// own checksums from runtime_checksums_values and falling back to a
+// hash of rows when they are unavailable
+func (s *Server) runtimeETag(r *http.Request, rows interface{}, checksums ...string) string {
+	if cs, err := admin.SelectRuntimeChecksums(s.db(r)); err == nil {
+		if etag, ok := admin.RuntimeETag(cs, checksums...); ok {
+			return etag
+		}
+	}
+	return admin.ETag(rows)
+}
+
+// checkIfMatch compares the If-Match header of r with the current ETag
+// of the table, so a client which read the table before a concurrent
+// change does not overwrite it. Writes to runtime, e.g. PUT
+// /load/runtime/mysql_servers, are compared with the runtime table's
+// ETag, other writes with the memory table's. It writes 412
+// Precondition Failed and returns false if the table has changed.
+// Requests without If-Match always pass.
+func (s *Server) checkIfMatch(w http.ResponseWriter, r *http.Request, table string, runtime bool) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	etag, err := s.tableETag(r, table, runtime)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return false
+	}
+	if !etagMatches(header, etag) {
+		w.Header().Set("ETag", etag)
+		s.handleError(w, r, fmt.Errorf("%s has changed: If-Match %s does not match the current etag %s", table, header, etag), http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// setETag sets the ETag header to the table's new ETag after a write,
+// the runtime table's for writes to runtime, so the client can chain
+// its next If-Match without a GET. The write has already succeeded, so
+// failing to read the table back only leaves the header off.
+func (s *Server) setETag(w http.ResponseWriter, r *http.Request, table string, runtime bool) {
+	if etag, err := s.tableETag(r, table, runtime); err == nil {
+		w.Header().Set("ETag", etag)
+	}
+}
+
+// etagMatches reports whether the If-Match header value matches etag
+// using the strong comparison of RFC 7232, i.e. weak tags never match
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
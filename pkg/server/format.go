@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+)
+
+// unmarshalBody decodes a request payload in the format given by its
+// Content-Type. Anything but a YAML, TOML or cnf Content-Type, e.g.
+// the form type curl -d sends, is decoded as JSON.
+func unmarshalBody(r *http.Request, b []byte, v interface{}) error {
+	format := admin.FormatFromMediaType(r.Header.Get("Content-Type"))
+	if format == "" {
+		format = admin.FormatJSON
+	}
+	return decodePayload(r, format, b, v)
+}
+
+// decodePayload rejects unknown fields and mistyped values, which
+// would otherwise silently be replaced by ProxySQL's defaults, unless
+// the request has lenient=true
+func decodePayload(r *http.Request, format string, b []byte, v interface{}) error {
+	if r.URL.Query().Get("lenient") == "true" {
+		return admin.Unmarshal(format, b, v)
+	}
+	return admin.UnmarshalStrict(format, b, v)
+}
+
+// acceptedFormat returns the first format in the Accept header we can
+// produce, defaulting to JSON. cnf can only hold a config and is only
+// produced when asked for by a query parameter.
+func acceptedFormat(r *http.Request) string {
+	for _, mt := range strings.Split(r.Header.Get("Accept"), ",") {
+		if format := admin.FormatFromMediaType(strings.TrimSpace(mt)); format != "" && format != admin.FormatCnf {
+			return format
+		}
+	}
+	return admin.FormatJSON
+}
+
+// negotiateFormat converts JSON responses to YAML or TOML when the
+// Accept header asks for them, so handlers only ever write JSON. TOML
+// documents must be tables, so arrays, e.g. from /mysql_servers, are
+// returned under the last element of the path.
+func negotiateFormat(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := acceptedFormat(r)
+		if format == admin.FormatJSON {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		buf := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		h.ServeHTTP(buf, r)
+
+		body := buf.body.Bytes()
+		if admin.FormatFromMediaType(buf.header.Get("Content-Type")) == admin.FormatJSON {
+			converted, err := admin.MarshalJSONAs(format, body, path.Base(r.URL.Path))
+			if err != nil {
+				slog.ErrorContext(r.Context(), "unable to convert response", "path", r.URL.Path, "format", format, "error", err)
+			} else {
+				body = converted
+				buf.header.Set("Content-Type", admin.MediaType(format))
+				buf.header.Del("Content-Length")
+			}
+		}
+
+		for k, v := range buf.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(buf.status)
+		w.Write(body)
+	})
+}
+
+// convertHandler converts the config in the request body from one
+// format to another without touching ProxySQL, e.g. to produce a
+// proxysql.cnf for starting ProxySQL with --initial. Query parameters:
+//
+//	from=json  json, yaml, toml or cnf, defaults to the Content-Type
+//	to=cnf     json, yaml, toml or cnf, defaults to cnf, or to the Accept
+//	           header when converting from cnf
+//	lenient=true  ignore unknown fields, see decodePayload
+func (s *Server) convertHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = admin.FormatFromMediaType(r.Header.Get("Content-Type"))
+	}
+	if from == "" {
+		from = admin.FormatJSON
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		to = admin.FormatCnf
+		if from == admin.FormatCnf {
+			to = acceptedFormat(r)
+		}
+	}
+	for _, format := range []string{from, to} {
+		switch format {
+		case admin.FormatJSON, admin.FormatYAML, admin.FormatTOML, admin.FormatCnf:
+		default:
+			s.handleError(w, r, fmt.Errorf("unsupported format %q: expected json, yaml, toml or cnf", format), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var pcfg admin.ProxySQLConfig
+	if err := decodePayload(r, from, b, &pcfg); err != nil {
+		s.handleError(w, r, fmt.Errorf("reading %s config: %v", from, err), http.StatusBadRequest)
+		return
+	}
+
+	var out []byte
+	if to == admin.FormatJSON {
+		out, err = json.MarshalIndent(pcfg, "", "  ")
+	} else {
+		out, err = admin.Marshal(to, pcfg, "")
+	}
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("writing %s config: %v", to, err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", admin.MediaType(to))
+	w.Write(out)
+}
+
+// bufferedResponse holds a response until it has been converted
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) { b.status = status }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+	"github.com/jimmyjames85/proxysqlapi/pkg/auth"
 )
 
 // rootHandler will return a list of available endpoints
@@ -47,26 +51,31 @@ func (s *Server) handleLoadGlobalVariables(w http.ResponseWriter, r *http.Reques
 	}
 
 	var globalVariables map[string]string
-	err = json.Unmarshal(b, &globalVariables)
+	err = unmarshalBody(r, b, &globalVariables)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	err = admin.UpdateGlobalVariables(s.psqlAdminDb, globalVariables)
+	if !s.checkIfMatch(w, r, etagGlobalVariables, runtime) {
+		return
+	}
+
+	err = admin.UpdateGlobalVariables(s.db(r), globalVariables)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	if runtime {
-		err = admin.LoadAdminVariablesToRuntime(s.psqlAdminDb)
+		err = admin.LoadGlobalVariablesToRuntime(s.db(r))
 		if err != nil {
 			s.handleError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	}
 
+	s.setETag(w, r, etagGlobalVariables, runtime)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"success":"true"}`))
 
@@ -89,26 +98,31 @@ func (s *Server) handleLoadMysqlQueryRules(w http.ResponseWriter, r *http.Reques
 	}
 
 	var rules []admin.MysqlQueryRule
-	err = json.Unmarshal(b, &rules)
+	err = unmarshalBody(r, b, &rules)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	err = admin.SetMysqlQueryRules(s.psqlAdminDb, rules...)
+	if !s.checkIfMatch(w, r, etagMysqlQueryRules, runtime) {
+		return
+	}
+
+	err = admin.SetMysqlQueryRules(s.db(r), rules...)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	if runtime {
-		err = admin.LoadMysqlQueryRulesToRuntime(s.psqlAdminDb)
+		err = admin.LoadMysqlQueryRulesToRuntime(s.db(r))
 		if err != nil {
 			s.handleError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	}
 
+	s.setETag(w, r, etagMysqlQueryRules, runtime)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"success":"true"}`))
 
@@ -131,26 +145,31 @@ func (s *Server) handleLoadMysqlUsers(w http.ResponseWriter, r *http.Request, ru
 	}
 
 	var users []admin.MysqlUser
-	err = json.Unmarshal(b, &users)
+	err = unmarshalBody(r, b, &users)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	err = admin.SetMysqlUsers(s.psqlAdminDb, users...)
+	if !s.checkIfMatch(w, r, etagMysqlUsers, runtime) {
+		return
+	}
+
+	err = admin.SetMysqlUsers(s.db(r), users...)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	if runtime {
-		err = admin.LoadMysqlUsersToRuntime(s.psqlAdminDb)
+		err = admin.LoadMysqlUsersToRuntime(s.db(r))
 		if err != nil {
 			s.handleError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	}
 
+	s.setETag(w, r, etagMysqlUsers, runtime)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"success":"true"}`))
 
@@ -173,26 +192,31 @@ func (s *Server) handleLoadMysqlServers(w http.ResponseWriter, r *http.Request,
 	}
 
 	var servers []admin.MysqlServer
-	err = json.Unmarshal(b, &servers)
+	err = unmarshalBody(r, b, &servers)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	err = admin.SetMysqlServers(s.psqlAdminDb, servers...)
+	if !s.checkIfMatch(w, r, etagMysqlServers, runtime) {
+		return
+	}
+
+	err = admin.SetMysqlServers(s.db(r), servers...)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	if runtime {
-		err = admin.LoadMysqlServersToRuntime(s.psqlAdminDb)
+		err = admin.LoadMysqlServersToRuntime(s.db(r))
 		if err != nil {
 			s.handleError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	}
 
+	s.setETag(w, r, etagMysqlServers, runtime)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"success":"true"}`))
 
@@ -214,16 +238,20 @@ func (s *Server) handleLoadConfig(w http.ResponseWriter, r *http.Request, runtim
 	}
 
 	var pcfg admin.ProxySQLConfig
-	err = json.Unmarshal(b, &pcfg)
+	err = unmarshalBody(r, b, &pcfg)
 	if err != nil {
-		s.handleError(w, r, err, http.StatusInternalServerError)
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if !s.checkIfMatch(w, r, etagConfig, runtime) {
 		return
 	}
 
 	if runtime {
-		err = pcfg.LoadToRuntime(s.psqlAdminDb)
+		err = pcfg.LoadToRuntime(s.db(r))
 	} else {
-		err = pcfg.LoadToMemory(s.psqlAdminDb)
+		err = pcfg.LoadToMemory(s.db(r))
 	}
 
 	if err != nil {
@@ -231,6 +259,7 @@ func (s *Server) handleLoadConfig(w http.ResponseWriter, r *http.Request, runtim
 		return
 	}
 
+	s.setETag(w, r, etagConfig, runtime)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"success":"true"}`))
 }
@@ -249,24 +278,32 @@ func (s *Server) handleMysqlUsers(w http.ResponseWriter, r *http.Request, runtim
 	var err error
 
 	if runtime {
-		users, err = admin.SelectRuntimeMysqlUsers(s.psqlAdminDb)
+		users, err = admin.SelectRuntimeMysqlUsers(s.db(r))
 	} else {
-		users, err = admin.SelectMysqlUsers(s.psqlAdminDb)
+		users, err = admin.SelectMysqlUsers(s.db(r))
 	}
 
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
+	etag := admin.ETag(users)
+	if runtime {
+		etag = s.runtimeETag(r, users, "mysql_users")
+	}
 	if users == nil {
 		// better to return empty array than null
 		users = make([]admin.MysqlUser, 0)
 	}
+	if !s.allowed(r, auth.ReadSecrets) {
+		users = admin.RedactMysqlUsers(users)
+	}
 	b, err := json.Marshal(users)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", etag)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 }
@@ -285,15 +322,19 @@ func (s *Server) handleMysqlServers(w http.ResponseWriter, r *http.Request, runt
 	var err error
 
 	if runtime {
-		servers, err = admin.SelectRuntimeMysqlServers(s.psqlAdminDb)
+		servers, err = admin.SelectRuntimeMysqlServers(s.db(r))
 	} else {
-		servers, err = admin.SelectMysqlServers(s.psqlAdminDb)
+		servers, err = admin.SelectMysqlServers(s.db(r))
 	}
 
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
+	etag := admin.ETag(servers)
+	if runtime {
+		etag = s.runtimeETag(r, servers, "mysql_servers")
+	}
 	if servers == nil {
 		// better to return empty array than null
 		servers = make([]admin.MysqlServer, 0)
@@ -303,6 +344,7 @@ func (s *Server) handleMysqlServers(w http.ResponseWriter, r *http.Request, runt
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", etag)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 }
@@ -322,15 +364,19 @@ func (s *Server) handleMysqlQueryRules(w http.ResponseWriter, r *http.Request, r
 	var err error
 
 	if runtime {
-		rules, err = admin.SelectRuntimeMysqlQueryRules(s.psqlAdminDb)
+		rules, err = admin.SelectRuntimeMysqlQueryRules(s.db(r))
 	} else {
-		rules, err = admin.SelectMysqlQueryRules(s.psqlAdminDb)
+		rules, err = admin.SelectMysqlQueryRules(s.db(r))
 	}
 
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
+	etag := admin.ETag(rules)
+	if runtime {
+		etag = s.runtimeETag(r, rules, "mysql_query_rules")
+	}
 	if rules == nil {
 		// better to return empty array than null
 		rules = make([]admin.MysqlQueryRule, 0)
@@ -340,6 +386,7 @@ func (s *Server) handleMysqlQueryRules(w http.ResponseWriter, r *http.Request, r
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", etag)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 }
@@ -358,26 +405,98 @@ func (s *Server) handleGlobalVariables(w http.ResponseWriter, r *http.Request, r
 	var err error
 
 	if runtime {
-		globalVariables, err = admin.SelectRuntimeGlobalVariables(s.psqlAdminDb)
+		globalVariables, err = admin.SelectRuntimeGlobalVariables(s.db(r))
 	} else {
-		globalVariables, err = admin.SelectGlobalVariables(s.psqlAdminDb)
+		globalVariables, err = admin.SelectGlobalVariables(s.db(r))
 	}
 
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
+	etag := admin.ETag(globalVariables)
+	if runtime {
+		etag = s.runtimeETag(r, globalVariables, "mysql_variables", "admin_variables")
+	}
+	if !s.allowed(r, auth.ReadSecrets) {
+		globalVariables = admin.RedactGlobalVariables(globalVariables)
+	}
 	b, err := json.Marshal(globalVariables)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", etag)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 }
 
+func (s *Server) adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	s.handleConfig(w, r, false)
+}
+
+func (s *Server) adminRuntimeConfigHandler(w http.ResponseWriter, r *http.Request) {
+	s.handleConfig(w, r, true)
+}
+
+// handleConfig returns every table managed by ProxySQLConfig as a
+// single document which can be fed back into /load/runtime/config.
+// Query parameters:
+//
+//	redact=true   replace passwords, always on without read_secrets
+//	minimal=true  drop columns matching ProxySQL's defaults
+//	format=json   indented JSON (default), json-compact, yaml, toml or
+//	              cnf, defaults to the Accept header
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request, runtime bool) {
+	opts := admin.ExportOptions{
+		Redact:  r.URL.Query().Get("redact") == "true" || !s.allowed(r, auth.ReadSecrets),
+		Minimal: r.URL.Query().Get("minimal") == "true",
+	}
+
+	var pcfg *admin.ProxySQLConfig
+	var err error
+	if runtime {
+		pcfg, err = admin.SelectRuntimeProxySQLConfig(s.db(r))
+	} else {
+		pcfg, err = admin.SelectProxySQLConfig(s.db(r))
+	}
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// the tag is of the config, not of the chosen export
+	etag := admin.ETag(pcfg)
+	doc := admin.ExportProxySQLConfig(pcfg, opts)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = acceptedFormat(r)
+	}
+	var b []byte
+	switch format {
+	case admin.FormatJSON:
+		b, err = json.MarshalIndent(doc, "", "  ")
+	case "json-compact":
+		b, err = json.Marshal(doc)
+		format = admin.FormatJSON
+	case admin.FormatYAML, admin.FormatTOML, admin.FormatCnf:
+		b, err = admin.Marshal(format, doc, "")
+	default:
+		s.handleError(w, r, fmt.Errorf("unsupported format %q: expected json, json-compact, yaml, toml or cnf", format), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", admin.MediaType(format))
+	w.Write(b)
+}
+
 func (s *Server) statsMysqlConnectionPoolHandler(w http.ResponseWriter, r *http.Request) {
-	connPool, err := admin.SelectStatsMysqlConnectionPool(s.psqlAdminDb)
+	connPool, err := admin.SelectStatsMysqlConnectionPool(s.db(r))
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
@@ -392,7 +511,7 @@ func (s *Server) statsMysqlConnectionPoolHandler(w http.ResponseWriter, r *http.
 }
 
 func (s *Server) statsMysqlGlobalHandler(w http.ResponseWriter, r *http.Request) {
-	mysqlGlobal, err := admin.SelectStatsMysqlGlobal(s.psqlAdminDb)
+	mysqlGlobal, err := admin.SelectStatsMysqlGlobal(s.db(r))
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
@@ -407,7 +526,7 @@ func (s *Server) statsMysqlGlobalHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *Server) statsMysqlQueryDigestHandler(w http.ResponseWriter, r *http.Request) {
-	queryDigest, err := admin.SelectStatsMysqlQueryDigest(s.psqlAdminDb)
+	queryDigest, err := admin.SelectStatsMysqlQueryDigest(s.db(r))
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
@@ -422,7 +541,7 @@ func (s *Server) statsMysqlQueryDigestHandler(w http.ResponseWriter, r *http.Req
 }
 
 func (s *Server) statsMysqlQueryRulesHandler(w http.ResponseWriter, r *http.Request) {
-	queryDigest, err := admin.SelectStatsMysqlQueryRules(s.psqlAdminDb)
+	queryDigest, err := admin.SelectStatsMysqlQueryRules(s.db(r))
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
@@ -437,7 +556,7 @@ func (s *Server) statsMysqlQueryRulesHandler(w http.ResponseWriter, r *http.Requ
 }
 
 func (s *Server) statsMysqlUsersHandler(w http.ResponseWriter, r *http.Request) {
-	users, err := admin.SelectStatsMysqlUsers(s.psqlAdminDb)
+	users, err := admin.SelectStatsMysqlUsers(s.db(r))
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
@@ -452,8 +571,215 @@ func (s *Server) statsMysqlUsersHandler(w http.ResponseWriter, r *http.Request)
 
 }
 
+func (s *Server) statsGlobalVariablesHandler(w http.ResponseWriter, r *http.Request) {
+	globalVariables, err := admin.SelectStatsGlobalVariables(s.db(r))
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(globalVariables)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) statsMemoryMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	memoryMetrics, err := admin.SelectStatsMemoryMetrics(s.db(r))
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(memoryMetrics)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) statsMysqlCommandsCountersHandler(w http.ResponseWriter, r *http.Request) {
+	counters, err := admin.SelectStatsMysqlCommandsCounters(s.db(r))
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(counters)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) statsMysqlConnectionPoolResetHandler(w http.ResponseWriter, r *http.Request) {
+	connPool, err := admin.SelectStatsMysqlConnectionPoolReset(s.db(r))
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(connPool)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) statsMysqlErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	mysqlErrors, err := admin.SelectStatsMysqlErrors(s.db(r))
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(mysqlErrors)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) statsMysqlFreeConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	freeConns, err := admin.SelectStatsMysqlFreeConnections(s.db(r))
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(freeConns)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) statsMysqlPreparedStatementsInfoHandler(w http.ResponseWriter, r *http.Request) {
+	stmtInfo, err := admin.SelectStatsMysqlPreparedStatementsInfo(s.db(r))
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(stmtInfo)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) statsMysqlProcesslistHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProcesslistFilter(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	processlist, err := admin.SelectStatsMysqlProcesslist(s.db(r), filter)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if processlist == nil {
+		// better to return empty array than null
+		processlist = make([]admin.StatsMysqlProcesslist, 0)
+	}
+	b, err := json.Marshal(processlist)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// killConnectionHandler kills a single session. If the query
+// parameter query=true is set only the running query is killed.
+func (s *Server) killConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.Atoi(chi.URLParam(r, "SessionID"))
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("invalid SessionID: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("query") == "true" {
+		err = admin.KillQuery(s.db(r), sessionID)
+	} else {
+		err = admin.KillConnection(s.db(r), sessionID)
+	}
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"success":"true"}`))
+}
+
+// killConnectionsHandler kills every session matching the same
+// filters accepted by /stats/mysql_processlist. To avoid killing
+// every session by accident an empty filter is rejected unless
+// all=true is set.
+func (s *Server) killConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProcesslistFilter(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	if filter.IsEmpty() && q.Get("all") != "true" {
+		s.handleError(w, r, fmt.Errorf("refusing to kill every session without all=true"), http.StatusBadRequest)
+		return
+	}
+
+	killed, err := admin.KillSessions(s.db(r), filter, q.Get("query") == "true")
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(killed)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// parseProcesslistFilter reads the user, db, hostgroup, command and
+// min_time_ms query parameters
+func parseProcesslistFilter(r *http.Request) (admin.StatsMysqlProcesslistFilter, error) {
+	var err error
+	q := r.URL.Query()
+	f := admin.StatsMysqlProcesslistFilter{
+		User:      q.Get("user"),
+		DB:        q.Get("db"),
+		Hostgroup: q.Get("hostgroup"),
+		Command:   q.Get("command"),
+	}
+	if minTime := q.Get("min_time_ms"); minTime != "" {
+		f.MinTimeMS, err = strconv.Atoi(minTime)
+		if err != nil {
+			return f, fmt.Errorf("invalid min_time_ms %q: %v", minTime, err)
+		}
+	}
+	return f, nil
+}
+
 func (s *Server) monitorMysqlServerPingLogHandler(w http.ResponseWriter, r *http.Request) {
-	pingLog, err := admin.SelectMonitorMysqlServerPingLogHandler(s.psqlAdminDb)
+	filter, err := parseMonitorLogFilter(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	pingLog, err := admin.SelectMonitorMysqlServerPingLog(s.db(r), filter)
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
@@ -467,8 +793,146 @@ func (s *Server) monitorMysqlServerPingLogHandler(w http.ResponseWriter, r *http
 	w.Write(b)
 }
 
+func (s *Server) monitorMysqlServerConnectLogHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMonitorLogFilter(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	connectLog, err := admin.SelectMonitorMysqlServerConnectLog(s.db(r), filter)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(connectLog)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) monitorMysqlServerReadOnlyLogHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMonitorLogFilter(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	readOnlyLog, err := admin.SelectMonitorMysqlServerReadOnlyLog(s.db(r), filter)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(readOnlyLog)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) monitorMysqlServerReplicationLagLogHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMonitorLogFilter(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	replicationLagLog, err := admin.SelectMonitorMysqlServerReplicationLagLog(s.db(r), filter)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(replicationLagLog)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) monitorMysqlServerGroupReplicationLogHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMonitorLogFilter(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	groupReplicationLog, err := admin.SelectMonitorMysqlServerGroupReplicationLog(s.db(r), filter)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(groupReplicationLog)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) monitorHealthHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMonitorLogFilter(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	health, err := admin.SelectMonitorHealth(s.db(r), filter)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(health)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// parseMonitorLogFilter reads the hostname, port, since and until
+// query parameters. since and until are either RFC3339 timestamps or
+// durations relative to now, e.g. since=15m
+func parseMonitorLogFilter(r *http.Request) (admin.MonitorLogFilter, error) {
+	var f admin.MonitorLogFilter
+	var err error
+	q := r.URL.Query()
+
+	f.Hostname = q.Get("hostname")
+	if port := q.Get("port"); port != "" {
+		f.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return f, fmt.Errorf("invalid port %q: %v", port, err)
+		}
+	}
+	if f.Since, err = parseTimeParam(q.Get("since")); err != nil {
+		return f, err
+	}
+	if f.Until, err = parseTimeParam(q.Get("until")); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q: expected RFC3339 timestamp or duration", v)
+	}
+	return t, nil
+}
+
 func (s *Server) _TEMPLATEstatsMysqlConnectionPoolHandler(w http.ResponseWriter, r *http.Request) {
-	connPool, err := admin.SelectStatsMysqlConnectionPool(s.psqlAdminDb)
+	connPool, err := admin.SelectStatsMysqlConnectionPool(s.db(r))
 	if err != nil {
 		s.handleError(w, r, err, http.StatusInternalServerError)
 		return
@@ -483,20 +947,41 @@ func (s *Server) _TEMPLATEstatsMysqlConnectionPoolHandler(w http.ResponseWriter,
 }
 
 // handleError provides a uniform way to emit errors out of our handlers. You should ALWAYS call
-// return after calling it.
+// return after calling it. The body is an ErrorResponse, and statusCode may be replaced by a
+// more accurate one for typed errors from pkg/admin, see errorResponse.
 func (s *Server) handleError(w http.ResponseWriter, r *http.Request, err error, statusCode int) {
+	resp, statusCode := s.errorResponse(r, err, statusCode)
+	resp.StatusCode = fmt.Sprintf("%d", statusCode)
+	resp.RequestID = requestID(w, r)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
-	enc := json.NewEncoder(w)
-	m := make(map[string]string)
-	if err != nil {
-		m["error"] = err.Error()
+	b, _ := json.Marshal(resp)
+	w.Write(append(b, '\n'))
+
+	level := slog.LevelWarn
+	if statusCode >= 500 {
+		level = slog.LevelError
 	}
-	m["status_code"] = fmt.Sprintf("%d", statusCode)
-	enc.Encode(m)
+	attrs := []slog.Attr{
+		slog.Int("status", statusCode),
+		slog.String("code", resp.Code),
+		slog.String("error", resp.Error),
+	}
+	if resp.Table != "" {
+		attrs = append(attrs, slog.String("table", resp.Table), slog.String("row", resp.Row))
+	}
+	slog.LogAttrs(r.Context(), level, "request failed", attrs...)
+}
 
-	b, _ := json.Marshal(m)
-	log.Printf("%+v", string(b))
+// requestID returns the id logRequests gave r, or assigns one so
+// errors can always be traced to a request
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if ri := requestInfoFrom(r.Context()); ri != nil {
+		return ri.id
+	}
+	id := newJobID()
+	w.Header().Set("X-Request-Id", id)
+	return id
 }
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+)
+
+// ReadyCheck is the outcome of a single readiness check
+type ReadyCheck struct {
+	Name       string         `json:"name"`
+	OK         bool           `json:"ok"`
+	DurationMS int64          `json:"duration_ms"`
+	Error      string         `json:"error,omitempty"`
+	Drift      []DriftedTable `json:"drift,omitempty"`
+}
+
+// DriftedTable is a runtime table which differs from the desired
+// config. Only the number of differing rows is reported, the health
+// port is unauthenticated; GET /drift shows the rows themselves.
+type DriftedTable struct {
+	Table string `json:"table"`
+	Rows  int    `json:"rows"`
+}
+
+func driftedTables(diff admin.ConfigDiff) []DriftedTable {
+	var ret []DriftedTable
+	for _, t := range diff {
+		ret = append(ret, DriftedTable{Table: t.Table, Rows: len(t.Rows)})
+	}
+	return ret
+}
+
+// ReadyStatus is the response body of /readyz
+type ReadyStatus struct {
+	Ready  bool         `json:"ready"`
+	Checks []ReadyCheck `json:"checks"`
+}
+
+// healthzHandler reports that the process is up. It does not touch
+// the admin interface.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"healthy":"true"}`))
+}
+
+// readyzHandler reports whether proxysqlapi can serve requests: the
+// admin interface must answer a ping and a trivial SELECT within
+// ReadyTimeout. If DesiredConfigFile is set, the runtime tables must
+// also match it. Once shutdown has started it is never ready. Responds
+// with 503 Service Unavailable when not ready.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ReadyTimeout)
+	defer cancel()
+
+	status := ReadyStatus{Ready: true}
+	check := func(name string, fn func() ([]DriftedTable, error)) bool {
+		start := time.Now()
+		drift, err := fn()
+		c := ReadyCheck{Name: name, OK: err == nil, DurationMS: int64(time.Since(start) / time.Millisecond), Drift: drift}
+		if err != nil {
+			c.Error = err.Error()
+			status.Ready = false
+		}
+		status.Checks = append(status.Checks, c)
+		return c.OK
+	}
+
+	if s.isShuttingDown() {
+		check("shutdown", func() ([]DriftedTable, error) {
+			return nil, errShuttingDown
+		})
+	}
+
+	ok := check("ping", func() ([]DriftedTable, error) {
+		return nil, s.psqlAdminDb.PingContext(ctx)
+	})
+	if ok {
+		ok = check("select", func() ([]DriftedTable, error) {
+			var one int
+			return nil, s.psqlAdminDb.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+		})
+	}
+	if ok && s.cfg.DesiredConfigFile != "" {
+		check("runtime_config", func() ([]DriftedTable, error) {
+			desired, err := s.desired.load()
+			if err != nil {
+				return nil, err
+			}
+			runtime, err := admin.SelectRuntimeProxySQLConfig(admin.WithContext(ctx, s.psqlAdminDb))
+			if err != nil {
+				return nil, err
+			}
+			diff := admin.DiffProxySQLConfig(runtime, desired)
+			if !diff.Empty() {
+				return driftedTables(diff), errRuntimeDrift
+			}
+			return nil, nil
+		})
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+var (
+	errRuntimeDrift = errors.New("runtime tables do not match the desired config")
+	errShuttingDown = errors.New("shutting down")
+)
+
+// desiredConfig holds DesiredConfigFile as last read, so /readyz and
+// the reconciler only parse it again once it has changed
+type desiredConfig struct {
+	path string
+
+	mu    sync.Mutex
+	stamp string
+	cfg   *admin.ProxySQLConfig
+}
+
+func newDesiredConfig(path string) *desiredConfig {
+	if path == "" {
+		return nil
+	}
+	return &desiredConfig{path: path}
+}
+
+// load returns the desired config, reading it again only if the file,
+// or a file in the directory, changed size or modification time since
+// the last read. The config is shared and must not be modified.
+func (d *desiredConfig) load() (*admin.ProxySQLConfig, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stamp, err := fileStamp(d.path)
+	if err != nil {
+		return nil, err
+	}
+	if d.cfg != nil && stamp == d.stamp {
+		return d.cfg, nil
+	}
+	cfg, err := admin.LoadProxySQLConfigFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	d.stamp = stamp
+	d.cfg = cfg
+	return cfg, nil
+}
+
+// fileStamp returns the size and modification time of path, or of
+// every file in it if it is a directory
+func fileStamp(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return fmt.Sprintf("%d:%d", fi.Size(), fi.ModTime().UnixNano()), nil
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&b, "%s:%d:%d/", f.Name(), f.Size(), f.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+	"github.com/jimmyjames85/proxysqlapi/pkg/auth"
+)
+
+// ConfigVersion is a snapshot of the runtime config taken after a
+// successful change. Config is omitted when listing versions.
+type ConfigVersion struct {
+	Version   int                   `json:"version"`
+	Time      time.Time             `json:"time"`
+	Author    string                `json:"author"`
+	Message   string                `json:"message,omitempty"`
+	RequestID string                `json:"request_id,omitempty"`
+	Config    *admin.ProxySQLConfig `json:"config,omitempty"`
+}
+
+// errVersionNotFound is returned for versions that were never
+// recorded or have been pruned
+var errVersionNotFound = fmt.Errorf("version not found")
+
+// historyStore keeps one JSON file per version in dir. Files hold
+// backend passwords and are only readable by the owner.
+type historyStore struct {
+	mu       sync.Mutex
+	dir      string
+	max      int
+	versions []ConfigVersion // oldest first, without Config
+	latest   *admin.ProxySQLConfig
+}
+
+// openHistoryStore returns nil if dir is empty
+func openHistoryStore(dir string, max int) (*historyStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating history dir: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Glob sorts the zero padded file names, i.e. by version
+	h := &historyStore{dir: dir, max: max}
+	for _, f := range files {
+		v, err := readConfigVersion(f)
+		if err != nil {
+			return nil, fmt.Errorf("loading history: %v", err)
+		}
+		h.latest = v.Config
+		v.Config = nil
+		h.versions = append(h.versions, *v)
+	}
+	return h, nil
+}
+
+func (h *historyStore) path(version int) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%08d.json", version))
+}
+
+func readConfigVersion(path string) (*ConfigVersion, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var v ConfigVersion
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &v, nil
+}
+
+// record stores cfg as a new version unless it does not differ from
+// the latest version, in which case nil is returned
+func (h *historyStore) record(cfg *admin.ProxySQLConfig, author, message, requestID string) (*ConfigVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.latest != nil && admin.DiffProxySQLConfig(h.latest, cfg).Empty() {
+		return nil, nil
+	}
+
+	v := ConfigVersion{
+		Version:   1,
+		Time:      time.Now().UTC(),
+		Author:    author,
+		Message:   message,
+		RequestID: requestID,
+		Config:    cfg,
+	}
+	if n := len(h.versions); n > 0 {
+		v.Version = h.versions[n-1].Version + 1
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// write then rename so a crash never leaves a partial version behind
+	tmp := h.path(v.Version) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, h.path(v.Version)); err != nil {
+		return nil, err
+	}
+
+	h.latest = cfg
+	meta := v
+	meta.Config = nil
+	h.versions = append(h.versions, meta)
+
+	for h.max > 0 && len(h.versions) > h.max {
+		if err := os.Remove(h.path(h.versions[0].Version)); err != nil {
+			slog.Error("unable to prune config version", "version", h.versions[0].Version, "error", err)
+			break
+		}
+		h.versions = h.versions[1:]
+	}
+
+	return &v, nil
+}
+
+// list returns every stored version without its config, oldest first
+func (h *historyStore) list() []ConfigVersion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ret := make([]ConfigVersion, len(h.versions))
+	copy(ret, h.versions)
+	return ret
+}
+
+func (h *historyStore) get(version int) (*ConfigVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, v := range h.versions {
+		if v.Version == version {
+			return readConfigVersion(h.path(version))
+		}
+	}
+	return nil, errVersionNotFound
+}
+
+// recordConfigVersion snapshots the runtime tables into the history
+// store. Failures are logged, the change itself already succeeded. The
+// snapshot is taken even if ctx was cancelled, since the change it
+// records was still made, but gives up after snapshotTimeout.
+func (s *Server) recordConfigVersion(ctx context.Context, author, message, requestID string) {
+	if s.history == nil {
+		return
+	}
+	db, cancel := s.snapshotDB(ctx)
+	defer cancel()
+	cfg, err := admin.SelectRuntimeProxySQLConfig(db)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to snapshot runtime config for history", "request_id", requestID, "error", err)
+		return
+	}
+	v, err := s.history.record(cfg, author, message, requestID)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to record config version", "request_id", requestID, "error", err)
+		return
+	}
+	if v != nil {
+		slog.InfoContext(ctx, "recorded config version", "version", v.Version, "author", author, "request_id", requestID)
+	}
+}
+
+// versioned wraps a mutating endpoint so that the runtime config is
+// recorded as a new version after every successful request that
+// changed it. The author is the caller's identity, or their IP when
+// auth is disabled, and the message is taken from the
+// X-Change-Message header.
+func (s *Server) versioned(ep Endpoint) http.HandlerFunc {
+	if s.history == nil || !ep.mutates() {
+		return ep.HandlerFunc
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		// capture the config as it was before the change, so the first
+		// change and any changes made outside proxysqlapi can be undone
+		before := "runtime config changed outside proxysqlapi"
+		if len(s.history.list()) == 0 {
+			before = "initial runtime config"
+		}
+		s.recordConfigVersion(r.Context(), "unknown", before, "")
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		ep.HandlerFunc(rec, r)
+		if rec.status >= 400 {
+			return
+		}
+		message := r.Header.Get("X-Change-Message")
+		if message == "" {
+			message = fmt.Sprintf("%s %s", r.Method, r.URL.Path)
+		}
+		s.recordConfigVersion(r.Context(), changeAuthor(r), message, requestID(w, r))
+	}
+}
+
+// changeAuthor returns who made the change in r
+func changeAuthor(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil {
+		return id.Name
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return host
+}
+
+func (s *Server) parseVersion(w http.ResponseWriter, r *http.Request, v string) (*ConfigVersion, bool) {
+	if s.history == nil {
+		s.handleError(w, r, fmt.Errorf("config history is not enabled"), http.StatusNotFound)
+		return nil, false
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("invalid version %q", v), http.StatusBadRequest)
+		return nil, false
+	}
+	ret, err := s.history.get(version)
+	if err == errVersionNotFound {
+		s.handleError(w, r, fmt.Errorf("version %d not found", version), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	return ret, true
+}
+
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.history == nil {
+		s.handleError(w, r, fmt.Errorf("config history is not enabled"), http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(s.history.list())
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Server) historyVersionHandler(w http.ResponseWriter, r *http.Request) {
+	v, ok := s.parseVersion(w, r, chi.URLParam(r, "Version"))
+	if !ok {
+		return
+	}
+	if !s.allowed(r, auth.ReadSecrets) {
+		v.Config.MysqlUsers = admin.RedactMysqlUsers(v.Config.MysqlUsers)
+		v.Config.GlobalVariables = admin.RedactGlobalVariables(v.Config.GlobalVariables)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// historyDiffHandler returns the changes between the versions given by
+// the from and to query parameters. to defaults to the latest version.
+func (s *Server) historyDiffHandler(w http.ResponseWriter, r *http.Request) {
+	from, ok := s.parseVersion(w, r, r.URL.Query().Get("from"))
+	if !ok {
+		return
+	}
+	toParam := r.URL.Query().Get("to")
+	if toParam == "" {
+		versions := s.history.list()
+		toParam = strconv.Itoa(versions[len(versions)-1].Version)
+	}
+	to, ok := s.parseVersion(w, r, toParam)
+	if !ok {
+		return
+	}
+
+	diff := admin.DiffProxySQLConfig(from.Config, to.Config)
+	if !s.allowed(r, auth.ReadSecrets) {
+		diff = diff.Redacted()
+	}
+	b, err := json.Marshal(diff)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// historyRestoreHandler loads a previous version to memory and
+// runtime. The restored config is recorded as a new version.
+func (s *Server) historyRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	v, ok := s.parseVersion(w, r, chi.URLParam(r, "Version"))
+	if !ok {
+		return
+	}
+
+	if err := v.Config.LoadToRuntime(s.db(r)); err != nil {
+		s.handleError(w, r, fmt.Errorf("restoring version %d: %v", v.Version, err), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("restore version %d", v.Version)
+	if m := strings.TrimSpace(r.Header.Get("X-Change-Message")); m != "" {
+		message = fmt.Sprintf("%s: %s", message, m)
+	}
+	s.recordConfigVersion(r.Context(), changeAuthor(r), message, w.Header().Get("X-Request-Id"))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"success":"true"}`))
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jimmyjames85/proxysqlapi/pkg/trace"
+)
+
+// Job states
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// JobEvent is a single progress update reported by a running job
+type JobEvent struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Job is a long running operation (e.g. draining a backend) started
+// by an HTTP request which can be polled via the /jobs endpoints.
+type Job struct {
+	mu sync.Mutex
+
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	Target   string      `json:"target"`
+	State    string      `json:"state"`
+	Error    string      `json:"error,omitempty"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished"`
+	Progress []JobEvent  `json:"progress"`
+	Result   interface{} `json:"result,omitempty"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	log    *slog.Logger
+}
+
+// Logf records a progress event on the job
+func (j *Job) Logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	j.log.Info(msg)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Progress = append(j.Progress, JobEvent{Time: time.Now(), Message: msg})
+}
+
+// SetResult sets the result reported alongside the job state
+func (j *Job) SetResult(result interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Result = result
+}
+
+// Cancel asks the job to stop. It does not wait for the job to exit.
+func (j *Job) Cancel() { j.cancel() }
+
+// Done is closed once the job has finished
+func (j *Job) Done() <-chan struct{} { return j.done }
+
+func (j *Job) running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.State == JobRunning
+}
+
+func (j *Job) ToJSON() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	b, _ := json.Marshal(j)
+	return string(b)
+}
+
+// jobManager runs and keeps track of jobs. Finished jobs are kept in
+// memory so their outcome can be queried, but are lost on restart. Only
+// the last maxFinished finished jobs are kept, 0 keeps every job.
+type jobManager struct {
+	mu          sync.Mutex
+	jobs        map[string]*Job
+	maxFinished int
+	wg          sync.WaitGroup
+}
+
+func newJobManager(maxFinished int) *jobManager {
+	return &jobManager{jobs: make(map[string]*Job), maxFinished: maxFinished}
+}
+
+// pruneLocked forgets the oldest finished jobs beyond maxFinished.
+// m.mu must be held.
+func (m *jobManager) pruneLocked() {
+	if m.maxFinished <= 0 {
+		return
+	}
+	var finished []*Job
+	for _, j := range m.jobs {
+		if !j.running() {
+			finished = append(finished, j)
+		}
+	}
+	if len(finished) <= m.maxFinished {
+		return
+	}
+	sort.Slice(finished, func(i, k int) bool { return finished[i].Started.Before(finished[k].Started) })
+	for _, j := range finished[:len(finished)-m.maxFinished] {
+		delete(m.jobs, j.ID)
+	}
+}
+
+// start runs fn in its own goroutine. The context passed to fn is
+// derived from ctx and is cancelled when the job is cancelled. The
+// job's logs carry the request id in ctx, see requestContext.
+func (m *jobManager) start(ctx context.Context, kind, target string, fn func(ctx context.Context, j *Job) error) *Job {
+	ctx, span := trace.Start(ctx, "job "+kind, trace.KindInternal)
+	ctx, cancel := context.WithCancel(ctx)
+	j := &Job{
+		ID:       newJobID(),
+		Kind:     kind,
+		Target:   target,
+		State:    JobRunning,
+		Started:  time.Now(),
+		Progress: []JobEvent{},
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	j.log = slog.With("job_id", j.ID, "job_kind", kind, "job_target", target)
+	span.SetAttr("proxysqlapi.job_id", j.ID)
+	span.SetAttr("proxysqlapi.job_target", target)
+	if ri := requestInfoFrom(ctx); ri != nil {
+		j.log = j.log.With("request_id", ri.id)
+	}
+
+	m.mu.Lock()
+	m.pruneLocked()
+	m.jobs[j.ID] = j
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(j.done)
+		defer cancel()
+
+		err := fn(ctx, j)
+		span.SetError(err)
+		defer span.End()
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		now := time.Now()
+		j.Finished = &now
+		switch {
+		case err == nil:
+			j.State = JobSucceeded
+		case ctx.Err() == context.Canceled:
+			j.State = JobCancelled
+			j.Error = err.Error()
+		default:
+			j.State = JobFailed
+			j.Error = err.Error()
+		}
+		level := slog.LevelInfo
+		if j.State == JobFailed {
+			level = slog.LevelWarn
+		}
+		j.log.Log(context.Background(), level, "job finished", "state", j.State, "error", j.Error)
+	}()
+	return j
+}
+
+func (m *jobManager) get(id string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+// running returns the running job of the given kind and target, if any
+func (m *jobManager) running(kind, target string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.Kind == kind && j.Target == target && j.running() {
+			return j
+		}
+	}
+	return nil
+}
+
+// runningKind returns a running job of the given kind, if any
+func (m *jobManager) runningKind(kind string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.Kind == kind && j.running() {
+			return j
+		}
+	}
+	return nil
+}
+
+func (m *jobManager) list() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]*Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		ret = append(ret, j)
+	}
+	sort.Slice(ret, func(i, k int) bool { return ret[i].Started.Before(ret[k].Started) })
+	return ret
+}
+
+// wait blocks until every job has finished
+func (m *jobManager) wait() { m.wg.Wait() }
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sleepCtx sleeps for d or until ctx is done, in which case ctx.Err()
+// is returned
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (s *Server) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs := s.jobs.list()
+	var buf []byte
+	buf = append(buf, '[')
+	for i, j := range jobs {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, j.ToJSON()...)
+	}
+	buf = append(buf, ']')
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (s *Server) jobHandler(w http.ResponseWriter, r *http.Request) {
+	j := s.jobs.get(chi.URLParam(r, "JobID"))
+	if j == nil {
+		s.handleError(w, r, fmt.Errorf("job not found"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(j.ToJSON()))
+}
+
+func (s *Server) cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	j := s.jobs.get(chi.URLParam(r, "JobID"))
+	if j == nil {
+		s.handleError(w, r, fmt.Errorf("job not found"), http.StatusNotFound)
+		return
+	}
+	j.Cancel()
+	select {
+	case <-j.Done():
+	case <-r.Context().Done():
+		s.handleError(w, r, r.Context().Err(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(j.ToJSON()))
+}
+
+// writeJobAccepted responds with 202 Accepted and the job's current
+// state. The Location header points at the job.
+func (s *Server) writeJobAccepted(w http.ResponseWriter, j *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(j.ToJSON()))
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Lease grants exclusive write access to ProxySQL to the holder of its
+// ID, which is sent with every write as the X-Lock-Id header. Only the
+// response to POST /locks includes the ID.
+type Lease struct {
+	ID       string    `json:"id,omitempty"`
+	Owner    string    `json:"owner"`
+	Acquired time.Time `json:"acquired_at"`
+	Expires  time.Time `json:"expires_at"`
+}
+
+// LeaseRequest is the body of POST /locks and PUT /locks/{LockID}
+type LeaseRequest struct {
+	Owner string `json:"owner"` // defaults to the caller's identity
+	TTL   string `json:"ttl"`   // e.g. 5m, defaults to LockDefaultTTL
+}
+
+// LockedError is returned when a lease held by someone else prevents a
+// write
+type LockedError struct {
+	Lease Lease
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("proxysql is locked by %s until %s, see /locks", e.Lease.Owner, e.Lease.Expires.Format(time.RFC3339))
+}
+
+// writeLock serializes every change made to ProxySQL. The memory
+// tables are shared by every admin connection and e.g. SetMysqlServers
+// deletes then inserts, so two interleaved writes leave a mix of both.
+// On top of that a lease keeps other writers out across several
+// requests.
+type writeLock struct {
+	sem chan struct{} // holds a token for the duration of a single write
+
+	leaseMu sync.Mutex
+	lease   *Lease // nil when no lease is held
+}
+
+func newWriteLock() *writeLock {
+	return &writeLock{sem: make(chan struct{}, 1)}
+}
+
+// current returns the unexpired lease, if any. leaseMu must be held.
+func (l *writeLock) current() *Lease {
+	if l.lease != nil && time.Now().After(l.lease.Expires) {
+		l.lease = nil
+	}
+	return l.lease
+}
+
+// check returns a LockedError if a lease other than leaseID is held
+func (l *writeLock) check(leaseID string) error {
+	l.leaseMu.Lock()
+	defer l.leaseMu.Unlock()
+	if cur := l.current(); cur != nil && cur.ID != leaseID {
+		ret := *cur
+		ret.ID = ""
+		return &LockedError{Lease: ret}
+	}
+	return nil
+}
+
+// lockWrites waits for any other write to finish and returns a func
+// which must be called once the caller's write is done. leaseID is
+// the lease the write is made under, empty for none. A LockedError is
+// returned if someone else holds a lease, or ctx's error if it is done
+// first, e.g. a job cancelled by a request holding the lock.
+func (s *Server) lockWrites(ctx context.Context, leaseID string) (func(), error) {
+	l := s.writeLock
+	if err := l.check(leaseID); err != nil {
+		return nil, err
+	}
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	unlock := func() { <-l.sem }
+	// a lease may have been taken while we waited
+	if err := l.check(leaseID); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// stopWrites waits for the write in flight, if any, to finish and then
+// holds the write lock for good, so no write is ever cut off half way
+// by the admin db being closed, e.g. after SetMysqlServers deleted the
+// rows and before it inserted the new ones. It gives up after timeout,
+// 0 for none.
+func (l *writeLock) stopWrites(timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-expired:
+		return fmt.Errorf("a write is still in flight after %s", timeout)
+	}
+}
+
+// serialized wraps a mutating endpoint so it runs under the write
+// lock, see lockWrites. It runs outside audited and versioned so the
+// before and after snapshots they take belong to this request alone.
+func (s *Server) serialized(ep Endpoint) http.HandlerFunc {
+	if !ep.mutates() || ep.LockExempt {
+		return ep.HandlerFunc
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		unlock, err := s.lockWrites(r.Context(), r.Header.Get("X-Lock-Id"))
+		if err != nil {
+			s.handleError(w, r, err, lockStatus(err))
+			return
+		}
+		defer unlock()
+		ep.HandlerFunc(w, r)
+	}
+}
+
+// lockStatus returns the status code for an error from lockWrites
+func lockStatus(err error) int {
+	if _, ok := err.(*LockedError); ok {
+		return http.StatusLocked
+	}
+	// the deadline passed or the client went away while waiting
+	return http.StatusGatewayTimeout
+}
+
+// leaseTTL parses ttl, applying LockDefaultTTL and LockMaxTTL
+func (s *Server) leaseTTL(ttl string) (time.Duration, error) {
+	d, err := parseDurationDefault(ttl, s.cfg.LockDefaultTTL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl: %v", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid ttl: must be positive")
+	}
+	if s.cfg.LockMaxTTL > 0 && d > s.cfg.LockMaxTTL {
+		return 0, fmt.Errorf("invalid ttl: must be at most %s", s.cfg.LockMaxTTL)
+	}
+	return d, nil
+}
+
+func readLeaseRequest(r *http.Request) (LeaseRequest, error) {
+	var req LeaseRequest
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return req, err
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &req)
+	}
+	return req, err
+}
+
+func writeLease(w http.ResponseWriter, status int, l Lease) {
+	b, _ := json.Marshal(l)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// locksHandler returns the lease currently held, without its ID, or
+// null
+func (s *Server) locksHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLock.leaseMu.Lock()
+	var ret *Lease
+	if cur := s.writeLock.current(); cur != nil {
+		l := *cur
+		l.ID = ""
+		ret = &l
+	}
+	s.writeLock.leaseMu.Unlock()
+
+	b, _ := json.Marshal(ret)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// acquireLockHandler takes out a lease. It waits for in flight writes
+// to finish, so once it returns the caller is the only writer. If a
+// lease is already held it fails with 409 Conflict.
+func (s *Server) acquireLockHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := readLeaseRequest(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	ttl, err := s.leaseTTL(req.TTL)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if req.Owner == "" {
+		req.Owner = changeAuthor(r)
+	}
+
+	unlock, err := s.lockWrites(r.Context(), "")
+	if _, ok := err.(*LockedError); ok {
+		s.handleError(w, r, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		s.handleError(w, r, err, lockStatus(err))
+		return
+	}
+	defer unlock()
+
+	now := time.Now().UTC()
+	l := Lease{ID: newJobID(), Owner: req.Owner, Acquired: now, Expires: now.Add(ttl)}
+	s.writeLock.leaseMu.Lock()
+	s.writeLock.lease = &l
+	s.writeLock.leaseMu.Unlock()
+
+	w.Header().Set("Location", "/locks/"+l.ID)
+	writeLease(w, http.StatusCreated, l)
+}
+
+// renewLockHandler extends the lease to expire ttl from now
+func (s *Server) renewLockHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := readLeaseRequest(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	ttl, err := s.leaseTTL(req.TTL)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	s.writeLock.leaseMu.Lock()
+	cur := s.writeLock.current()
+	if cur == nil || cur.ID != chi.URLParam(r, "LockID") {
+		s.writeLock.leaseMu.Unlock()
+		s.handleError(w, r, fmt.Errorf("lock not found, it may have expired"), http.StatusNotFound)
+		return
+	}
+	cur.Expires = time.Now().UTC().Add(ttl)
+	l := *cur
+	s.writeLock.leaseMu.Unlock()
+
+	writeLease(w, http.StatusOK, l)
+}
+
+// releaseLockHandler ends the lease early
+func (s *Server) releaseLockHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLock.leaseMu.Lock()
+	cur := s.writeLock.current()
+	if cur == nil || cur.ID != chi.URLParam(r, "LockID") {
+		s.writeLock.leaseMu.Unlock()
+		s.handleError(w, r, fmt.Errorf("lock not found, it may have expired"), http.StatusNotFound)
+		return
+	}
+	s.writeLock.lease = nil
+	s.writeLock.leaseMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"success":"true"}`))
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jimmyjames85/proxysqlapi/pkg/trace"
+)
+
+// newLogger returns the JSON logger every log line goes through, see
+// setupLogging, logging at level and above
+func newLogger(level *slog.LevelVar) *slog.Logger {
+	h := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	})
+	return slog.New(requestIDHandler{h})
+}
+
+// setupLogging makes the JSON logger the default for slog, the log
+// package and the mysql driver, and returns its level so it can be
+// changed at runtime with PUT /debug/loglevel
+func setupLogging(cfg Config) (*slog.LevelVar, error) {
+	level := new(slog.LevelVar)
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %v", cfg.LogLevel, err)
+	}
+	logger := newLogger(level)
+	slog.SetDefault(logger)
+	mysql.SetLogger(slog.NewLogLogger(logger.Handler(), slog.LevelError))
+	return level, nil
+}
+
+// redactAttr masks attributes which may hold a secret, so a password
+// can never be logged by passing it as e.g. slog.String("password", pw)
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	k := strings.ToLower(a.Key)
+	for _, secret := range []string{"pass", "pswd", "secret", "token", "authorization"} {
+		if strings.Contains(k, secret) {
+			return slog.String(a.Key, "****")
+		}
+	}
+	return a
+}
+
+// requestIDHandler adds the request_id of the request being served,
+// and its trace_id if it is traced, to every log line written with its
+// context, e.g. slog.InfoContext(r.Context(), ...)
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ri := requestInfoFrom(ctx); ri != nil {
+		r.AddAttrs(slog.String("request_id", ri.id))
+	}
+	if span := trace.SpanFromContext(ctx); span != nil {
+		r.AddAttrs(slog.String("trace_id", span.SpanContext().TraceIDString()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// requestInfo is what the access log needs to know about a request
+// which is only learned deeper in the handler chain, e.g. who made it
+type requestInfo struct {
+	id   string
+	user string
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, ri *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, ri)
+}
+
+// requestInfoFrom returns the requestInfo stored in ctx by logRequests
+// or nil
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	ri, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return ri
+}
+
+// requestContext returns ctx carrying the request id and span of r,
+// so logs and spans from background work r started, e.g. a job, can be
+// traced back to it
+func requestContext(ctx context.Context, r *http.Request) context.Context {
+	if ri := requestInfoFrom(r.Context()); ri != nil {
+		ctx = withRequestInfo(ctx, &requestInfo{id: ri.id, user: ri.user})
+	}
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(r.Context()))
+}
+
+// validRequestID returns true if the caller's X-Request-Id is safe to
+// reuse as ours
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequests gives every request an id, taken from X-Request-Id if
+// the caller set one, which is returned in the X-Request-Id header
+// and added to every log line about the request. Each request is then
+// written to the access log with its status and latency.
+func (s *Server) logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ri := &requestInfo{id: r.Header.Get("X-Request-Id")}
+		if !validRequestID(ri.id) {
+			ri.id = newJobID()
+		}
+		w.Header().Set("X-Request-Id", ri.id)
+		r = r.WithContext(withRequestInfo(r.Context(), ri))
+
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		remote, _, _ := net.SplitHostPort(r.RemoteAddr)
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", remote),
+		}
+		if ri.user != "" {
+			attrs = append(attrs, slog.String("user", ri.user))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// accessRecorder records the status and size of a response for the
+// access log
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessRecorder) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets pprof and other streaming handlers flush through the
+// recorder
+func (w *accessRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// LogLevel is the body of /debug/loglevel
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+func (s *Server) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(LogLevel{Level: strings.ToLower(s.logLevel.Level().String())})
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// setLogLevelHandler changes the log level until the next restart,
+// e.g. to debug while chasing a problem
+func (s *Server) setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	var req LogLevel
+	if err = json.Unmarshal(b, &req); err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	var level slog.Level
+	if err = level.UnmarshalText([]byte(req.Level)); err != nil {
+		s.handleError(w, r, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", req.Level), http.StatusBadRequest)
+		return
+	}
+	prev := s.logLevel.Level()
+	s.logLevel.Set(level)
+	slog.WarnContext(r.Context(), "log level changed", "from", prev.String(), "to", level.String())
+	s.logLevelHandler(w, r)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+	"github.com/jimmyjames85/proxysqlapi/pkg/auth"
+)
+
+// readPatch reads a patch from the request body. The patch type is
+// taken from the Content-Type, application/merge-patch+json or
+// application/json-patch+json. Without either, an array is taken to
+// be a JSON Patch and anything else a merge patch.
+func readPatch(r *http.Request) (admin.Patch, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return admin.Patch{}, err
+	}
+	p := admin.Patch{Type: admin.PatchMerge, Data: b}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mt == "application/json-patch+json":
+		p.Type = admin.PatchJSON
+	case mt == "application/merge-patch+json":
+	case bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")):
+		p.Type = admin.PatchJSON
+	}
+	return p, nil
+}
+
+// handlePatch reads the patch in r and passes it to apply, which
+// patches the memory table, see checkIfMatch. Query parameters:
+//
+//	runtime=true  load the table to runtime afterwards, requires the
+//	              load_runtime permission
+//	lenient=true  ignore unknown fields in the patched rows
+func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, table string, apply func(admin.Patch, admin.PatchOptions) error, loadToRuntime func() error) {
+	runtime := r.URL.Query().Get("runtime") == "true"
+	if runtime && !s.allowed(r, auth.LoadRuntime) {
+		s.handleError(w, r, fmt.Errorf("runtime=true requires the %s permission", auth.LoadRuntime), http.StatusForbidden)
+		return
+	}
+
+	p, err := readPatch(r)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	opts := admin.PatchOptions{
+		Strict: r.URL.Query().Get("lenient") != "true",
+		Redact: !s.allowed(r, auth.ReadSecrets),
+	}
+
+	if !s.checkIfMatch(w, r, table, false) {
+		return
+	}
+
+	if err := apply(p, opts); err != nil {
+		switch t := err.(type) {
+		case *admin.PatchError:
+			if t.TestFailed {
+				s.handleError(w, r, err, http.StatusConflict)
+			} else {
+				s.handleError(w, r, err, http.StatusBadRequest)
+			}
+		case admin.FieldErrors:
+			s.handleError(w, r, err, http.StatusBadRequest)
+		default:
+			s.handleError(w, r, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if runtime {
+		if err := loadToRuntime(); err != nil {
+			s.handleError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s.setETag(w, r, table, false)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"success":"true"}`))
+}
+
+func (s *Server) patchMysqlServersHandler(w http.ResponseWriter, r *http.Request) {
+	s.handlePatch(w, r, etagMysqlServers, func(p admin.Patch, opts admin.PatchOptions) error {
+		servers, err := admin.SelectMysqlServers(s.db(r))
+		if err != nil {
+			return err
+		}
+		patched, err := admin.PatchMysqlServers(servers, p, opts)
+		if err != nil {
+			return err
+		}
+		return admin.SetMysqlServers(s.db(r), patched...)
+	}, func() error {
+		return admin.LoadMysqlServersToRuntime(s.db(r))
+	})
+}
+
+func (s *Server) patchMysqlUsersHandler(w http.ResponseWriter, r *http.Request) {
+	s.handlePatch(w, r, etagMysqlUsers, func(p admin.Patch, opts admin.PatchOptions) error {
+		users, err := admin.SelectMysqlUsers(s.db(r))
+		if err != nil {
+			return err
+		}
+		patched, err := admin.PatchMysqlUsers(users, p, opts)
+		if err != nil {
+			return err
+		}
+		return admin.SetMysqlUsers(s.db(r), patched...)
+	}, func() error {
+		return admin.LoadMysqlUsersToRuntime(s.db(r))
+	})
+}
+
+func (s *Server) patchMysqlQueryRulesHandler(w http.ResponseWriter, r *http.Request) {
+	s.handlePatch(w, r, etagMysqlQueryRules, func(p admin.Patch, opts admin.PatchOptions) error {
+		rules, err := admin.SelectMysqlQueryRules(s.db(r))
+		if err != nil {
+			return err
+		}
+		patched, err := admin.PatchMysqlQueryRules(rules, p, opts)
+		if err != nil {
+			return err
+		}
+		return admin.SetMysqlQueryRules(s.db(r), patched...)
+	}, func() error {
+		return admin.LoadMysqlQueryRulesToRuntime(s.db(r))
+	})
+}
+
+func (s *Server) patchGlobalVariablesHandler(w http.ResponseWriter, r *http.Request) {
+	s.handlePatch(w, r, etagGlobalVariables, func(p admin.Patch, opts admin.PatchOptions) error {
+		vars, err := admin.SelectGlobalVariables(s.db(r))
+		if err != nil {
+			return err
+		}
+		changed, err := admin.PatchGlobalVariables(vars, p, opts)
+		if err != nil {
+			return err
+		}
+		return admin.UpdateGlobalVariables(s.db(r), changed)
+	}, func() error {
+		return admin.LoadGlobalVariablesToRuntime(s.db(r))
+	})
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+)
+
+// Reconciler modes
+const (
+	ReconcileOff     = "off"
+	ReconcileReport  = "report"  // detect drift without correcting it
+	ReconcileEnforce = "enforce" // load the desired config to runtime on drift
+)
+
+// Reconcile results
+const (
+	ReconcileInSync    = "in_sync"
+	ReconcileDrift     = "drift"     // drift detected and left as is (report mode)
+	ReconcileCorrected = "corrected" // drift detected and corrected
+	ReconcileFailed    = "failed"
+)
+
+// maxReconcileEvents is the number of drift events kept for
+// /reconciler/status
+const maxReconcileEvents = 100
+
+// ReconcileEvent records a reconcile run that found drift or failed
+type ReconcileEvent struct {
+	Time   time.Time        `json:"time"`
+	Result string           `json:"result"`
+	Tables []string         `json:"tables,omitempty"`
+	Diff   admin.ConfigDiff `json:"diff,omitempty"` // changes needed to go from runtime to desired, passwords redacted
+	Error  string           `json:"error,omitempty"`
+}
+
+// ReconcilerStatus is the response body of /reconciler/status
+type ReconcilerStatus struct {
+	Mode        string           `json:"mode"`
+	Path        string           `json:"path"`
+	Interval    string           `json:"interval"`
+	InSync      bool             `json:"in_sync"`
+	LastRun     *time.Time       `json:"last_run"`
+	LastResult  string           `json:"last_result,omitempty"`
+	LastError   string           `json:"last_error,omitempty"`
+	Runs        map[string]int   `json:"runs"` // by result
+	DriftedRows map[string]int   `json:"drifted_rows"`
+	Events      []ReconcileEvent `json:"events"` // newest first
+}
+
+// reconciler periodically compares the runtime tables with the
+// desired config at DesiredConfigFile and, in enforce mode, loads the
+// desired config when they differ
+type reconciler struct {
+	mu     sync.Mutex
+	status ReconcilerStatus
+	wg     sync.WaitGroup // running reconcile loop
+}
+
+func newReconciler(cfg Config) (*reconciler, error) {
+	switch cfg.ReconcileMode {
+	case ReconcileOff, "":
+		return nil, nil
+	case ReconcileReport, ReconcileEnforce:
+	default:
+		return nil, fmt.Errorf("unknown reconcile mode %q: expected %s, %s or %s", cfg.ReconcileMode, ReconcileOff, ReconcileReport, ReconcileEnforce)
+	}
+	if cfg.DesiredConfigFile == "" {
+		return nil, fmt.Errorf("reconcile mode %s requires a desired config file", cfg.ReconcileMode)
+	}
+	if cfg.ReconcileInterval <= 0 {
+		return nil, fmt.Errorf("invalid reconcile interval %s", cfg.ReconcileInterval)
+	}
+	return &reconciler{
+		status: ReconcilerStatus{
+			Mode:        cfg.ReconcileMode,
+			Path:        cfg.DesiredConfigFile,
+			Interval:    cfg.ReconcileInterval.String(),
+			Runs:        make(map[string]int),
+			DriftedRows: make(map[string]int),
+			Events:      []ReconcileEvent{},
+		},
+	}, nil
+}
+
+// startReconciler reconciles every ReconcileInterval until ctx is
+// done
+func (s *Server) startReconciler(ctx context.Context) {
+	s.reconciler.wg.Add(1)
+	go func() {
+		defer s.reconciler.wg.Done()
+		s.runReconciler(ctx)
+	}()
+}
+
+func (s *Server) runReconciler(ctx context.Context) {
+	slog.Info("reconciler: started", "mode", s.cfg.ReconcileMode, "desired_config", s.cfg.DesiredConfigFile, "interval", s.cfg.ReconcileInterval.String())
+	for {
+		s.reconcile()
+		if err := sleepCtx(ctx, s.cfg.ReconcileInterval); err != nil {
+			return
+		}
+	}
+}
+
+// reconcile runs a single reconcile pass and records its outcome
+func (s *Server) reconcile() {
+	// a run never outlasts the interval, e.g. when the admin interface
+	// stops answering
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.ReconcileInterval)
+	defer cancel()
+
+	ev := ReconcileEvent{Time: time.Now().UTC()}
+	diff, err := s.reconcileOnce(ctx, &ev)
+	if err != nil {
+		ev.Result = ReconcileFailed
+		ev.Error = err.Error()
+		slog.Error("reconciler: failed", "error", err)
+	}
+	if diff != nil {
+		ev.Diff = diff.Redacted()
+		ev.Tables = diff.Tables()
+	}
+
+	r := s.reconciler
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.LastRun = &ev.Time
+	r.status.LastResult = ev.Result
+	r.status.LastError = ev.Error
+	r.status.InSync = ev.Result == ReconcileInSync || ev.Result == ReconcileCorrected
+	r.status.Runs[ev.Result]++
+	r.status.DriftedRows = make(map[string]int)
+	if ev.Result != ReconcileCorrected {
+		for _, t := range diff {
+			r.status.DriftedRows[t.Table] = len(t.Rows)
+		}
+	}
+	if ev.Result != ReconcileInSync {
+		r.status.Events = append([]ReconcileEvent{ev}, r.status.Events...)
+		if len(r.status.Events) > maxReconcileEvents {
+			r.status.Events = r.status.Events[:maxReconcileEvents]
+		}
+	}
+}
+
+// reconcileOnce sets ev.Result and returns the drift found, if any
+func (s *Server) reconcileOnce(ctx context.Context, ev *ReconcileEvent) (admin.ConfigDiff, error) {
+	desired, err := s.desired.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading desired config: %v", err)
+	}
+	db := admin.WithContext(ctx, s.psqlAdminDb)
+	runtime, err := admin.SelectRuntimeProxySQLConfig(db)
+	if err != nil {
+		return nil, fmt.Errorf("reading runtime config: %v", err)
+	}
+
+	diff := admin.DiffProxySQLConfig(runtime, desired)
+	if diff.Empty() {
+		ev.Result = ReconcileInSync
+		return nil, nil
+	}
+
+	slog.Warn("reconciler: runtime drifted from desired config", "tables", diff.Tables())
+	if s.cfg.ReconcileMode != ReconcileEnforce {
+		ev.Result = ReconcileDrift
+		return diff, nil
+	}
+
+	// never correct under someone else's lease, they may be half way
+	// through a change
+	unlock, err := s.lockWrites(ctx, "")
+	if _, ok := err.(*LockedError); ok {
+		slog.Warn("reconciler: not enforcing", "error", err)
+		ev.Result = ReconcileDrift
+		return diff, nil
+	} else if err != nil {
+		return diff, err
+	}
+	defer unlock()
+
+	// drains and traffic shifts change mysql_servers on purpose, step
+	// by step, so enforcing would undo them half way
+	for _, kind := range []string{drainJobKind, trafficShiftJobKind} {
+		if j := s.jobs.runningKind(kind); j != nil {
+			slog.Warn("reconciler: not enforcing while a job is running", "job_id", j.ID, "job_kind", kind)
+			ev.Result = ReconcileDrift
+			return diff, nil
+		}
+	}
+
+	// the drift may have been a write which was in flight
+	runtime, err = admin.SelectRuntimeProxySQLConfig(db)
+	if err != nil {
+		return nil, fmt.Errorf("reading runtime config: %v", err)
+	}
+	if diff = admin.DiffProxySQLConfig(runtime, desired); diff.Empty() {
+		ev.Result = ReconcileInSync
+		return nil, nil
+	}
+
+	// keep the drifted config in the history, then audit and version
+	// the correction like any other change
+	s.recordConfigVersion(ctx, "unknown", "runtime config changed outside proxysqlapi", "")
+	start := time.Now().UTC()
+	memoryBefore, _ := admin.SelectProxySQLConfig(db)
+	applyErr := desired.LoadToRuntime(db)
+	// the change may have happened even if the run timed out
+	auditDB, cancel := s.snapshotDB(ctx)
+	s.auditReconcile(auditDB, start, memoryBefore, runtime, applyErr)
+	cancel()
+	if applyErr != nil {
+		return diff, fmt.Errorf("loading desired config to runtime: %v", applyErr)
+	}
+	s.recordConfigVersion(ctx, "reconciler", fmt.Sprintf("reconciled drift in %v", diff.Tables()), "")
+
+	// make sure the correction stuck, e.g. ProxySQL silently resets
+	// invalid variable values
+	runtime, err = admin.SelectRuntimeProxySQLConfig(db)
+	if err != nil {
+		return diff, fmt.Errorf("reading runtime config: %v", err)
+	}
+	if remaining := admin.DiffProxySQLConfig(runtime, desired); !remaining.Empty() {
+		return remaining, fmt.Errorf("runtime still differs from desired config in %v after loading it", remaining.Tables())
+	}
+	ev.Result = ReconcileCorrected
+	return diff, nil
+}
+
+// auditReconcile writes an audit entry for a correction made by the
+// reconciler
+func (s *Server) auditReconcile(db admin.DB, start time.Time, memoryBefore, runtimeBefore *admin.ProxySQLConfig, applyErr error) {
+	if s.audit == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:       start,
+		RequestID:  newJobID(),
+		User:       "reconciler",
+		Method:     "RECONCILE",
+		Endpoint:   "reconciler",
+		Path:       s.cfg.DesiredConfigFile,
+		Status:     http.StatusOK,
+		Outcome:    AuditSuccess,
+		DurationMS: int64(time.Since(start) / time.Millisecond),
+	}
+	if applyErr != nil {
+		e.Status = http.StatusInternalServerError
+		e.Outcome = AuditFailure
+		e.Error = applyErr.Error()
+	}
+	if after, err := admin.SelectProxySQLConfig(db); err == nil && memoryBefore != nil {
+		e.Diff = admin.DiffProxySQLConfig(memoryBefore, after).Redacted()
+	}
+	if after, err := admin.SelectRuntimeProxySQLConfig(db); err == nil {
+		e.RuntimeDiff = admin.DiffProxySQLConfig(runtimeBefore, after).Redacted()
+	}
+	e.Tables = unionStrings(e.Diff.Tables(), e.RuntimeDiff.Tables())
+	if err := s.audit.write(e); err != nil {
+		slog.Error("AUDIT FAILURE: unable to write audit entry", "entry", json.RawMessage(e.ToJSON()), "error", err)
+	}
+}
+
+func (r *reconciler) snapshot() ReconcilerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := r.status
+	ret.Runs = make(map[string]int)
+	for k, v := range r.status.Runs {
+		ret.Runs[k] = v
+	}
+	ret.DriftedRows = make(map[string]int)
+	for k, v := range r.status.DriftedRows {
+		ret.DriftedRows[k] = v
+	}
+	ret.Events = append([]ReconcileEvent{}, r.status.Events...)
+	return ret
+}
+
+func (s *Server) reconcilerStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if s.reconciler == nil {
+		s.handleError(w, r, fmt.Errorf("reconciler is not enabled"), http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(s.reconciler.snapshot())
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// metricsHandler serves the reconciler metrics in the Prometheus text
+// format
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if s.reconciler == nil {
+		return
+	}
+	st := s.reconciler.snapshot()
+
+	fmt.Fprintf(w, "# HELP proxysqlapi_reconciler_runs_total Reconcile runs by result.\n")
+	fmt.Fprintf(w, "# TYPE proxysqlapi_reconciler_runs_total counter\n")
+	for _, result := range []string{ReconcileInSync, ReconcileDrift, ReconcileCorrected, ReconcileFailed} {
+		fmt.Fprintf(w, "proxysqlapi_reconciler_runs_total{result=%q} %d\n", result, st.Runs[result])
+	}
+
+	inSync := 0
+	if st.InSync {
+		inSync = 1
+	}
+	fmt.Fprintf(w, "# HELP proxysqlapi_reconciler_in_sync Whether runtime matched the desired config after the last run.\n")
+	fmt.Fprintf(w, "# TYPE proxysqlapi_reconciler_in_sync gauge\n")
+	fmt.Fprintf(w, "proxysqlapi_reconciler_in_sync %d\n", inSync)
+
+	fmt.Fprintf(w, "# HELP proxysqlapi_reconciler_drifted_rows Rows differing from the desired config in the last run.\n")
+	fmt.Fprintf(w, "# TYPE proxysqlapi_reconciler_drifted_rows gauge\n")
+	var tables []string
+	for t := range st.DriftedRows {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	for _, t := range tables {
+		fmt.Fprintf(w, "proxysqlapi_reconciler_drifted_rows{table=%q} %d\n", t, st.DriftedRows[t])
+	}
+
+	if st.LastRun != nil {
+		fmt.Fprintf(w, "# HELP proxysqlapi_reconciler_last_run_timestamp_seconds Time of the last reconcile run.\n")
+		fmt.Fprintf(w, "# TYPE proxysqlapi_reconciler_last_run_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "proxysqlapi_reconciler_last_run_timestamp_seconds %d\n", st.LastRun.Unix())
+	}
+}
@@ -1,31 +1,92 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"runtime/debug"
 	runtimepprof "runtime/pprof"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/go-sql-driver/mysql"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jimmyjames85/proxysqlapi/pkg/auth"
 	"github.com/jimmyjames85/proxysqlapi/pkg/common"
+	"github.com/jimmyjames85/proxysqlapi/pkg/trace"
 )
 
 type Config struct {
 	common.DBConfig
 
 	Port int `envconfig:"PORT" required:"false" default:"16032"` // port to run on
+
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"` // how long Shutdown waits for in-flight requests and jobs
+	RequestTimeout  time.Duration `envconfig:"REQUEST_TIMEOUT" default:"30s"`  // deadline for the admin queries of a request, 0 for none
+
+	HealthPort        int           `envconfig:"HEALTH_PORT" default:"16033"`    // port serving /healthz and /readyz
+	ReadyTimeout      time.Duration `envconfig:"READY_TIMEOUT" default:"2s"`     // how long /readyz waits on the admin interface
+	DesiredConfigFile string        `envconfig:"DESIRED_CONFIG_FILE" default:""` // if set /readyz checks runtime matches this ProxySQLConfig file or directory
+
+	ReconcileMode     string        `envconfig:"RECONCILE_MODE" default:"off"`     // off, report or enforce DesiredConfigFile
+	ReconcileInterval time.Duration `envconfig:"RECONCILE_INTERVAL" default:"30s"` // how often runtime is compared to DesiredConfigFile
+
+	// Auth is enabled when any of the tokens file, basic auth file or
+	// client cert authentication is configured. The policy file is
+	// then required.
+	AuthTokensFile string `envconfig:"AUTH_TOKENS_FILE" default:""`      // "<token> <identity>" lines
+	AuthBasicFile  string `envconfig:"AUTH_BASIC_FILE" default:""`       // "<username>:<bcrypt hash>" lines
+	AuthClientCert bool   `envconfig:"AUTH_CLIENT_CERT" default:"false"` // identify callers by their TLS client cert common name
+	AuthPolicyFile string `envconfig:"AUTH_POLICY_FILE" default:""`      // JSON mapping identities to roles and roles to permissions
+
+	// TLS is enabled on the API port when a certificate and key are
+	// configured. Both files are watched and reloaded on change.
+	TLSCertFile           string `envconfig:"TLS_CERT_FILE" default:""`
+	TLSKeyFile            string `envconfig:"TLS_KEY_FILE" default:""`
+	TLSMinVersion         string `envconfig:"TLS_MIN_VERSION" default:"1.2"`            // 1.0, 1.1, 1.2 or 1.3
+	TLSClientCAFile       string `envconfig:"TLS_CLIENT_CA_FILE" default:""`            // if set clients must present a cert signed by this CA
+	TLSClientCertOptional bool   `envconfig:"TLS_CLIENT_CERT_OPTIONAL" default:"false"` // only verify client certs that are presented
+	HTTP2                 bool   `envconfig:"HTTP2" default:"true"`                     // negotiate HTTP/2 over TLS
+	PlainPort             int    `envconfig:"PLAIN_PORT" default:"0"`                   // if TLS is enabled, also serve plain HTTP on this port
+	HealthTLS             bool   `envconfig:"HEALTH_TLS" default:"false"`               // serve the health port over TLS too
+
+	// every mutating request is audited when an audit file or syslog
+	// is configured. GET /audit requires the file.
+	AuditLogFile       string `envconfig:"AUDIT_LOG_FILE" default:""`
+	AuditSyslog        bool   `envconfig:"AUDIT_SYSLOG" default:"false"`
+	AuditSyslogNetwork string `envconfig:"AUDIT_SYSLOG_NETWORK" default:""` // e.g. udp, empty for the local syslog
+	AuditSyslogAddr    string `envconfig:"AUDIT_SYSLOG_ADDR" default:""`
+
+	HistoryDir         string `envconfig:"HISTORY_DIR" default:""`              // if set every runtime config change is stored as a version here
+	HistoryMaxVersions int    `envconfig:"HISTORY_MAX_VERSIONS" default:"1000"` // older versions are pruned, 0 keeps every version
+
+	DrainStateFile  string `envconfig:"DRAIN_STATE_FILE" default:""`     // if set the status and weight of drained servers is kept here, so undrain works after a restart
+	JobsMaxFinished int    `envconfig:"JOBS_MAX_FINISHED" default:"100"` // older finished jobs are forgotten, 0 keeps every job
+
+	LockDefaultTTL time.Duration `envconfig:"LOCK_DEFAULT_TTL" default:"5m"` // lease length when POST /locks has no ttl
+	LockMaxTTL     time.Duration `envconfig:"LOCK_MAX_TTL" default:"1h"`     // longest lease that can be taken or renewed, 0 for no limit
+
+	LogLevel string `envconfig:"LOG_LEVEL" default:"info"` // debug, info, warn or error, see PUT /debug/loglevel
+
+	TraceEndpoint    string            `envconfig:"TRACE_ENDPOINT" default:""` // OTLP/HTTP traces URL e.g. http://localhost:4318/v1/traces, empty disables tracing
+	TraceHeaders     map[string]string `envconfig:"TRACE_HEADERS" default:""`  // sent to the collector e.g. "Authorization:Bearer abc"
+	TraceServiceName string            `envconfig:"TRACE_SERVICE_NAME" default:"proxysqlapi"`
+	TraceSampleRatio float64           `envconfig:"TRACE_SAMPLE_RATIO" default:"1"` // share of new traces recorded, callers' sampling decisions are kept
 }
 
 func (c *Config) ToJSON() string {
 	copy := *c
 	copy.DBPswd = "****"
+	if len(copy.TraceHeaders) > 0 {
+		copy.TraceHeaders = map[string]string{"****": "****"}
+	}
 	b, _ := json.Marshal(copy)
 	return string(b)
 }
@@ -37,10 +98,58 @@ type Server struct {
 	httpServer    *http.Server
 	httpEndpoints []Endpoint
 
+	// plainServer serves the API over plain HTTP next to the TLS
+	// httpServer, it is nil unless PlainPort is set
+	plainServer *http.Server
+	tlsConfig   *tls.Config // nil when TLS is disabled
+
 	healthcheckRouter    *chi.Mux
+	healthcheckServer    *http.Server
 	healthcheckEndpoints []Endpoint
 
 	psqlAdminDb *sql.DB
+
+	// ctx is cancelled when the server is closed, stopping any
+	// background jobs
+	ctx    context.Context
+	cancel context.CancelFunc
+	jobs   *jobManager
+
+	// authn is nil when auth is disabled
+	authn  auth.Authenticator
+	policy *auth.Policy
+
+	// audit is nil when auditing is disabled
+	audit *auditLog
+
+	// history is nil when the config history is disabled
+	history *historyStore
+
+	// desired is nil when DesiredConfigFile is not set
+	desired *desiredConfig
+
+	// reconciler is nil when ReconcileMode is off
+	reconciler *reconciler
+
+	// writeLock serializes writes to ProxySQL and holds the lease
+	// taken out through /locks
+	writeLock *writeLock
+
+	// logLevel is the level of the default slog logger, see logging.go
+	logLevel *slog.LevelVar
+
+	// tracer is nil when tracing is disabled
+	tracer *trace.Tracer
+
+	drainedMu sync.Mutex
+	drained   map[serverKey]drainedServer
+
+	// mu guards the fields below, which coordinate Serve with
+	// Shutdown and Close
+	mu           sync.Mutex
+	shuttingDown bool
+	closeOnce    sync.Once
+	closed       chan struct{} // closed once Shutdown or Close has released every resource
 }
 
 // Endpoint is leveraged in handler.go in rootHandler, which prints out registered routes.
@@ -48,24 +157,94 @@ type Endpoint struct {
 	Path        string
 	HandlerFunc http.HandlerFunc
 	Method      string
+	Permissions []auth.Permission // required when auth is enabled, see authorize
+
+	// ReadOnly marks a non-GET endpoint which does not change ProxySQL,
+	// e.g. /convert, so it is neither audited nor versioned
+	ReadOnly bool
+
+	// LockExempt marks a mutating endpoint which is not run under the
+	// write lock, see serialized: /locks itself, endpoints which change
+	// no table, e.g. killing connections, and endpoints which wait for
+	// a job and so take the lock themselves once it is done
+	LockExempt bool
+}
+
+// mutates returns true if ep may change ProxySQL
+func (ep Endpoint) mutates() bool {
+	return ep.Method != "GET" && !ep.ReadOnly
 }
 
 // New creates a new server
 func New(cfg Config) (*Server, error) {
-	return &Server{cfg: cfg}, nil
+	logLevel, err := setupLogging(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	authn, policy, err := loadAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := loadServerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := openAuditLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := openHistoryStore(cfg.HistoryDir, cfg.HistoryMaxVersions)
+	if err != nil {
+		return nil, err
+	}
+
+	reconciler, err := newReconciler(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := openTracer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	drained, err := loadDrainState(cfg.DrainStateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		cfg:        cfg,
+		ctx:        ctx,
+		cancel:     cancel,
+		authn:      authn,
+		policy:     policy,
+		tlsConfig:  tlsConfig,
+		audit:      audit,
+		history:    history,
+		desired:    newDesiredConfig(cfg.DesiredConfigFile),
+		reconciler: reconciler,
+		jobs:       newJobManager(cfg.JobsMaxFinished),
+		writeLock:  newWriteLock(),
+		logLevel:   logLevel,
+		tracer:     tracer,
+		drained:    drained,
+		closed:     make(chan struct{}),
+	}, nil
 }
 
 // Serve starts http server running on the port set in srv
 func (s *Server) Serve() error {
-	dbcfg := mysql.Config{
-		Addr:              fmt.Sprintf("%s:%d", s.cfg.DBHost, s.cfg.DBPort),
-		Passwd:            s.cfg.DBPswd,
-		User:              s.cfg.DBuser,
-		Net:               "tcp",
-		InterpolateParams: true,
+	dbcfg, err := s.cfg.MysqlConfig()
+	if err != nil {
+		return err
 	}
 
-	var err error
 	s.psqlAdminDb, err = sql.Open("mysql", dbcfg.FormatDSN())
 	if err != nil {
 		return err
@@ -77,106 +256,263 @@ func (s *Server) Serve() error {
 		return fmt.Errorf("unable to serve http - %v", err)
 	}
 
-	defer s.Close()
-	return s.listen(httpListener)
+	var plainListener net.Listener
+	if s.tlsConfig != nil && s.cfg.PlainPort != 0 {
+		plainListener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.cfg.PlainPort))
+		if err != nil {
+			httpListener.Close()
+			s.psqlAdminDb.Close()
+			return fmt.Errorf("unable to serve plain http - %v", err)
+		}
+	}
+
+	healthcheckListener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.cfg.HealthPort))
+	if err != nil {
+		httpListener.Close()
+		if plainListener != nil {
+			plainListener.Close()
+		}
+		s.psqlAdminDb.Close()
+		return fmt.Errorf("unable to serve healthchecks - %v", err)
+	}
+
+	if s.reconciler != nil {
+		s.startReconciler(s.ctx)
+	}
+
+	err = s.listen(httpListener, plainListener, healthcheckListener)
+	if err != nil {
+		s.Close()
+		return err
+	}
+
+	// the http server only stops without error once Shutdown or Close
+	// is called, wait for them to finish cleaning up
+	<-s.closed
+	return nil
 }
 
 // listen starts a server on the given listeners. It allows for easier testability of the server.
-func (s *Server) listen(httpListener net.Listener) error {
+// plainListener may be nil, it is only used when TLS is enabled.
+func (s *Server) listen(httpListener, plainListener, healthcheckListener net.Listener) error {
+	s.healthcheckRouter = chi.NewRouter()
+	s.healthcheckEndpoints = []Endpoint{
+		{Method: "GET", Path: "/healthz", HandlerFunc: s.healthzHandler},
+		{Method: "GET", Path: "/readyz", HandlerFunc: s.readyzHandler},
+		{Method: "GET", Path: "/metrics", HandlerFunc: s.metricsHandler},
+	}
+	for _, ep := range s.healthcheckEndpoints {
+		s.healthcheckRouter.MethodFunc(ep.Method, ep.Path, ep.HandlerFunc)
+	}
+
+	healthcheckServer := &http.Server{Addr: fmt.Sprintf(":%d", s.cfg.HealthPort), Handler: Panic(s.healthcheckRouter)}
+	healthcheckServer.WriteTimeout = 1 * time.Minute
+	healthcheckServer.ReadTimeout = 1 * time.Minute
+	if s.tlsConfig != nil && s.cfg.HealthTLS {
+		// probes rarely carry client certs, never ask them for one
+		healthcheckServer.TLSConfig = s.tlsConfig.Clone()
+		healthcheckServer.TLSConfig.ClientAuth = tls.NoClientCert
+		healthcheckServer.TLSConfig.ClientCAs = nil
+	}
+
 	s.httpRouter = chi.NewRouter()
 
+	// permissions required by the endpoints when auth is enabled
+	readStats := []auth.Permission{auth.ReadStats}
+	readConfig := []auth.Permission{auth.ReadConfig}
+	loadRuntime := []auth.Permission{auth.LoadRuntime}
+	writeMemory := []auth.Permission{auth.WriteMemory}
+	writeRuntime := []auth.Permission{auth.WriteMemory, auth.LoadRuntime}
+	readAudit := []auth.Permission{auth.ReadAudit}
+
 	s.httpEndpoints = []Endpoint{
-		// root and healthchecks
+		// root
 		{Method: "GET", Path: "/", HandlerFunc: s.rootHandler},
-		// TODO where did my healthcheck go?!?!?
 
 		// load to memory
-		{Method: "PUT", Path: "/load/config", HandlerFunc: s.loadConfigHandler},
-		{Method: "PUT", Path: "/load/global_variables", HandlerFunc: s.loadGlobalVariablesHandler},
-		{Method: "PUT", Path: "/load/mysql_query_rules", HandlerFunc: s.loadMysqlQueryRulesHanlder},
-		{Method: "PUT", Path: "/load/mysql_servers", HandlerFunc: s.loadMysqlServersHandler},
-		{Method: "PUT", Path: "/load/mysql_users", HandlerFunc: s.loadMysqlUsersHandler},
+		{Method: "PUT", Path: "/load/config", HandlerFunc: s.loadConfigHandler, Permissions: writeMemory},
+		{Method: "PUT", Path: "/load/global_variables", HandlerFunc: s.loadGlobalVariablesHandler, Permissions: writeMemory},
+		{Method: "PUT", Path: "/load/mysql_query_rules", HandlerFunc: s.loadMysqlQueryRulesHanlder, Permissions: writeMemory},
+		{Method: "PUT", Path: "/load/mysql_servers", HandlerFunc: s.loadMysqlServersHandler, Permissions: writeMemory},
+		{Method: "PUT", Path: "/load/mysql_users", HandlerFunc: s.loadMysqlUsersHandler, Permissions: writeMemory},
 
 		// load to runtime
-		{Method: "PUT", Path: "/load/runtime/config", HandlerFunc: s.loadConfigToRuntimeHandler},
-		{Method: "PUT", Path: "/load/runtime/global_variables", HandlerFunc: s.loadGlobalVariablesToRuntimeHandler},
-		{Method: "PUT", Path: "/load/runtime/mysql_query_rules", HandlerFunc: s.loadMysqlQueryRulesToRuntimeHanlder},
-		{Method: "PUT", Path: "/load/runtime/mysql_servers", HandlerFunc: s.loadMysqlServersToRuntimeHandler},
-		{Method: "PUT", Path: "/load/runtime/mysql_users", HandlerFunc: s.loadMysqlUsersToRuntimeHandler},
+		{Method: "PUT", Path: "/load/runtime/config", HandlerFunc: s.loadConfigToRuntimeHandler, Permissions: writeRuntime},
+		{Method: "PUT", Path: "/load/runtime/global_variables", HandlerFunc: s.loadGlobalVariablesToRuntimeHandler, Permissions: writeRuntime},
+		{Method: "PUT", Path: "/load/runtime/mysql_query_rules", HandlerFunc: s.loadMysqlQueryRulesToRuntimeHanlder, Permissions: writeRuntime},
+		{Method: "PUT", Path: "/load/runtime/mysql_servers", HandlerFunc: s.loadMysqlServersToRuntimeHandler, Permissions: writeRuntime},
+		{Method: "PUT", Path: "/load/runtime/mysql_users", HandlerFunc: s.loadMysqlUsersToRuntimeHandler, Permissions: writeRuntime},
 
 		// memory tables
-		// {Method: "GET", Path: "/config", HandlerFunc: s.adminConfig},
-		{Method: "GET", Path: "/global_variables", HandlerFunc: s.adminGlobalVariablesHandler},
+		{Method: "GET", Path: "/config", HandlerFunc: s.adminConfigHandler, Permissions: readConfig},
+		{Method: "GET", Path: "/global_variables", HandlerFunc: s.adminGlobalVariablesHandler, Permissions: readConfig},
 		//{Method: "GET", Path: "/mysql_collations", HandlerFunc: s.adminMysqlCollationsHandler},
 		//{Method: "GET", Path: "/mysql_group_replication_hostgroups", HandlerFunc: s.adminMysqlGroupReplicationHostgroupsHandler},
-		{Method: "GET", Path: "/mysql_query_rules", HandlerFunc: s.adminMysqlQueryRulesHandler},
+		{Method: "GET", Path: "/mysql_query_rules", HandlerFunc: s.adminMysqlQueryRulesHandler, Permissions: readConfig},
 		//{Method: "GET", Path: "/mysql_query_rules_fast_routing", HandlerFunc: s.adminMysqlQueryRulesFastRoutingHandler},
 		//{Method: "GET", Path: "/mysql_replication_hostgroups", HandlerFunc: s.adminMysqlReplicationHostgroupsHandler},
-		{Method: "GET", Path: "/mysql_servers", HandlerFunc: s.adminMysqlServersHandler},
-		{Method: "GET", Path: "/mysql_users", HandlerFunc: s.adminMysqlUsersHandler},
+		{Method: "GET", Path: "/mysql_servers", HandlerFunc: s.adminMysqlServersHandler, Permissions: readConfig},
+		{Method: "GET", Path: "/mysql_users", HandlerFunc: s.adminMysqlUsersHandler, Permissions: readConfig},
 		//{Method: "GET", Path:"/proxysql_servers", HandlerFunc: s.adminProxysqlServersHandler},
 		//{Method: "GET", Path:"/scheduler", HandlerFunc: s.adminSchedulerHandler},
 
+		// patch memory tables, see handlePatch
+		{Method: "PATCH", Path: "/global_variables", HandlerFunc: s.patchGlobalVariablesHandler, Permissions: writeMemory},
+		{Method: "PATCH", Path: "/mysql_query_rules", HandlerFunc: s.patchMysqlQueryRulesHandler, Permissions: writeMemory},
+		{Method: "PATCH", Path: "/mysql_servers", HandlerFunc: s.patchMysqlServersHandler, Permissions: writeMemory},
+		{Method: "PATCH", Path: "/mysql_users", HandlerFunc: s.patchMysqlUsersHandler, Permissions: writeMemory},
+
 		// runtime tables
-		// {Method: "GET", Path: "/runtime/config", HandlerFunc: s.adminRuntimeConfigHandler},
+		{Method: "GET", Path: "/runtime/config", HandlerFunc: s.adminRuntimeConfigHandler, Permissions: readConfig},
 		//{Method: "GET", Path: "/runtime/checksums_values", HandlerFunc: s.adminRuntimeChecksumsValuesHandler},
-		{Method: "GET", Path: "/runtime/global_variables", HandlerFunc: s.adminRuntimeGlobalVariablesHandler},
+		{Method: "GET", Path: "/runtime/global_variables", HandlerFunc: s.adminRuntimeGlobalVariablesHandler, Permissions: readConfig},
 		//{Method: "GET", Path: "/runtime/mysql_group_replication_hostgroups", HandlerFunc: s.adminRuntimeMysqlGroupReplicationHostgroupsHandler},
-		{Method: "GET", Path: "/runtime/mysql_query_rules", HandlerFunc: s.adminRuntimeMysqlQueryRulesHandler},
+		{Method: "GET", Path: "/runtime/mysql_query_rules", HandlerFunc: s.adminRuntimeMysqlQueryRulesHandler, Permissions: readConfig},
 		//{Method: "GET", Path: "/runtime/mysql_query_rules_fast_routing", HandlerFunc: s.adminRuntimeMysqlQueryRulesFastRoutingHandler},
 		//{Method: "GET", Path: "/runtime/mysql_replication_hostgroups", HandlerFunc: s.adminRuntimeMysqlReplicationHostgroupsHandler},
-		{Method: "GET", Path: "/runtime/mysql_servers", HandlerFunc: s.adminRuntimeMysqlServersHandler},
-		{Method: "GET", Path: "/runtime/mysql_users", HandlerFunc: s.adminRuntimeMysqlUsersHandler},
+		{Method: "GET", Path: "/runtime/mysql_servers", HandlerFunc: s.adminRuntimeMysqlServersHandler, Permissions: readConfig},
+		{Method: "GET", Path: "/runtime/mysql_users", HandlerFunc: s.adminRuntimeMysqlUsersHandler, Permissions: readConfig},
 		//{Method: "GET", Path: "/runtime/proxysql_servers", HandlerFunc: s.adminRuntimeProxysqlServersHandler},
 		//{Method: "GET", Path: "/runtime/scheduler", HandlerFunc: s.adminRuntimeSchedulerHandler},
 
 		// stats tables
-		//{Method: "GET", Path: "/stats/global_variables", HandlerFunc: s.statsGlobalVariablesHandler},
-		//{Method: "GET", Path: "/stats/memory_metrics", HandlerFunc: s.statsMemoryMetricsHandler},
-		//{Method: "GET", Path: "/stats/mysql_commands_counters", HandlerFunc: s.statsMysqlCommandsCountersHandler},
-		{Method: "GET", Path: "/stats/mysql_connection_pool", HandlerFunc: s.statsMysqlConnectionPoolHandler},
-		//{Method: "GET", Path: "/stats/mysql_connection_pool_reset", HandlerFunc: s.statsMysqlConnectionPoolResetHandler},
-		{Method: "GET", Path: "/stats/mysql_global", HandlerFunc: s.statsMysqlGlobalHandler},
-		//{Method: "GET", Path: "/stats/mysql_prepared_statements_info", HandlerFunc: s.statsMysqlPreparedStatementsInfoHandler},
-		//{Method: "GET", Path: "/stats/mysql_processlist", HandlerFunc: s.statsMysqlProcesslistHandler},
-		{Method: "GET", Path: "/stats/mysql_query_digest", HandlerFunc: s.statsMysqlQueryDigestHandler},
+		{Method: "GET", Path: "/stats/global_variables", HandlerFunc: s.statsGlobalVariablesHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/memory_metrics", HandlerFunc: s.statsMemoryMetricsHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/mysql_commands_counters", HandlerFunc: s.statsMysqlCommandsCountersHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/mysql_connection_pool", HandlerFunc: s.statsMysqlConnectionPoolHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/mysql_connection_pool_reset", HandlerFunc: s.statsMysqlConnectionPoolResetHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/mysql_errors", HandlerFunc: s.statsMysqlErrorsHandler, Permissions: readStats},                    // ProxySQL 2.x only
+		{Method: "GET", Path: "/stats/mysql_free_connections", HandlerFunc: s.statsMysqlFreeConnectionsHandler, Permissions: readStats}, // ProxySQL 2.x only
+		{Method: "GET", Path: "/stats/mysql_global", HandlerFunc: s.statsMysqlGlobalHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/mysql_prepared_statements_info", HandlerFunc: s.statsMysqlPreparedStatementsInfoHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/mysql_processlist", HandlerFunc: s.statsMysqlProcesslistHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/mysql_query_digest", HandlerFunc: s.statsMysqlQueryDigestHandler, Permissions: readStats},
 		//{Method: "GET", Path: "/stats/mysql_query_digest_reset", HandlerFunc: s.statsMysqlQueryDigestResetHandler},
-		{Method: "GET", Path: "/stats/mysql_query_rules", HandlerFunc: s.statsMysqlQueryRulesHandler},
-		{Method: "GET", Path: "/stats/mysql_users", HandlerFunc: s.statsMysqlUsersHandler},
+		{Method: "GET", Path: "/stats/mysql_query_rules", HandlerFunc: s.statsMysqlQueryRulesHandler, Permissions: readStats},
+		{Method: "GET", Path: "/stats/mysql_users", HandlerFunc: s.statsMysqlUsersHandler, Permissions: readStats},
 		//{Method: "GET", Path: "/stats/proxysql_servers_checksums", HandlerFunc: s.statsProxysqlServersChecksumsHandler},
 		//{Method: "GET", Path: "/stats/proxysql_servers_metrics", HandlerFunc: s.statsProxysqlServersMetricsHandler},
 		//{Method: "GET", Path: "/stats/proxysql_servers_status", HandlerFunc: s.statsProxysqlServersStatusHandler},
 
+		// connections
+		{Method: "DELETE", Path: "/connections", HandlerFunc: s.killConnectionsHandler, Permissions: loadRuntime, LockExempt: true},
+		{Method: "DELETE", Path: "/connections/{SessionID}", HandlerFunc: s.killConnectionHandler, Permissions: loadRuntime, LockExempt: true},
+
+		// backend maintenance
+		{Method: "POST", Path: "/servers/{hostgroup}/{host}/{port}/drain", HandlerFunc: s.drainServerHandler, Permissions: writeRuntime},
+		{Method: "POST", Path: "/servers/{hostgroup}/{host}/{port}/undrain", HandlerFunc: s.undrainServerHandler, Permissions: writeRuntime, LockExempt: true},
+
+		{Method: "POST", Path: "/traffic-shift", HandlerFunc: s.trafficShiftHandler, Permissions: writeRuntime},
+
+		// jobs
+		{Method: "GET", Path: "/jobs", HandlerFunc: s.jobsHandler, Permissions: readConfig},
+		{Method: "GET", Path: "/jobs/{JobID}", HandlerFunc: s.jobHandler, Permissions: readConfig},
+		{Method: "DELETE", Path: "/jobs/{JobID}", HandlerFunc: s.cancelJobHandler, Permissions: loadRuntime, LockExempt: true},
+
 		// monitor tables
-		//{Method: "GET", Path: "/monitor/mysql_server_connect_log", HandlerFunc: s.monitorMysqlServerConnectLogHandler},
-		//{Method: "GET", Path: "/monitor/mysql_server_group_replication_log", HandlerFunc: s.monitorMysqlServerGroupReplicationLogHandler},
-		{Method: "GET", Path: "/monitor/mysql_server_ping_log", HandlerFunc: s.monitorMysqlServerPingLogHandler},
-		//{Method: "GET", Path: "/monitor/mysql_server_read_only_log", HandlerFunc: s.monitorMysqlServerReadOnlyLogHandler},
-		//{Method: "GET", Path: "/monitor/mysql_server_replication_lag_log", HandlerFunc: s.monitorMysqlServerReplicationLagLogHandler},
+		{Method: "GET", Path: "/monitor/health", HandlerFunc: s.monitorHealthHandler, Permissions: readStats},
+		{Method: "GET", Path: "/monitor/mysql_server_connect_log", HandlerFunc: s.monitorMysqlServerConnectLogHandler, Permissions: readStats},
+		{Method: "GET", Path: "/monitor/mysql_server_group_replication_log", HandlerFunc: s.monitorMysqlServerGroupReplicationLogHandler, Permissions: readStats},
+		{Method: "GET", Path: "/monitor/mysql_server_ping_log", HandlerFunc: s.monitorMysqlServerPingLogHandler, Permissions: readStats},
+		{Method: "GET", Path: "/monitor/mysql_server_read_only_log", HandlerFunc: s.monitorMysqlServerReadOnlyLogHandler, Permissions: readStats},
+		{Method: "GET", Path: "/monitor/mysql_server_replication_lag_log", HandlerFunc: s.monitorMysqlServerReplicationLagLogHandler, Permissions: readStats},
+
+		// audit
+		{Method: "GET", Path: "/audit", HandlerFunc: s.auditHandler, Permissions: readAudit},
+
+		{Method: "GET", Path: "/drift", HandlerFunc: s.driftHandler, Permissions: readConfig},
+
+		// format conversion, e.g. to proxysql.cnf
+		{Method: "POST", Path: "/convert", HandlerFunc: s.convertHandler, ReadOnly: true},
+
+		// reconciler
+		{Method: "GET", Path: "/reconciler/status", HandlerFunc: s.reconcilerStatusHandler, Permissions: readConfig},
+
+		// write leases, see locks.go
+		{Method: "GET", Path: "/locks", HandlerFunc: s.locksHandler, Permissions: readConfig},
+		{Method: "POST", Path: "/locks", HandlerFunc: s.acquireLockHandler, Permissions: writeMemory, LockExempt: true},
+		{Method: "PUT", Path: "/locks/{LockID}", HandlerFunc: s.renewLockHandler, Permissions: writeMemory, LockExempt: true},
+		{Method: "DELETE", Path: "/locks/{LockID}", HandlerFunc: s.releaseLockHandler, Permissions: writeMemory, LockExempt: true},
+
+		// config history
+		{Method: "GET", Path: "/history", HandlerFunc: s.historyHandler, Permissions: readConfig},
+		{Method: "GET", Path: "/history/diff", HandlerFunc: s.historyDiffHandler, Permissions: readConfig},
+		{Method: "GET", Path: "/history/{Version}", HandlerFunc: s.historyVersionHandler, Permissions: readConfig},
+		{Method: "POST", Path: "/history/{Version}/restore", HandlerFunc: s.historyRestoreHandler, Permissions: writeRuntime},
 
 		// pprof
-		{Method: "GET", Path: "/debug/config", HandlerFunc: s.configHandler},
-		{Method: "GET", Path: "/debug/pprof/cmdline", HandlerFunc: pprof.Cmdline},
-		{Method: "GET", Path: "/debug/pprof/profile", HandlerFunc: pprof.Profile},
-		{Method: "GET", Path: "/debug/pprof/symbol", HandlerFunc: pprof.Symbol},
-		{Method: "GET", Path: "/debug/pprof/trace", HandlerFunc: pprof.Trace},
-		{Method: "GET", Path: "/debug/pprof/", HandlerFunc: pprof.Index},
+		{Method: "GET", Path: "/debug/config", HandlerFunc: s.configHandler, Permissions: readConfig},
+		{Method: "GET", Path: "/debug/loglevel", HandlerFunc: s.logLevelHandler, Permissions: readConfig},
+		{Method: "PUT", Path: "/debug/loglevel", HandlerFunc: s.setLogLevelHandler, Permissions: loadRuntime, ReadOnly: true},
+		{Method: "GET", Path: "/debug/pprof/cmdline", HandlerFunc: pprof.Cmdline, Permissions: readConfig},
+		{Method: "GET", Path: "/debug/pprof/profile", HandlerFunc: pprof.Profile, Permissions: readConfig},
+		{Method: "GET", Path: "/debug/pprof/symbol", HandlerFunc: pprof.Symbol, Permissions: readConfig},
+		{Method: "GET", Path: "/debug/pprof/trace", HandlerFunc: pprof.Trace, Permissions: readConfig},
+		{Method: "GET", Path: "/debug/pprof/", HandlerFunc: pprof.Index, Permissions: readConfig},
 	}
 
 	// runtime pprof endoints
 	for _, p := range runtimepprof.Profiles() {
-		s.httpEndpoints = append(s.httpEndpoints, Endpoint{Method: "GET", Path: "/debug/pprof/" + p.Name(), HandlerFunc: pprof.Index})
+		s.httpEndpoints = append(s.httpEndpoints, Endpoint{Method: "GET", Path: "/debug/pprof/" + p.Name(), HandlerFunc: pprof.Index, Permissions: readConfig})
 	}
 	for _, ep := range s.httpEndpoints {
-		s.httpRouter.MethodFunc(ep.Method, ep.Path, ep.HandlerFunc)
+		ep.HandlerFunc = s.versioned(ep)
+		ep.HandlerFunc = s.audited(ep)
+		ep.HandlerFunc = s.serialized(ep)
+		ep.HandlerFunc = s.withDeadline(ep)
+		s.httpRouter.MethodFunc(ep.Method, ep.Path, traceRoute(ep, s.authorize(ep)))
+	}
+
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", s.cfg.Port), Handler: s.traced(s.logRequests(Panic(negotiateFormat(s.httpRouter))))}
+	httpServer.WriteTimeout = 1 * time.Minute
+	httpServer.ReadTimeout = 1 * time.Minute
+	httpServer.TLSConfig = s.tlsConfig
+	if !s.cfg.HTTP2 {
+		// a non-nil empty map stops net/http from configuring h2
+		httpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	var plainServer *http.Server
+	if plainListener != nil {
+		plainServer = &http.Server{Addr: fmt.Sprintf(":%d", s.cfg.PlainPort), Handler: s.traced(s.logRequests(Panic(negotiateFormat(s.httpRouter))))}
+		plainServer.WriteTimeout = 1 * time.Minute
+		plainServer.ReadTimeout = 1 * time.Minute
+	}
+
+	s.mu.Lock()
+	if s.shuttingDown {
+		// Shutdown or Close was called before we started serving
+		s.mu.Unlock()
+		httpListener.Close()
+		if plainListener != nil {
+			plainListener.Close()
+		}
+		healthcheckListener.Close()
+		return nil
 	}
+	s.httpServer = httpServer
+	s.plainServer = plainServer
+	s.healthcheckServer = healthcheckServer
+	s.mu.Unlock()
+
+	slog.Info("healthchecks listening", "port", s.cfg.HealthPort)
+	go func() {
+		if err := serve(healthcheckServer, healthcheckListener); err != nil && err != http.ErrServerClosed {
+			slog.Error("healthcheck server failure", "error", err)
+		}
+	}()
 
-	log.Printf("listening on %d", s.cfg.Port)
-	s.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", s.cfg.Port), Handler: Panic(s.httpRouter)}
-	s.httpServer.WriteTimeout = 1 * time.Minute
-	s.httpServer.ReadTimeout = 1 * time.Minute
+	if plainServer != nil {
+		slog.Info("plain http listening", "port", s.cfg.PlainPort)
+		go func() {
+			if err := plainServer.Serve(plainListener); err != nil && err != http.ErrServerClosed {
+				slog.Error("plain http server failure", "error", err)
+			}
+		}()
+	}
 
-	if err := s.httpServer.Serve(httpListener); err != nil {
+	slog.Info("listening", "port", s.cfg.Port, "tls", s.tlsConfig != nil)
+	if err := serve(httpServer, httpListener); err != nil {
 		if err != http.ErrServerClosed {
 			return err
 		}
@@ -184,20 +520,133 @@ func (s *Server) listen(httpListener net.Listener) error {
 	return nil
 }
 
+// serve serves srv on l using TLS if srv has a TLSConfig
+func serve(srv *http.Server, l net.Listener) error {
+	if srv.TLSConfig != nil {
+		// certificates come from TLSConfig.GetCertificate
+		return srv.ServeTLS(l, "", "")
+	}
+	return srv.Serve(l)
+}
+
 func Panic(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
-				log.Println(rec, string(debug.Stack()))
+				slog.ErrorContext(r.Context(), "panic", "panic", fmt.Sprint(rec), "stack", string(debug.Stack()))
 			}
 		}()
 		h.ServeHTTP(w, r)
 	})
 }
 
-// Close closes all db connections or any other clean up
+// Shutdown gracefully stops the server. New requests are refused
+// and /readyz starts failing, then Shutdown waits for in-flight
+// requests (e.g. config applies) to finish, stops background jobs and
+// finally closes the admin db connections. If ctx expires first,
+// Shutdown releases every resource anyway and returns an error, though
+// it still waits up to ShutdownTimeout for a write in flight, see
+// release.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	httpServer, plainServer, healthcheckServer := s.httpServer, s.plainServer, s.healthcheckServer
+	s.mu.Unlock()
+
+	var errs []string
+
+	// stop accepting new requests and wait for in flight ones
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("waiting for requests: %v", err))
+		}
+	}
+	if plainServer != nil {
+		if err := plainServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("waiting for plain http requests: %v", err))
+		}
+	}
+
+	// stop background jobs e.g. drains and traffic shifts between steps,
+	// and the reconciler
+	s.cancel()
+	jobsDone := make(chan struct{})
+	go func() {
+		s.jobs.wait()
+		if s.reconciler != nil {
+			s.reconciler.wg.Wait()
+		}
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Sprintf("waiting for jobs: %v", ctx.Err()))
+	}
+
+	if healthcheckServer != nil {
+		if err := healthcheckServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("waiting for healthchecks: %v", err))
+		}
+	}
+
+	s.release()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("unclean shutdown: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// isShuttingDown returns true once Shutdown or Close has been called
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// Close closes all db connections or any other clean up without
+// waiting for in flight requests. Prefer Shutdown.
 func (s *Server) Close() error {
-	defer s.psqlAdminDb.Close()
+	s.mu.Lock()
+	s.shuttingDown = true
+	httpServer, plainServer, healthcheckServer := s.httpServer, s.plainServer, s.healthcheckServer
+	s.mu.Unlock()
+
+	defer s.release()
+	defer s.jobs.wait()
+	if s.reconciler != nil {
+		defer s.reconciler.wg.Wait()
+	}
+	s.cancel()
+	if healthcheckServer != nil {
+		healthcheckServer.Close()
+	}
+	if plainServer != nil {
+		plainServer.Close()
+	}
 	// close socket to stop new requests from coming in
-	return s.httpServer.Close()
+	if httpServer != nil {
+		return httpServer.Close()
+	}
+	return nil
+}
+
+// release closes the admin db connections, once the write in flight,
+// if any, is done, and unblocks Serve. It is safe to call more than
+// once.
+func (s *Server) release() {
+	s.closeOnce.Do(func() {
+		if err := s.writeLock.stopWrites(s.cfg.ShutdownTimeout); err != nil {
+			slog.Error("closing the admin db anyway", "error", err)
+		}
+		if s.psqlAdminDb != nil {
+			s.psqlAdminDb.Close()
+		}
+		if s.audit != nil {
+			s.audit.close()
+		}
+		s.shutdownTracer()
+		close(s.closed)
+	})
 }
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the certificate and key files are
+// checked for changes
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves a certificate/key pair and reloads it when
+// either file changes, so certificates can be rotated without a
+// restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the key pair if either file changed since the last
+// load. c.mu must be held or c must not be shared yet.
+func (c *certReloader) reload() error {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		slog.Info("reloaded TLS certificate", "file", c.certFile)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If reloading
+// fails, e.g. because only one of the files has been replaced so far,
+// the previous certificate keeps being served.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastCheck) > certReloadInterval {
+		c.lastCheck = time.Now()
+		if err := c.reload(); err != nil {
+			slog.Error("unable to reload TLS certificate", "file", c.certFile, "error", err)
+		}
+	}
+	return c.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var ret time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return ret, err
+		}
+		if fi.ModTime().After(ret) {
+			ret = fi.ModTime()
+		}
+	}
+	return ret, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadServerTLSConfig returns the tls.Config used for the API port or
+// nil if TLS is not configured
+func loadServerTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("a TLS client CA requires a TLS certificate and key")
+		}
+		return nil, nil
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, fmt.Errorf("both a TLS certificate and key are required")
+	}
+
+	minVersion, ok := tlsVersions[cfg.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS min version %q", cfg.TLSMinVersion)
+	}
+
+	certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %v", err)
+	}
+
+	ret := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		b, err := ioutil.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS client CA: %v", err)
+		}
+		ret.ClientCAs = x509.NewCertPool()
+		if !ret.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in TLS client CA %s", cfg.TLSClientCAFile)
+		}
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+		if cfg.TLSClientCertOptional {
+			ret.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return ret, nil
+}
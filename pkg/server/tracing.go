@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/trace"
+)
+
+// openTracer returns the tracer exporting to TraceEndpoint or nil if
+// tracing is disabled
+func openTracer(cfg Config) (*trace.Tracer, error) {
+	if cfg.TraceEndpoint == "" {
+		return nil, nil
+	}
+	return trace.New(trace.Config{
+		Endpoint:    cfg.TraceEndpoint,
+		Headers:     cfg.TraceHeaders,
+		ServiceName: cfg.TraceServiceName,
+		SampleRatio: cfg.TraceSampleRatio,
+	})
+}
+
+// traced records every request as a server span, continuing the
+// caller's trace if it sent a W3C traceparent header. Admin statements
+// run with the request context become its children, see admin.WithContext.
+// The span is named after the endpoint by traceRoute once it is known.
+func (s *Server) traced(h http.Handler) http.Handler {
+	if s.tracer == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _ := trace.ParseTraceparent(r.Header.Get("traceparent"))
+		ctx, span := s.tracer.StartRemote(r.Context(), r.Method, trace.KindServer, remote)
+		if span == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			span.SetAttr("client.address", host)
+		}
+		if ua := r.UserAgent(); ua != "" {
+			span.SetAttr("user_agent.original", ua)
+		}
+
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttr("http.response.status_code", rec.status)
+		if id := w.Header().Get("X-Request-Id"); id != "" {
+			span.SetAttr("proxysqlapi.request_id", id)
+		}
+		if rec.status >= 500 {
+			span.SetAttr("error.type", http.StatusText(rec.status))
+			span.SetError(errStatus(rec.status))
+		}
+	})
+}
+
+// traceRoute names the request's span after ep, e.g.
+// "PUT /load/mysql_servers", rather than the raw path
+func traceRoute(ep Endpoint, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if span := trace.SpanFromContext(r.Context()); span != nil {
+			span.SetName(ep.Method + " " + ep.Path)
+			span.SetAttr("http.route", ep.Path)
+		}
+		h(w, r)
+	}
+}
+
+type errStatus int
+
+func (e errStatus) Error() string { return http.StatusText(int(e)) }
+
+// shutdownTracer exports the spans still queued, for at most a few
+// seconds so a dead collector does not hold up exiting
+func (s *Server) shutdownTracer() {
+	if s.tracer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.tracer.Shutdown(ctx); err != nil {
+		slog.Warn("trace: unable to export every span before shutting down", "error", err)
+	}
+}
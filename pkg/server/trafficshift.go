@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jimmyjames85/proxysqlapi/pkg/admin"
+)
+
+const trafficShiftJobKind = "traffic-shift"
+
+// Valid values of TrafficShiftRequest.OnFailure
+const (
+	TrafficShiftOnFailureStop    = "stop"
+	TrafficShiftOnFailureReverse = "reverse"
+)
+
+// TrafficShiftServer identifies a mysql_servers row taking part in a
+// traffic shift. Weight is the weight the server ends up with once
+// the shift completes. It defaults to 0 for source servers and to the
+// average starting weight of the source servers for target servers.
+type TrafficShiftServer struct {
+	HostgroupID int    `json:"hostgroup_id"`
+	Hostname    string `json:"hostname"`
+	Port        int    `json:"port"`
+	Weight      *int   `json:"weight"`
+}
+
+func (t TrafficShiftServer) key() serverKey {
+	return serverKey{HostgroupID: t.HostgroupID, Hostname: t.Hostname, Port: t.Port}
+}
+
+// TrafficShiftRequest is the JSON payload of POST /traffic-shift.
+//
+// Every Interval the weights of all servers move StepPercent of the
+// way from their starting to their final weight. Before each step the
+// target servers are checked in stats_mysql_connection_pool: if the
+// ratio of ConnERR to ConnOK+ConnERR accumulated since the previous
+// step exceeds MaxErrorRate, or a target's Latency_us exceeds
+// MaxLatencyMS, the shift stops (OnFailure "stop") or restores the
+// starting weights (OnFailure "reverse").
+type TrafficShiftRequest struct {
+	Source       []TrafficShiftServer `json:"source"`
+	Target       []TrafficShiftServer `json:"target"`
+	StepPercent  int                  `json:"step_percent"`   // default 10
+	Interval     string               `json:"interval"`       // default 30s
+	MaxErrorRate *float64             `json:"max_error_rate"` // default 0.01, 0 allows no errors
+	MaxLatencyMS int                  `json:"max_latency_ms"` // 0 disables the latency check
+	OnFailure    string               `json:"on_failure"`     // stop (default) or reverse
+}
+
+// TrafficShiftWeight is the starting, current and final weight of a
+// single server
+type TrafficShiftWeight struct {
+	HostgroupID int    `json:"hostgroup_id"`
+	Hostname    string `json:"hostname"`
+	Port        int    `json:"port"`
+	From        int    `json:"from"`
+	Current     int    `json:"current"`
+	To          int    `json:"to"`
+}
+
+// TrafficShiftResult is the result reported by a traffic shift job
+type TrafficShiftResult struct {
+	Percent  int                  `json:"percent"`
+	Reversed bool                 `json:"reversed"`
+	Weights  []TrafficShiftWeight `json:"weights"`
+}
+
+func (t *TrafficShiftRequest) setDefaults() {
+	if t.StepPercent == 0 {
+		t.StepPercent = 10
+	}
+	if t.Interval == "" {
+		t.Interval = "30s"
+	}
+	if t.MaxErrorRate == nil {
+		rate := 0.01
+		t.MaxErrorRate = &rate
+	}
+	if t.OnFailure == "" {
+		t.OnFailure = TrafficShiftOnFailureStop
+	}
+}
+
+func (t *TrafficShiftRequest) validate() error {
+	if len(t.Source) == 0 || len(t.Target) == 0 {
+		return fmt.Errorf("source and target servers are required")
+	}
+	if t.StepPercent < 1 || t.StepPercent > 100 {
+		return fmt.Errorf("step_percent must be between 1 and 100")
+	}
+	if *t.MaxErrorRate < 0 || *t.MaxErrorRate > 1 {
+		return fmt.Errorf("max_error_rate must be between 0 and 1")
+	}
+	if t.OnFailure != TrafficShiftOnFailureStop && t.OnFailure != TrafficShiftOnFailureReverse {
+		return fmt.Errorf("on_failure must be %q or %q", TrafficShiftOnFailureStop, TrafficShiftOnFailureReverse)
+	}
+	seen := make(map[serverKey]bool)
+	for _, srv := range append(append([]TrafficShiftServer{}, t.Source...), t.Target...) {
+		if seen[srv.key()] {
+			return fmt.Errorf("server %s listed more than once", srv.key())
+		}
+		seen[srv.key()] = true
+		if srv.Weight != nil && *srv.Weight < 0 {
+			return fmt.Errorf("weight of server %s cannot be negative", srv.key())
+		}
+	}
+	return nil
+}
+
+func (t *TrafficShiftRequest) target() string {
+	var src, tgt []string
+	for _, srv := range t.Source {
+		src = append(src, srv.key().String())
+	}
+	for _, srv := range t.Target {
+		tgt = append(tgt, srv.key().String())
+	}
+	return strings.Join(src, ",") + "->" + strings.Join(tgt, ",")
+}
+
+// trafficShiftHandler validates the request and starts a traffic
+// shift job. The response is the job, which can be polled at
+// /jobs/{JobID}. Only one traffic shift may run at a time.
+func (s *Server) trafficShiftHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	var req TrafficShiftRequest
+	if err = unmarshalBody(r, b, &req); err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	req.setDefaults()
+	if err = req.validate(); err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	interval, err := time.ParseDuration(req.Interval)
+	if err != nil {
+		s.handleError(w, r, fmt.Errorf("invalid interval: %v", err), http.StatusBadRequest)
+		return
+	}
+	if interval <= 0 {
+		// the error rate and latency checks need time between steps
+		s.handleError(w, r, fmt.Errorf("interval must be positive"), http.StatusBadRequest)
+		return
+	}
+
+	if j := s.jobs.runningKind(trafficShiftJobKind); j != nil {
+		s.handleError(w, r, fmt.Errorf("traffic shift %s is already running", j.ID), http.StatusConflict)
+		return
+	}
+
+	weights, err := s.trafficShiftWeights(s.db(r), req)
+	if err != nil {
+		s.handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	author, requestID := changeAuthor(r), w.Header().Get("X-Request-Id")
+	leaseID := r.Header.Get("X-Lock-Id")
+	j := s.jobs.start(requestContext(s.ctx, r), trafficShiftJobKind, req.target(), func(ctx context.Context, j *Job) error {
+		err := s.runTrafficShift(ctx, j, leaseID, req, interval, weights)
+		// the weights changed after the request returned
+		s.recordConfigVersion(ctx, author, fmt.Sprintf("traffic shift %s (job %s)", req.target(), j.ID), requestID)
+		return err
+	})
+	s.writeJobAccepted(w, j)
+}
+
+// trafficShiftWeights looks up the starting weight of every server and
+// computes its final weight
+func (s *Server) trafficShiftWeights(db admin.DB, req TrafficShiftRequest) ([]TrafficShiftWeight, error) {
+	var weights []TrafficShiftWeight
+	lookup := func(t TrafficShiftServer) (TrafficShiftWeight, error) {
+		srv, err := admin.SelectMysqlServer(db, t.HostgroupID, t.Hostname, t.Port)
+		if err != nil {
+			return TrafficShiftWeight{}, err
+		}
+		if srv == nil {
+			return TrafficShiftWeight{}, admin.NotFound("mysql_servers", t.key().String())
+		}
+		return TrafficShiftWeight{
+			HostgroupID: t.HostgroupID,
+			Hostname:    t.Hostname,
+			Port:        t.Port,
+			From:        srv.Weight,
+			Current:     srv.Weight,
+		}, nil
+	}
+
+	sourceTotal := 0
+	for _, t := range req.Source {
+		w, err := lookup(t)
+		if err != nil {
+			return nil, err
+		}
+		if t.Weight != nil {
+			w.To = *t.Weight
+		}
+		sourceTotal += w.From
+		weights = append(weights, w)
+	}
+
+	defaultTarget := sourceTotal / len(req.Source)
+	if defaultTarget == 0 {
+		defaultTarget = 1
+	}
+	for _, t := range req.Target {
+		w, err := lookup(t)
+		if err != nil {
+			return nil, err
+		}
+		w.To = defaultTarget
+		if t.Weight != nil {
+			w.To = *t.Weight
+		}
+		weights = append(weights, w)
+	}
+	return weights, nil
+}
+
+func (s *Server) runTrafficShift(ctx context.Context, j *Job, leaseID string, req TrafficShiftRequest, interval time.Duration, weights []TrafficShiftWeight) error {
+	res := TrafficShiftResult{Weights: weights}
+	j.SetResult(res)
+
+	targets := make(map[serverKey]bool)
+	for _, t := range req.Target {
+		targets[t.key()] = true
+	}
+
+	prev, err := s.targetPoolStats(ctx, targets)
+	if err != nil {
+		return err
+	}
+
+	for pct := req.StepPercent; ; pct += req.StepPercent {
+		if pct > 100 {
+			pct = 100
+		}
+		for i := range res.Weights {
+			w := &res.Weights[i]
+			w.Current = w.From + (w.To-w.From)*pct/100
+		}
+		if err := s.applyTrafficShiftWeights(ctx, leaseID, res.Weights); err != nil {
+			return err
+		}
+		res.Percent = pct
+		j.SetResult(res)
+		j.Logf("shifted %d%%", pct)
+
+		if err := sleepCtx(ctx, interval); err != nil {
+			return err
+		}
+
+		cur, err := s.targetPoolStats(ctx, targets)
+		if err != nil {
+			return err
+		}
+		if err := checkTrafficShiftHealth(req, prev, cur); err != nil {
+			j.Logf("%v", err)
+			if req.OnFailure == TrafficShiftOnFailureReverse {
+				for i := range res.Weights {
+					res.Weights[i].Current = res.Weights[i].From
+				}
+				if rerr := s.applyTrafficShiftWeights(ctx, leaseID, res.Weights); rerr != nil {
+					return fmt.Errorf("%v; reversing failed: %v", err, rerr)
+				}
+				res.Percent = 0
+				res.Reversed = true
+				j.SetResult(res)
+				j.Logf("restored starting weights")
+			}
+			return err
+		}
+		prev = cur
+
+		if pct == 100 {
+			return nil
+		}
+	}
+}
+
+// applyTrafficShiftWeights writes the current weights to memory and
+// loads mysql_servers to runtime, under the write lock and leaseID
+func (s *Server) applyTrafficShiftWeights(ctx context.Context, leaseID string, weights []TrafficShiftWeight) error {
+	unlock, err := s.lockWrites(ctx, leaseID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	db := admin.WithContext(ctx, s.psqlAdminDb)
+	for _, w := range weights {
+		srv, err := admin.SelectMysqlServer(db, w.HostgroupID, w.Hostname, w.Port)
+		if err != nil {
+			return err
+		}
+		if srv == nil {
+			return fmt.Errorf("mysql_server %d:%s:%d no longer exists", w.HostgroupID, w.Hostname, w.Port)
+		}
+		srv.Weight = w.Current
+		if err = admin.UpdateMysqlServer(db, *srv); err != nil {
+			return err
+		}
+	}
+	return admin.LoadMysqlServersToRuntime(db)
+}
+
+// targetPoolStats returns the stats_mysql_connection_pool rows of
+// the given servers
+func (s *Server) targetPoolStats(ctx context.Context, targets map[serverKey]bool) (map[serverKey]admin.StatsMysqlConnectionPool, error) {
+	pool, err := admin.SelectStatsMysqlConnectionPool(admin.WithContext(ctx, s.psqlAdminDb))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[serverKey]admin.StatsMysqlConnectionPool)
+	for _, p := range pool {
+		k := serverKey{HostgroupID: p.Hostgroup, Hostname: p.SrvHost, Port: p.SrvPort}
+		if targets[k] {
+			ret[k] = p
+		}
+	}
+	return ret, nil
+}
+
+// checkTrafficShiftHealth compares the connection pool stats of the
+// target servers before and after a step
+func checkTrafficShiftHealth(req TrafficShiftRequest, prev, cur map[serverKey]admin.StatsMysqlConnectionPool) error {
+	for k, c := range cur {
+		p := prev[k]
+		connErr := c.ConnERR - p.ConnERR
+		connOK := c.ConnOK - p.ConnOK
+		if connErr < 0 || connOK < 0 {
+			// counters were reset e.g. by reading stats_mysql_connection_pool_reset
+			connErr, connOK = c.ConnERR, c.ConnOK
+		}
+		if total := connErr + connOK; total > 0 {
+			if rate := float64(connErr) / float64(total); rate > *req.MaxErrorRate {
+				return fmt.Errorf("server %s error rate %.4f exceeds max_error_rate %.4f", k, rate, *req.MaxErrorRate)
+			}
+		}
+		if req.MaxLatencyMS > 0 && c.LatencyUS > req.MaxLatencyMS*1000 {
+			return fmt.Errorf("server %s latency %dus exceeds max_latency_ms %d", k, c.LatencyUS, req.MaxLatencyMS)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	exportQueueSize = 2048             // spans waiting for export, more are dropped
+	exportBatchSize = 512              // spans per request to the collector
+	exportInterval  = 5 * time.Second  // how long a span may wait for a full batch
+	exportTimeout   = 10 * time.Second // per request to the collector
+)
+
+// The OTLP/HTTP JSON encoding of an ExportTraceServiceRequest, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+// Ids are hex and 64 bit integers are strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func toOTLPAttr(a Attr) otlpAttr {
+	var v otlpValue
+	switch x := a.Value.(type) {
+	case string:
+		v.StringValue = &x
+	case bool:
+		v.BoolValue = &x
+	case int:
+		s := strconv.Itoa(x)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &x
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpAttr{Key: a.Key, Value: v}
+}
+
+// toOTLP snapshots s, which must be locked
+func (s *Span) toOTLP() otlpSpan {
+	o := otlpSpan{
+		TraceID:           s.sc.TraceIDString(),
+		SpanID:            s.sc.SpanIDString(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: s.status, Message: s.statusMsg},
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = SpanContext{SpanID: s.parent}.SpanIDString()
+	}
+	for _, a := range s.attrs {
+		o.Attributes = append(o.Attributes, toOTLPAttr(a))
+	}
+	return o
+}
+
+// exporter sends finished spans to the collector in batches from a
+// single goroutine, so a slow collector never holds up a request.
+// When the queue is full spans are dropped.
+type exporter struct {
+	cfg      Config
+	client   *http.Client
+	resource otlpResource
+
+	queue chan otlpSpan
+	done  chan struct{}
+
+	mu      sync.Mutex
+	dropped int
+	closed  bool
+}
+
+func newExporter(cfg Config) *exporter {
+	e := &exporter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: exportTimeout},
+		resource: otlpResource{Attributes: []otlpAttr{
+			toOTLPAttr(Attr{Key: "service.name", Value: cfg.ServiceName}),
+		}},
+		queue: make(chan otlpSpan, exportQueueSize),
+		done:  make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *exporter) export(s *Span) {
+	s.mu.Lock()
+	o := s.toOTLP()
+	s.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- o:
+	default:
+		e.dropped++
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+	send := func() {
+		if len(batch) > 0 {
+			e.send(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				send()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= exportBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		}
+	}
+}
+
+func (e *exporter) send(batch []otlpSpan) {
+	e.mu.Lock()
+	dropped := e.dropped
+	e.dropped = 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		slog.Warn("trace: export queue full, spans dropped", "dropped", dropped)
+	}
+
+	b, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: e.resource,
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/jimmyjames85/proxysqlapi"},
+			Spans: batch,
+		}},
+	}}})
+	if err != nil {
+		slog.Error("trace: unable to encode spans", "error", err)
+		return
+	}
+	req, err := http.NewRequest("POST", e.cfg.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		slog.Error("trace: unable to export spans", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		slog.Warn("trace: unable to export spans", "spans", len(batch), "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("trace: collector rejected spans", "spans", len(batch), "status", resp.StatusCode, "body", string(body))
+	}
+}
+
+// shutdown stops accepting spans and waits for the queued ones to be
+// sent or for ctx to be done
+func (e *exporter) shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("exporting queued spans: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,295 @@
+// Package trace records spans of HTTP requests and admin statements
+// and exports them to an OpenTelemetry collector over OTLP/HTTP. It
+// implements only the small part of OpenTelemetry proxysqlapi needs:
+// W3C trace context propagation, parent based sampling and batched
+// export of finished spans.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as numbered by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span status codes, as numbered by OTLP
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Valid returns true if neither id is all zeros
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceIDString returns the trace id in hex
+func (sc SpanContext) TraceIDString() string { return hex.EncodeToString(sc.TraceID[:]) }
+
+// SpanIDString returns the span id in hex
+func (sc SpanContext) SpanIDString() string { return hex.EncodeToString(sc.SpanID[:]) }
+
+// Traceparent returns sc as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceIDString(), sc.SpanIDString(), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value, see
+// https://www.w3.org/TR/trace-context/#traceparent-header. Headers of
+// a later version are parsed as version 00, as the spec requires, and
+// ids must be lowercase hex.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || !isLowerHex(parts[0]) || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if !isLowerHex(parts[1]) || !isLowerHex(parts[2]) || !isLowerHex(parts[3]) {
+		return sc, false
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	flags, _ := hex.DecodeString(parts[3])
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
+
+// isLowerHex returns true if s only holds the characters 0-9 and a-f.
+// hex.Decode also accepts A-F, which the spec does not allow.
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Attr is a span attribute. Value is a string, bool, int, int64 or
+// float64.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a single timed operation. A nil *Span is valid and does
+// nothing, which is what Start returns for unsampled requests, so
+// callers never need to check.
+type Span struct {
+	tracer *Tracer
+
+	mu        sync.Mutex
+	name      string
+	kind      int
+	sc        SpanContext
+	parent    [8]byte
+	start     time.Time
+	end       time.Time
+	attrs     []Attr
+	status    int
+	statusMsg string
+	ended     bool
+}
+
+// SpanContext returns the ids of s
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetName renames s, e.g. once the route of a request is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttr sets an attribute on s, replacing any with the same key
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.attrs {
+		if s.attrs[i].Key == key {
+			s.attrs[i].Value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, Attr{Key: key, Value: value})
+}
+
+// SetError marks s as failed with err. A nil err does nothing.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = StatusError
+	s.statusMsg = err.Error()
+}
+
+// End finishes s and queues it for export. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.exporter.export(s)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying s, so spans started
+// from it become its children
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span stored in ctx or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a child of the span in ctx. If ctx holds no span, e.g.
+// because tracing is disabled or the request was not sampled, it
+// returns ctx and a nil span.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, kind, parent.sc.TraceID, parent.sc.SpanID)
+	return ContextWithSpan(ctx, s), s
+}
+
+// Config configures a Tracer
+type Config struct {
+	Endpoint    string            // OTLP/HTTP traces URL e.g. http://localhost:4318/v1/traces
+	Headers     map[string]string // sent with every export, e.g. for auth
+	ServiceName string
+	SampleRatio float64 // share of traces started here which are recorded, 0 to 1
+}
+
+// Tracer starts root spans and exports finished spans
+type Tracer struct {
+	cfg      Config
+	exporter *exporter
+}
+
+// New returns a Tracer exporting to cfg.Endpoint. Call Shutdown to
+// export the spans still queued.
+func New(cfg Config) (*Tracer, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("a trace endpoint is required")
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("trace sample ratio must be between 0 and 1, got %v", cfg.SampleRatio)
+	}
+	t := &Tracer{cfg: cfg}
+	t.exporter = newExporter(cfg)
+	return t, nil
+}
+
+// StartRemote starts a root span of this process, continuing the
+// caller's trace if remote is valid. The caller's sampling decision
+// is kept; otherwise new traces are sampled at SampleRatio. Unsampled
+// requests get a nil span.
+func (t *Tracer) StartRemote(ctx context.Context, name string, kind int, remote SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if remote.Valid() {
+		if !remote.Sampled {
+			return ctx, nil
+		}
+		s := t.newSpan(name, kind, remote.TraceID, remote.SpanID)
+		return ContextWithSpan(ctx, s), s
+	}
+	var traceID [16]byte
+	rand.Read(traceID[:])
+	if !t.sampled(traceID) {
+		return ctx, nil
+	}
+	s := t.newSpan(name, kind, traceID, [8]byte{})
+	return ContextWithSpan(ctx, s), s
+}
+
+// sampled decides from the trace id alone, like OpenTelemetry's
+// TraceIDRatioBased sampler, so the decision is stable for a trace
+func (t *Tracer) sampled(traceID [16]byte) bool {
+	if t.cfg.SampleRatio >= 1 {
+		return true
+	}
+	bound := uint64(t.cfg.SampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+func (t *Tracer) newSpan(name string, kind int, traceID [16]byte, parent [8]byte) *Span {
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		parent: parent,
+		start:  time.Now(),
+	}
+	s.sc.TraceID = traceID
+	s.sc.Sampled = true
+	rand.Read(s.sc.SpanID[:])
+	return s
+}
+
+// Shutdown exports the spans still queued, giving up when ctx is done
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.shutdown(ctx)
+}
@@ -0,0 +1,243 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{name: "sampled", header: "00-" + traceID + "-" + spanID + "-01", ok: true, sampled: true},
+		{name: "not sampled", header: "00-" + traceID + "-" + spanID + "-00", ok: true},
+		{name: "only the sampled flag counts", header: "00-" + traceID + "-" + spanID + "-03", ok: true, sampled: true},
+		{name: "unknown flags", header: "00-" + traceID + "-" + spanID + "-02", ok: true},
+		{name: "surrounding whitespace", header: " 00-" + traceID + "-" + spanID + "-01\t", ok: true, sampled: true},
+		{name: "future version", header: "cc-" + traceID + "-" + spanID + "-01", ok: true, sampled: true},
+		{name: "future version with more fields", header: "cc-" + traceID + "-" + spanID + "-01-what-the-future-holds", ok: true, sampled: true},
+		{name: "version 00 with more fields", header: "00-" + traceID + "-" + spanID + "-01-extra"},
+		{name: "version ff", header: "ff-" + traceID + "-" + spanID + "-01"},
+		{name: "uppercase version", header: "0A-" + traceID + "-" + spanID + "-01"},
+		{name: "uppercase trace id", header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01"},
+		{name: "uppercase span id", header: "00-" + traceID + "-00F067AA0BA902B7-01"},
+		{name: "uppercase flags", header: "00-" + traceID + "-" + spanID + "-0A"},
+		{name: "all zero trace id", header: "00-00000000000000000000000000000000-" + spanID + "-01"},
+		{name: "all zero span id", header: "00-" + traceID + "-0000000000000000-01"},
+		{name: "short trace id", header: "00-" + traceID[1:] + "-" + spanID + "-01"},
+		{name: "long span id", header: "00-" + traceID + "-" + spanID + "0-01"},
+		{name: "not hex", header: "00-" + traceID + "-" + "00f067aa0ba902bz" + "-01"},
+		{name: "three digit version", header: "000-" + traceID + "-" + spanID + "-01"},
+		{name: "missing flags", header: "00-" + traceID + "-" + spanID},
+		{name: "empty", header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.TraceIDString() != traceID || sc.SpanIDString() != spanID {
+				t.Errorf("ids = %s %s, want %s %s", sc.TraceIDString(), sc.SpanIDString(), traceID, spanID)
+			}
+			if sc.Sampled != tt.sampled {
+				t.Errorf("sampled = %v, want %v", sc.Sampled, tt.sampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, sampled := range []bool{true, false} {
+		sc := SpanContext{Sampled: sampled}
+		hex.Decode(sc.TraceID[:], []byte("4bf92f3577b34da6a3ce929d0e0e4736"))
+		hex.Decode(sc.SpanID[:], []byte("00f067aa0ba902b7"))
+		got, ok := ParseTraceparent(sc.Traceparent())
+		if !ok || got != sc {
+			t.Errorf("ParseTraceparent(%q) = %+v, %v, want %+v", sc.Traceparent(), got, ok, sc)
+		}
+	}
+}
+
+func TestSampled(t *testing.T) {
+	traceID := func(low string) [16]byte {
+		var id [16]byte
+		hex.Decode(id[:], []byte("4bf92f3577b34da6"+low))
+		return id
+	}
+	tests := []struct {
+		name    string
+		ratio   float64
+		traceID [16]byte
+		want    bool
+	}{
+		{name: "ratio 0, lowest id", ratio: 0, traceID: traceID("0000000000000000")},
+		{name: "ratio 0, highest id", ratio: 0, traceID: traceID("ffffffffffffffff")},
+		{name: "ratio 1, lowest id", ratio: 1, traceID: traceID("0000000000000000"), want: true},
+		{name: "ratio 1, highest id", ratio: 1, traceID: traceID("ffffffffffffffff"), want: true},
+		{name: "ratio 0.5, below the bound", ratio: 0.5, traceID: traceID("7fffffffffffffff"), want: true},
+		{name: "ratio 0.5, at the bound", ratio: 0.5, traceID: traceID("8000000000000000")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &Tracer{cfg: Config{SampleRatio: tt.ratio}}
+			if got := tr.sampled(tt.traceID); got != tt.want {
+				t.Errorf("sampled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartRemote(t *testing.T) {
+	tr := &Tracer{cfg: Config{SampleRatio: 0}}
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	// the caller's sampling decision wins over the ratio
+	_, s := tr.StartRemote(context.Background(), "GET", KindServer, remote)
+	if s == nil {
+		t.Fatal("expected a span for a sampled caller")
+	}
+	if s.sc.TraceID != remote.TraceID || s.parent != remote.SpanID {
+		t.Errorf("span %s/%s does not continue the caller's trace", s.sc.TraceIDString(), SpanContext{SpanID: s.parent}.SpanIDString())
+	}
+
+	remote.Sampled = false
+	if _, s = tr.StartRemote(context.Background(), "GET", KindServer, remote); s != nil {
+		t.Error("expected no span for an unsampled caller")
+	}
+	if _, s = tr.StartRemote(context.Background(), "GET", KindServer, SpanContext{}); s != nil {
+		t.Error("expected no span for a new trace at ratio 0")
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer collector.Close()
+
+	tr, err := New(Config{
+		Endpoint:    collector.URL,
+		Headers:     map[string]string{"Authorization": "Bearer secret"},
+		ServiceName: "proxysqlapi",
+		SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	root := &Span{
+		tracer: tr,
+		name:   "PUT /load/mysql_servers",
+		kind:   KindServer,
+		start:  start,
+		end:    start.Add(1500 * time.Microsecond),
+		attrs: []Attr{
+			{Key: "http.request.method", Value: "PUT"},
+			{Key: "http.response.status_code", Value: 200},
+		},
+	}
+	hex.Decode(root.sc.TraceID[:], []byte("4bf92f3577b34da6a3ce929d0e0e4736"))
+	hex.Decode(root.sc.SpanID[:], []byte("00f067aa0ba902b7"))
+	child := &Span{
+		tracer: tr,
+		name:   "admin query",
+		kind:   KindClient,
+		sc:     SpanContext{TraceID: root.sc.TraceID},
+		parent: root.sc.SpanID,
+		start:  start.Add(100 * time.Microsecond),
+		end:    start.Add(1200 * time.Microsecond),
+		attrs: []Attr{
+			{Key: "db.system", Value: "mysql"},
+			{Key: "db.rows", Value: int64(3)},
+			{Key: "db.cached", Value: false},
+			{Key: "db.load", Value: 0.25},
+		},
+		status:    StatusError,
+		statusMsg: "connection refused",
+	}
+	hex.Decode(child.sc.SpanID[:], []byte("53995c3f42cd8ad8"))
+
+	// export directly rather than through End, which sets the end time
+	tr.exporter.export(root)
+	tr.exporter.export(child)
+	if err = tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"resourceSpans": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "proxysqlapi"}}]},
+		"scopeSpans": [{
+			"scope": {"name": "github.com/jimmyjames85/proxysqlapi"},
+			"spans": [
+				{
+					"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+					"spanId": "00f067aa0ba902b7",
+					"name": "PUT /load/mysql_servers",
+					"kind": 2,
+					"startTimeUnixNano": "1700000000000000000",
+					"endTimeUnixNano": "1700000000001500000",
+					"attributes": [
+						{"key": "http.request.method", "value": {"stringValue": "PUT"}},
+						{"key": "http.response.status_code", "value": {"intValue": "200"}}
+					],
+					"status": {}
+				},
+				{
+					"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+					"spanId": "53995c3f42cd8ad8",
+					"parentSpanId": "00f067aa0ba902b7",
+					"name": "admin query",
+					"kind": 3,
+					"startTimeUnixNano": "1700000000000100000",
+					"endTimeUnixNano": "1700000000001200000",
+					"attributes": [
+						{"key": "db.system", "value": {"stringValue": "mysql"}},
+						{"key": "db.rows", "value": {"intValue": "3"}},
+						{"key": "db.cached", "value": {"boolValue": false}},
+						{"key": "db.load", "value": {"doubleValue": 0.25}}
+					],
+					"status": {"code": 2, "message": "connection refused"}
+				}
+			]
+		}]
+	}]}`
+	var buf bytes.Buffer
+	if err = json.Compact(&buf, []byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-bodies:
+		if !bytes.Equal(got, buf.Bytes()) {
+			t.Errorf("got  %s\nwant %s", got, buf.Bytes())
+		}
+	default:
+		t.Fatal("no spans were exported")
+	}
+}